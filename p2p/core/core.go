@@ -1,85 +1,307 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"os"
 	"sync"
+	"time"
 
 	"p2p/hole_punching/client"
+	"p2p/logging"
 	"p2p/shared"
 )
 
+// Time a message waits for the encrypted channel with the other peer
+const sendTimeout = 5 * time.Second
+
 type Core struct {
 	client *client.Client
 	mutex  sync.Mutex
+	code   string
+	// Connection request of another peer waiting for an answer of the app
+	incoming *shared.Peer
+	// Connection request of the app, sent once registered with the rendez-vous server
+	requests chan func(client *client.Client) error
+	// Last error answered by the rendez-vous server
+	lastError *shared.Error
+	// Level of the logs of the core and its client, info by default
+	level  *slog.LevelVar
+	logger *slog.Logger
+	// Stops the client and the goroutine sending the connection request, set by Start
+	cancel context.CancelFunc
 }
 
 func NewCore(addrStr string, username string) *Core {
-	client, err := client.NewClient(username, addrStr)
+	core := &Core{
+		requests: make(chan func(client *client.Client) error, 1),
+		level:    &slog.LevelVar{},
+	}
+
+	logger, err := logging.New(os.Stderr, core.level, "text")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	options := client.DefaultOptions()
+	options.ServerAddr = addrStr
+	options.Logger = logger
+
+	client, err := client.NewClient(username, options)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	client.OnRegistered(registeredCallback)
+	core.client = client
+	core.logger = logger.With("peer", client.GetCurrentPeer().ID)
+
 	client.OnConnecting(connectingCallback)
 	client.OnConnected(connectedCallback)
 	client.OnMessage(messageCallback)
+	client.OnCode(core.codeCallback)
+	client.OnAuthenticated(authenticatedCallback)
+	client.OnIncoming(core.incomingCallback)
+	client.OnResumed(resumedCallback)
+	client.OnDisconnected(disconnectedCallback)
+	client.OnError(core.errorCallback)
 
-	return &Core{
-		client: client,
-	}
+	return core
 }
 
 func (core *Core) SetPeerID(peerID string) {
+	core.request(func(client *client.Client) error {
+		fmt.Printf("Establishing connection with peer %s...", peerID)
+		_, err := client.Establish(context.Background(), peerID)
+		return err
+	})
+}
+
+// Create a pairing code, available with GetCode once received from the rendez-vous server
+func (core *Core) CreateCode() {
+	core.request(func(client *client.Client) error {
+		return client.CreateCode()
+	})
+}
+
+func (core *Core) JoinCode(code string) {
+	core.request(func(client *client.Client) error {
+		fmt.Printf("Joining pairing code %s...", code)
+		return client.JoinCode(code)
+	})
+}
+
+// Last pairing code created, empty if there is none yet
+func (core *Core) GetCode() string {
 	core.mutex.Lock()
-	core.client.SetOtherPeer(&shared.Peer{ID: peerID})
-	core.mutex.Unlock()
+	defer core.mutex.Unlock()
+
+	return core.code
+}
+
+// Username of the peer asking to connect, empty if there is no pending request
+func (core *Core) GetIncomingUsername() string {
+	core.mutex.Lock()
+	defer core.mutex.Unlock()
+
+	if core.incoming == nil {
+		return ""
+	}
+
+	return core.incoming.Username
+}
+
+// Identity key fingerprint of the peer asking to connect, to be compared out of band
+func (core *Core) GetIncomingFingerprint() string {
+	core.mutex.Lock()
+	defer core.mutex.Unlock()
+
+	if core.incoming == nil {
+		return ""
+	}
+
+	return core.incoming.Fingerprint()
+}
+
+// Accept the pending connection request, the peers are then introduced to each other
+func (core *Core) AcceptIncoming() {
+	if peer := core.takeIncoming(); peer != nil {
+		if err := core.client.Accept(peer.ID); err != nil {
+			core.logger.Error("Could not accept the connection request", "target", peer.ID, "err", err)
+		}
+	}
+}
+
+func (core *Core) DeclineIncoming() {
+	if peer := core.takeIncoming(); peer != nil {
+		if err := core.client.Decline(peer.ID); err != nil {
+			core.logger.Error("Could not decline the connection request", "target", peer.ID, "err", err)
+		}
+	}
+}
+
+// Code of the last error answered by the rendez-vous server, e.g. unknown_peer or rate_limited, empty if there is none
+func (core *Core) GetLastErrorCode() string {
+	core.mutex.Lock()
+	defer core.mutex.Unlock()
+
+	if core.lastError == nil {
+		return ""
+	}
+
+	return string(core.lastError.Code)
+}
+
+func (core *Core) GetLastErrorMessage() string {
+	core.mutex.Lock()
+	defer core.mutex.Unlock()
+
+	if core.lastError == nil {
+		return ""
+	}
+
+	return core.lastError.Message
 }
 
 func (core *Core) Start() error {
-	if err := core.client.Start(); err != nil {
-		log.Println(err)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if err := core.client.Start(ctx); err != nil {
+		cancel()
+		core.logger.Error("Could not start the client", "err", err)
+		return err
+	}
+
+	core.mutex.Lock()
+	core.cancel = cancel
+	core.mutex.Unlock()
+
+	go core.run(ctx)
+
+	return nil
+}
+
+// Call when the device switches networks, e.g. from Wi-Fi to cellular, the session with the peer is resumed
+func (core *Core) NetworkChanged() {
+	if err := core.client.Reconnect(); err != nil {
+		core.logger.Error("Could not reconnect", "err", err)
+	}
+}
+
+// Log level of the core and its client: debug, info, warn or error
+func (core *Core) SetLogLevel(level string) error {
+	parsed, err := logging.ParseLevel(level)
+	if err != nil {
 		return err
 	}
 
+	core.level.Set(parsed)
+
 	return nil
 }
 
 func (core *Core) Stop() {
+	core.mutex.Lock()
+	cancel := core.cancel
+	core.mutex.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+
 	core.client.Stop()
 }
 
 func (core *Core) SendMessage(text string) {
-	currentPeer := core.client.GetCurrentPeer()
-	otherPeerConn := core.client.GetOtherPeerConn()
-
-	if otherPeerConn == nil {
-		log.Println("No Peer connected yet!")
+	if core.client.GetOtherPeerConn() == nil {
+		core.logger.Warn("No Peer connected yet!")
 		return
 	}
 
-	otherPeerConn.Send(&shared.Message{
-		Type:    "message",
-		PeerID:  currentPeer.ID,
-		Content: text,
-	})
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+
+	if err := core.client.Send(ctx, text); err != nil {
+		core.logger.Warn("Could not send the message", "err", err)
+	}
 }
 
 // MARK: - Private
 
-func registeredCallback(client *client.Client) {
+func (core *Core) request(request func(client *client.Client) error) {
+	select {
+	case core.requests <- request:
+	default:
+		core.logger.Warn("A connection request is already pending!")
+	}
+}
+
+// Wait for the registration and the connection request of the app, outside of the handlers of the client
+func (core *Core) run(ctx context.Context) {
 	for {
-		if otherPeer := client.GetOtherPeer(); otherPeer != nil {
-			fmt.Printf("Establishing connection with peer %s...", otherPeer.ID)
-
-			client.GetRDVServerConn().Send(&shared.Message{
-				Type:    "establish",
-				PeerID:  client.GetCurrentPeer().ID,
-				Content: otherPeer.ID,
-			})
+		err := core.client.Register(ctx)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil || errors.Is(err, client.ErrClientStopped) {
 			return
 		}
+
+		core.logger.Warn("Could not register with the rendez-vous server", "err", err)
+	}
+
+	select {
+	case request := <-core.requests:
+		if err := request(core.client); err != nil {
+			core.logger.Error("Connection request failed", "err", err)
+		}
+	case <-ctx.Done():
+	}
+}
+
+func (core *Core) takeIncoming() *shared.Peer {
+	core.mutex.Lock()
+	defer core.mutex.Unlock()
+
+	peer := core.incoming
+	core.incoming = nil
+
+	return peer
+}
+
+func (core *Core) incomingCallback(client *client.Client, peer *shared.Peer) {
+	core.mutex.Lock()
+	core.incoming = peer
+	core.mutex.Unlock()
+
+	fmt.Printf("%s wants to connect\n", peer.Username)
+}
+
+func (core *Core) errorCallback(client *client.Client, err error) {
+	var protocolErr *shared.Error
+	if !errors.As(err, &protocolErr) {
+		return
 	}
+
+	core.mutex.Lock()
+	core.lastError = protocolErr
+	core.mutex.Unlock()
+
+	core.logger.Warn("Rendez-vous server answered an error", "errorCode", protocolErr.Code, "err", protocolErr)
+}
+
+func (core *Core) codeCallback(client *client.Client, code string) {
+	core.mutex.Lock()
+	core.code = code
+	core.mutex.Unlock()
+
+	fmt.Printf("Pairing code: %s\n", code)
+}
+
+func authenticatedCallback(client *client.Client) {
+	fmt.Println("Peer authenticated with the pairing code")
 }
 
 func connectingCallback(client *client.Client) {
@@ -98,6 +320,18 @@ func connectedCallback(client *client.Client) {
 	fmt.Printf("Connected to %s!\n", peer.Username)
 }
 
+func resumedCallback(client *client.Client) {
+	peer := client.GetOtherPeer()
+
+	fmt.Printf("Resumed connection with %s\n", peer.Username)
+}
+
+func disconnectedCallback(client *client.Client) {
+	peer := client.GetOtherPeer()
+
+	fmt.Printf("%s left\n", peer.Username)
+}
+
 func messageCallback(client *client.Client, text string) {
 	fmt.Printf("Received sent a message: %s", text)
 }
@@ -34,6 +34,13 @@ func GenKeyPair() ([32]byte, [32]byte, error) {
 	return pri, pub, nil
 }
 
+// Public key of a Curve25519 private key
+func GenPublicKey(pri [32]byte) [32]byte {
+	var pub [32]byte
+	curve25519.ScalarBaseMult(&pub, &pri)
+	return pub
+}
+
 // Shared secret generation with Curve25519 Diffie-Hellman function
 // http://cr.yp.to/ecdh.html
 func GenSharedSecret(selfPrivate [32]byte, otherPublic [32]byte) [32]byte {
@@ -49,6 +56,14 @@ func Hash(tag string, data []byte) []byte {
 	return h.Sum(nil)
 }
 
+// HMAC + SHA2 of the data keyed by a secret, the tag separates the uses of the same secret
+func MAC(secret [32]byte, tag string, data []byte) []byte {
+	h := hmac.New(sha512.New512_256, secret[:])
+	h.Write([]byte(tag))
+	h.Write(data)
+	return h.Sum(nil)
+}
+
 // https://github.com/gtank/cryptopasta/blob/master/encrypt.go
 func Encrypt(plaintext []byte, secret [32]byte) ([]byte, error) {
 	block, err := aes.NewCipher(secret[:])
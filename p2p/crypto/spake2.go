@@ -0,0 +1,180 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"filippo.io/edwards25519"
+)
+
+var ErrSPAKE2NotFinished = errors.New("SPAKE2 exchange is not finished")
+
+// Blinding point of symmetric SPAKE2, nobody knows its discrete logarithm
+var spake2S = hashToPoint("p2p hole punching SPAKE2 symmetric point S")
+
+// Password authenticated key exchange, both peers run the same code with the
+// same short password and derive the same key, which an active attacker
+// (such as the rendez-vous server) cannot learn without guessing the password.
+// Symmetric SPAKE2 over edwards25519, as in magic-wormhole.
+// https://datatracker.ietf.org/doc/html/rfc9382
+type SPAKE2 struct {
+	password []byte
+	w        *edwards25519.Scalar
+	x        *edwards25519.Scalar
+	message  []byte
+
+	otherMessage    []byte
+	key             [32]byte
+	confirmationKey [32]byte
+}
+
+// Hash a seed to a point of the prime order subgroup by try-and-increment
+func hashToPoint(seed string) *edwards25519.Point {
+	for i := 0; ; i += 1 {
+		h := sha512.Sum512([]byte(fmt.Sprintf("%s %d", seed, i)))
+
+		point, err := new(edwards25519.Point).SetBytes(h[:32])
+		if err != nil {
+			continue
+		}
+
+		point.MultByCofactor(point)
+		if point.Equal(edwards25519.NewIdentityPoint()) == 1 {
+			continue
+		}
+
+		return point
+	}
+}
+
+func hashToScalar(tag string, data []byte) *edwards25519.Scalar {
+	h := sha512.New()
+	h.Write([]byte(tag))
+	h.Write(data)
+
+	// SetUniformBytes only fails when the input is not 64 bytes long
+	scalar, _ := edwards25519.NewScalar().SetUniformBytes(h.Sum(nil))
+	return scalar
+}
+
+func NewSPAKE2(password []byte) (*SPAKE2, error) {
+	var seed [64]byte
+	_, err := rand.Read(seed[:])
+	if err != nil {
+		return nil, err
+	}
+
+	x, err := edwards25519.NewScalar().SetUniformBytes(seed[:])
+	if err != nil {
+		return nil, err
+	}
+
+	w := hashToScalar("p2p hole punching SPAKE2 password", password)
+
+	// X = x*B + w*S
+	X := new(edwards25519.Point).ScalarBaseMult(x)
+	X.Add(X, new(edwards25519.Point).ScalarMult(w, spake2S))
+
+	return &SPAKE2{
+		password: password,
+		w:        w,
+		x:        x,
+		message:  X.Bytes(),
+	}, nil
+}
+
+// Message to send to the other peer
+func (spake *SPAKE2) Message() []byte {
+	return spake.message
+}
+
+// Derive the session key from the message of the other peer.
+// The key only matches the other peer's one if both used the same password,
+// which is checked with the confirmations.
+func (spake *SPAKE2) Finish(otherMessage []byte) ([32]byte, error) {
+	if spake.otherMessage != nil {
+		if !hmac.Equal(spake.otherMessage, otherMessage) {
+			return spake.key, errors.New("SPAKE2 exchange already finished with another message")
+		}
+
+		return spake.key, nil
+	}
+
+	if hmac.Equal(spake.message, otherMessage) {
+		return spake.key, errors.New("SPAKE2 message reflected")
+	}
+
+	Y, err := new(edwards25519.Point).SetBytes(otherMessage)
+	if err != nil {
+		return spake.key, errors.New("malformed SPAKE2 message")
+	}
+
+	// The identity and the other points of small order carry no contribution of the other peer
+	if new(edwards25519.Point).MultByCofactor(Y).Equal(edwards25519.NewIdentityPoint()) == 1 {
+		return spake.key, errors.New("invalid SPAKE2 message")
+	}
+
+	// K = x*(Y - w*S)
+	K := new(edwards25519.Point).Subtract(Y, new(edwards25519.Point).ScalarMult(spake.w, spake2S))
+	K.ScalarMult(spake.x, K)
+	if K.Equal(edwards25519.NewIdentityPoint()) == 1 {
+		return spake.key, errors.New("invalid SPAKE2 message")
+	}
+
+	// Both peers hash the same transcript, messages are sorted since there are no roles
+	first, second := spake.message, otherMessage
+	if string(first) > string(second) {
+		first, second = second, first
+	}
+
+	passwordHash := sha256.Sum256(spake.password)
+
+	h := sha512.New()
+	for _, part := range [][]byte{[]byte("p2p hole punching SPAKE2"), passwordHash[:], first, second, K.Bytes()} {
+		binary.Write(h, binary.BigEndian, uint64(len(part)))
+		h.Write(part)
+	}
+	sum := h.Sum(nil)
+
+	copy(spake.key[:], sum[:32])
+	copy(spake.confirmationKey[:], sum[32:])
+	spake.otherMessage = otherMessage
+
+	return spake.key, nil
+}
+
+// Session key, only valid once finished
+func (spake *SPAKE2) Key() [32]byte {
+	return spake.key
+}
+
+// Confirmation to send to the other peer once finished, proves we know the key
+func (spake *SPAKE2) Confirmation() []byte {
+	return spake.confirm(spake.message, spake.otherMessage)
+}
+
+// Check the confirmation sent by the other peer
+func (spake *SPAKE2) VerifyConfirmation(confirmation []byte) error {
+	if spake.otherMessage == nil {
+		return ErrSPAKE2NotFinished
+	}
+
+	if !hmac.Equal(confirmation, spake.confirm(spake.otherMessage, spake.message)) {
+		return errors.New("SPAKE2 confirmation does not match, the passwords are different")
+	}
+
+	return nil
+}
+
+// Each side MACs its own message first so that a confirmation cannot be reflected
+func (spake *SPAKE2) confirm(first []byte, second []byte) []byte {
+	mac := hmac.New(sha256.New, spake.confirmationKey[:])
+	mac.Write(first)
+	mac.Write(second)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,174 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"filippo.io/edwards25519"
+)
+
+func newSPAKE2(t testing.TB, password string) *SPAKE2 {
+	t.Helper()
+
+	spake, err := NewSPAKE2([]byte(password))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return spake
+}
+
+// Run both sides of the exchange and return the keys they derived
+func exchange(t testing.TB, alice *SPAKE2, bob *SPAKE2) ([32]byte, [32]byte) {
+	t.Helper()
+
+	aliceKey, err := alice.Finish(bob.Message())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bobKey, err := bob.Finish(alice.Message())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return aliceKey, bobKey
+}
+
+func TestSPAKE2SamePassword(t *testing.T) {
+	alice, bob := newSPAKE2(t, "7-guitarist-revenge"), newSPAKE2(t, "7-guitarist-revenge")
+
+	aliceKey, bobKey := exchange(t, alice, bob)
+	if aliceKey != bobKey || aliceKey != alice.Key() {
+		t.Fatal("expected both peers to derive the same key")
+	}
+
+	if err := alice.VerifyConfirmation(bob.Confirmation()); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.VerifyConfirmation(alice.Confirmation()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every exchange derives a new key
+	otherKey, _ := exchange(t, newSPAKE2(t, "7-guitarist-revenge"), newSPAKE2(t, "7-guitarist-revenge"))
+	if otherKey == aliceKey {
+		t.Fatal("expected another exchange to derive another key")
+	}
+}
+
+func TestSPAKE2DifferentPassword(t *testing.T) {
+	alice, bob := newSPAKE2(t, "7-guitarist-revenge"), newSPAKE2(t, "7-guitarist-revenue")
+
+	aliceKey, bobKey := exchange(t, alice, bob)
+	if aliceKey == bobKey {
+		t.Fatal("expected different passwords to derive different keys")
+	}
+
+	if err := alice.VerifyConfirmation(bob.Confirmation()); err == nil {
+		t.Fatal("expected the confirmation of another password to be rejected")
+	}
+	if err := bob.VerifyConfirmation(alice.Confirmation()); err == nil {
+		t.Fatal("expected the confirmation of another password to be rejected")
+	}
+}
+
+func TestSPAKE2Reflection(t *testing.T) {
+	alice := newSPAKE2(t, "7-guitarist-revenge")
+
+	if _, err := alice.Finish(alice.Message()); err == nil {
+		t.Fatal("expected our own message to be rejected")
+	}
+
+	// Confirmations are bound to the side which sent them
+	bob := newSPAKE2(t, "7-guitarist-revenge")
+	exchange(t, alice, bob)
+
+	if err := alice.VerifyConfirmation(alice.Confirmation()); err == nil {
+		t.Fatal("expected our own confirmation to be rejected")
+	}
+}
+
+func TestSPAKE2InvalidMessages(t *testing.T) {
+	password := "7-guitarist-revenge"
+
+	// No point has y = 2, the point of order 2 has y = -1
+	lowOrder := bytes.Repeat([]byte{0xff}, 32)
+	lowOrder[0], lowOrder[31] = 0xec, 0x7f
+
+	// w*S, which cancels the blinding of the password
+	blinding := new(edwards25519.Point).ScalarMult(hashToScalar("p2p hole punching SPAKE2 password", []byte(password)), spake2S)
+
+	for name, message := range map[string][]byte{
+		"empty":     nil,
+		"short":     []byte{1, 2, 3},
+		"not point": append([]byte{2}, make([]byte, 31)...),
+		"identity":  edwards25519.NewIdentityPoint().Bytes(),
+		"low order": lowOrder,
+		"blinding":  blinding.Bytes(),
+	} {
+		spake := newSPAKE2(t, password)
+
+		if _, err := spake.Finish(message); err == nil {
+			t.Errorf("expected the %s message to be rejected", name)
+		}
+
+		// The exchange is not finished by a rejected message
+		if err := spake.VerifyConfirmation(nil); !errors.Is(err, ErrSPAKE2NotFinished) {
+			t.Errorf("expected the exchange to be unfinished after the %s message, got %v", name, err)
+		}
+	}
+}
+
+func TestSPAKE2FinishTwice(t *testing.T) {
+	alice, bob := newSPAKE2(t, "7-guitarist-revenge"), newSPAKE2(t, "7-guitarist-revenge")
+
+	key, _ := exchange(t, alice, bob)
+
+	// A retransmitted message gives the same key
+	again, err := alice.Finish(bob.Message())
+	if err != nil || again != key {
+		t.Fatalf("expected the same key again, got %v", err)
+	}
+
+	if _, err := alice.Finish(newSPAKE2(t, "7-guitarist-revenge").Message()); err == nil {
+		t.Fatal("expected another message to be rejected once finished")
+	}
+
+	if alice.Key() != key {
+		t.Fatal("expected the key to be kept")
+	}
+}
+
+func TestHashToPoint(t *testing.T) {
+	identity := edwards25519.NewIdentityPoint()
+
+	one, err := edwards25519.NewScalar().SetCanonicalBytes(append([]byte{1}, make([]byte, 31)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	minusOne := edwards25519.NewScalar().Negate(one)
+
+	for _, seed := range []string{"", "a", "p2p hole punching SPAKE2 symmetric point S", "another seed"} {
+		point := hashToPoint(seed)
+
+		if point.Equal(hashToPoint(seed)) != 1 {
+			t.Errorf("expected the point of %q to be deterministic", seed)
+		}
+
+		if point.Equal(identity) == 1 {
+			t.Errorf("expected the point of %q not to be the identity", seed)
+		}
+
+		// The point is in the prime order subgroup, (L-1)*P + P is the identity
+		multiple := new(edwards25519.Point).ScalarMult(minusOne, point)
+		if multiple.Add(multiple, point).Equal(identity) != 1 {
+			t.Errorf("expected the point of %q to be in the prime order subgroup", seed)
+		}
+	}
+
+	if hashToPoint("a").Equal(hashToPoint("b")) == 1 {
+		t.Fatal("expected different seeds to give different points")
+	}
+}
@@ -1,12 +1,15 @@
 module p2p
 
-go 1.16
+go 1.26.0
 
 require (
+	filippo.io/edwards25519 v1.2.0
 	github.com/mitchellh/mapstructure v1.4.2
-	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
-	golang.org/x/mobile v0.0.0-20211103151657-e68c98865fb2 // indirect
-	golang.org/x/mod v0.5.1 // indirect
-	golang.org/x/sys v0.0.0-20211106132015-ebca88c72f68 // indirect
-	google.golang.org/protobuf v1.27.1
+	github.com/quic-go/quic-go v0.63.0
+	go.etcd.io/bbolt v1.5.0
+	golang.org/x/crypto v0.54.0
+	golang.org/x/net v0.56.0
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require golang.org/x/sys v0.47.0 // indirect
@@ -1,20 +1,30 @@
 package client
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"encoding/base64"
-	"encoding/hex"
+	"log/slog"
 	"net"
 	"sync"
 	"time"
 
+	"github.com/mitchellh/mapstructure"
+	"github.com/quic-go/quic-go"
+
 	"p2p/crypto"
-	"p2p/hole_punching/server"
+	"p2p/hole_punching/transport"
+	"p2p/logging"
+	"p2p/metrics"
 	"p2p/shared"
 )
 
 type Client struct {
-	rdvServer *server.Server
+	transport *transport.Transport
 	addr      *net.UDPAddr
+	options   Options
+	logger    *slog.Logger
 
 	// Current peer
 	currentPeer *shared.Peer
@@ -27,19 +37,89 @@ type Client struct {
 	otherPeerConn shared.Conn
 
 	mutex *sync.Mutex
-
-	registeredCallback func(client *Client)
-	connectingCallback func(client *Client)
-	connectedCallback  func(client *Client)
-	messageCallback    func(client *Client, text string)
+	// Closed when the client stops, every goroutine of the client returns then
+	exit     chan struct{}
+	stopOnce *sync.Once
+	// Loops of the client, Stop waits for them
+	wg *sync.WaitGroup
+	// Guards the closing of exit, so that no goroutine is added to wg once Stop waits for it
+	lifecycle *sync.Mutex
+
+	// Whether the rendez-vous server registered us once, later registrations follow a server restart
+	registered bool
+	// Presence filter we subscribed with, sent again when we register again
+	subscription *shared.PeerFilter
+	// When the rendez-vous server last told us it lost our session
+	lastUnknownSession time.Time
+	// Our endpoint as seen by the rendez-vous server when we last registered
+	endpoint string
+	// When we last received an encrypted message from the rendez-vous server
+	lastServerMessage time.Time
+	// Session with the other peer, resumed when our endpoint changes
+	resumption *resumption
+	// Closed once the channel with the other peer is encrypted
+	encrypted chan struct{}
+	// Pending challenges of the new addresses of the other peer, by address
+	challenges map[string]*pathChallenge
+	// When the punch in progress started, zero once counted
+	punching time.Time
+	// Exported to a private registry unless SetMetrics is called
+	metrics *clientMetrics
+
+	// Forwarded TCP streams
+	streams      map[uint32]*stream
+	lastStreamID uint32
+	// Local addresses the other peer is allowed to forward to
+	exposed      map[string]bool
+	streamsMutex *sync.Mutex
+
+	// Identity key fingerprints of the peers whose establish requests are declined
+	blocked map[string]bool
+
+	// Authentication of the other peer with the pairing code, nil unless a code is used
+	pake *pakeState
+	// QUIC connection over the punched path, nil unless enabled
+	quic *quicState
+
+	// Group sessions by name
+	groups      map[string]*group
+	groupsMutex *sync.Mutex
+
+	// Requests to the rendez-vous server waiting for an answer, by request ID
+	requests      map[uint64]*pendingRequest
+	lastRequestID uint64
+	requestsMutex *sync.Mutex
+	// Callers of Register waiting for the handshake with the rendez-vous server
+	registering []chan error
+
+	registeredCallback      func(client *Client)
+	connectingCallback      func(client *Client)
+	connectedCallback       func(client *Client)
+	messageCallback         func(client *Client, text string)
+	codeCallback            func(client *Client, code string)
+	authenticatedCallback   func(client *Client)
+	quicCallback            func(client *Client, conn *quic.Conn)
+	groupJoinCallback       func(client *Client, group string, peer *shared.Peer)
+	groupLeaveCallback      func(client *Client, group string, peer *shared.Peer)
+	groupMessageCallback    func(client *Client, group string, peer *shared.Peer, text string)
+	listCallback            func(client *Client, list *shared.PeerList)
+	lookupCallback          func(client *Client, peer *shared.Peer)
+	presenceCallback        func(client *Client, peer *shared.Peer, online bool)
+	incomingCallback        func(client *Client, peer *shared.Peer)
+	establishFailedCallback func(client *Client, err error)
+	resumedCallback         func(client *Client)
+	disconnectedCallback    func(client *Client)
+	errorCallback           func(client *Client, err error)
 }
 
 func (client *Client) Connect() {
 	otherPeerConn := client.GetOtherPeerConn()
 	currentPeer := client.GetCurrentPeer()
 
-	// Sends 5 connect messages
-	for i := 0; i < 5; i += 1 {
+	client.punchStarted()
+
+	// Sends connect messages until the NAT of the other peer lets them through
+	for i := 0; i < client.options.PunchAttempts; i += 1 {
 		client.connectedCallback(client)
 
 		otherPeerConn.Send(&shared.Message{
@@ -47,57 +127,229 @@ func (client *Client) Connect() {
 			PeerID: currentPeer.ID,
 		})
 
-		time.Sleep(3 * time.Second)
+		if !client.pause(client.options.PunchInterval) {
+			return
+		}
+	}
+
+	// Not counted yet if the encrypted channel never came up
+	client.punchEnded(false)
+}
+
+// Keep the registration and the NAT mapping with the rendez-vous server alive
+func (client *Client) keepalive() {
+	ticker := time.NewTicker(client.options.KeepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-client.exit:
+			return
+		case now := <-ticker.C:
+			if client.isServerSilent(now) {
+				client.warn("Rendez-vous server stopped answering, greeting it again", "server", client.addr)
+				client.Reconnect()
+			}
+
+			client.GetRDVServerConn().Send(&shared.Message{
+				Type:    "keepalive",
+				PeerID:  client.GetCurrentPeer().ID,
+				Encrypt: true,
+			})
+		}
+	}
+}
+
+// Run f in a goroutine Stop waits for, unless the client stopped. The handlers start their goroutines with it
+// since they may still run while Stop waits, false if it was not started.
+func (client *Client) spawn(f func()) bool {
+	client.lifecycle.Lock()
+	defer client.lifecycle.Unlock()
+
+	select {
+	case <-client.exit:
+		return false
+	default:
+	}
+
+	client.wg.Go(f)
+
+	return true
+}
+
+// Wait for this long, false if the client stopped meanwhile
+func (client *Client) pause(duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-client.exit:
+		return false
+	case <-timer.C:
+		return true
 	}
 }
 
-func (client *Client) Start() error {
-	rdvServer := client.GetRDVServer()
+// Start the client and greet the rendez-vous server without waiting for the registration, see Register.
+// The client stops once the context is done, or when Stop is called.
+func (client *Client) Start(ctx context.Context) error {
+	transport := client.GetTransport()
 
 	// Add rendez-vous server connection
-	serverConn, err := rdvServer.CreateConn(client.addr)
+	serverConn, err := transport.CreateConn(client.addr)
 	if err != nil {
 		return err
 	}
 
 	client.SetRDVServerConn(serverConn)
 
-	// Get public key
+	// Start listening on the UDP socket, the client also stops on socket errors
+	go func() {
+		transport.Listen()
+		client.Stop()
+	}()
+	client.spawn(client.retransmit)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			client.Stop()
+		case <-client.exit:
+		}
+	}()
+
+	// Send greeting message to server
+	return client.greet("")
+}
+
+// Greet the rendez-vous server with our public key, and with its cookie once it sent one.
+// The requests of a previous handshake are no longer sent.
+func (client *Client) greet(cookie string) error {
 	pubKey, err := client.GetCurrentPeer().GetPublicKey()
 	if err != nil {
 		return err
 	}
 
-	// Start rendez-vous server
-	go rdvServer.Listen()
+	client.forgetHandshake()
 
-	// Send greeting message to server
-	serverConn.Send(&shared.Message{
-		Type:    "greeting",
-		Content: base64.StdEncoding.EncodeToString(pubKey[:]),
+	return client.send(&shared.Message{
+		Type: "greeting",
+		Content: &shared.Greeting{
+			PublicKey: base64.StdEncoding.EncodeToString(pubKey[:]),
+			Cookie:    cookie,
+		},
 	})
+}
+
+// Ask the rendez-vous server to introduce us to the peer with this ID, and wait until it consents.
+// Returns the other peer once introduced, the answered errors are *shared.Error.
+func (client *Client) Establish(ctx context.Context, peerID string) (*shared.Peer, error) {
+	client.SetOtherPeer(&shared.Peer{ID: peerID})
+
+	answer, err := client.request(ctx, &shared.Message{
+		Type:    "establish",
+		PeerID:  client.GetCurrentPeer().ID,
+		Content: peerID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var peer shared.Peer
+	err = mapstructure.Decode(answer.Content, &peer)
+	if err != nil {
+		return nil, err
+	}
 
-	return nil
+	return &peer, nil
+}
+
+// Ask the rendez-vous server for the nameplate of a pairing code, the whole code with its password words is received by the code callback
+func (client *Client) CreateCode() error {
+	return client.send(&shared.Message{
+		Type:   "code-create",
+		PeerID: client.GetCurrentPeer().ID,
+	})
+}
+
+// Join the pairing code created by another peer, the server then introduces both peers.
+// Only the nameplate is sent to the server, the whole code authenticates the other peer once connected.
+func (client *Client) JoinCode(code string) error {
+	code = normalizeCode(code)
+
+	nameplate, _, err := splitCode(code)
+	if err != nil {
+		return err
+	}
+
+	err = client.setPairingCode(code)
+	if err != nil {
+		return err
+	}
+
+	return client.send(&shared.Message{
+		Type:    "code-join",
+		PeerID:  client.GetCurrentPeer().ID,
+		Content: nameplate,
+	})
+}
+
+// Send a chat message to the other peer, once the channel with it is encrypted or until the context is done
+func (client *Client) Send(ctx context.Context, text string) error {
+	select {
+	case <-client.encrypted:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-client.exit:
+		return ErrClientStopped
+	}
+
+	return client.GetOtherPeerConn().Send(&shared.Message{
+		Type:    "message",
+		PeerID:  client.GetCurrentPeer().ID,
+		Content: text,
+		Encrypt: true,
+	})
 }
 
 func NewClient(
 	username string,
-	addrStr string,
+	options Options,
 ) (*Client, error) {
-	clientAddr, err := net.ResolveUDPAddr("udp", addrStr)
+	if options.Logger == nil {
+		options.Logger = slog.Default()
+	}
+
+	if options.IdentityKey == nil {
+		_, identityKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		options.IdentityKey = identityKey
+	}
+
+	err := options.validate()
 	if err != nil {
 		return nil, err
 	}
 
-	// Create UDP server
-	rdvServer, err := server.NewServer(shared.GenPort())
+	clientAddr, err := net.ResolveUDPAddr("udp", options.ServerAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create UDP socket
+	transport, err := bind(options)
 	if err != nil {
 		return nil, err
 	}
 
 	// Create current peer
 	currentPeer := &shared.Peer{
-		Username: username,
+		Username:    username,
+		Namespace:   options.Namespace,
+		IdentityKey: base64.StdEncoding.EncodeToString(options.IdentityKey.Public().(ed25519.PublicKey)),
 	}
 
 	// Create public and private keys
@@ -109,22 +361,55 @@ func NewClient(
 
 	currentPeer.SetPublicKey(pubKey)
 
-	// Create client ID: SHA-2 + HMAC hash of public key
-	currentPeer.ID = hex.EncodeToString(crypto.Hash("Hashing client public key for client id", pubKey[:]))
+	currentPeer.ID = shared.GenPeerID(pubKey)
 
 	client := &Client{
-		rdvServer:          rdvServer,
-		addr:               clientAddr,
-		currentPeer:        currentPeer,
-		otherPeer:          nil,
-		mutex:              &sync.Mutex{},
-		registeredCallback: func(*Client) {},
-		connectingCallback: func(*Client) {},
-		connectedCallback:  func(*Client) {},
-		messageCallback:    func(*Client, string) {},
+		transport:               transport,
+		addr:                    clientAddr,
+		options:                 options,
+		logger:                  slog.New(logging.Redact(options.Logger.Handler())).With("peer", currentPeer.ID),
+		currentPeer:             currentPeer,
+		otherPeer:               nil,
+		mutex:                   &sync.Mutex{},
+		exit:                    make(chan struct{}),
+		encrypted:               make(chan struct{}),
+		stopOnce:                &sync.Once{},
+		lifecycle:               &sync.Mutex{},
+		wg:                      &sync.WaitGroup{},
+		streams:                 make(map[uint32]*stream),
+		exposed:                 make(map[string]bool),
+		streamsMutex:            &sync.Mutex{},
+		blocked:                 make(map[string]bool),
+		challenges:              make(map[string]*pathChallenge),
+		groups:                  make(map[string]*group),
+		groupsMutex:             &sync.Mutex{},
+		requests:                make(map[uint64]*pendingRequest),
+		requestsMutex:           &sync.Mutex{},
+		registeredCallback:      func(*Client) {},
+		connectingCallback:      func(*Client) {},
+		connectedCallback:       func(*Client) {},
+		messageCallback:         func(*Client, string) {},
+		codeCallback:            func(*Client, string) {},
+		authenticatedCallback:   func(*Client) {},
+		quicCallback:            func(*Client, *quic.Conn) {},
+		groupJoinCallback:       func(*Client, string, *shared.Peer) {},
+		groupLeaveCallback:      func(*Client, string, *shared.Peer) {},
+		groupMessageCallback:    func(*Client, string, *shared.Peer, string) {},
+		listCallback:            func(*Client, *shared.PeerList) {},
+		lookupCallback:          func(*Client, *shared.Peer) {},
+		presenceCallback:        func(*Client, *shared.Peer, bool) {},
+		incomingCallback:        func(client *Client, peer *shared.Peer) { client.Decline(peer.ID) },
+		establishFailedCallback: func(*Client, error) {},
+		errorCallback:           func(*Client, error) {},
+		resumedCallback:         func(*Client) {},
+		disconnectedCallback:    func(*Client) {},
 	}
 
-	rdvServer.OnMessage(createMessageCallback(client))
+	client.SetMetrics(metrics.NewRegistry())
+
+	transport.OnMessage(createMessageCallback(client))
+	transport.OnUnknownPayload(client.handleUnknownPayload)
+	transport.OnError(func(err error) { client.error("Transport error", "err", err) })
 
 	return client, nil
 }
@@ -160,8 +445,8 @@ func (client *Client) SetRDVServerConn(conn shared.Conn) {
 	client.rdvServerConn = conn
 }
 
-func (client *Client) GetRDVServer() *server.Server {
-	return client.rdvServer
+func (client *Client) GetTransport() *transport.Transport {
+	return client.transport
 }
 
 func (client *Client) OnRegistered(callback func(client *Client)) {
@@ -180,6 +465,63 @@ func (client *Client) OnMessage(callback func(client *Client, text string)) {
 	client.messageCallback = callback
 }
 
+func (client *Client) OnCode(callback func(client *Client, code string)) {
+	client.codeCallback = callback
+}
+
+// Called with the errors answered by the rendez-vous server, compare them to the shared.Err* errors with errors.Is
+func (client *Client) OnError(callback func(client *Client, err error)) {
+	client.errorCallback = callback
+}
+
+// Called once the other peer proved it knows the pairing code
+func (client *Client) OnAuthenticated(callback func(client *Client)) {
+	client.authenticatedCallback = callback
+}
+
+// Say bye to the rendez-vous server and the other peer, stop the goroutines of the client and close its socket.
+// The later calls wait until the client stopped and do nothing. Must not be called from a callback.
 func (client *Client) Stop() {
-	client.rdvServer.Stop()
+	client.stopOnce.Do(func() {
+		client.sayBye()
+
+		client.lifecycle.Lock()
+		close(client.exit)
+		client.lifecycle.Unlock()
+
+		client.closeStreams()
+		client.stopQUIC()
+		client.transport.Stop()
+		client.wg.Wait()
+	})
+}
+
+// Tell the rendez-vous server to unregister us and the other peer that we are leaving, without waiting for answers
+func (client *Client) sayBye() {
+	client.mutex.Lock()
+	registered := client.registered
+	client.mutex.Unlock()
+
+	currentPeer := client.GetCurrentPeer()
+
+	if serverConn := client.GetRDVServerConn(); serverConn != nil && registered {
+		serverConn.Send(&shared.Message{
+			Type:    "bye",
+			PeerID:  currentPeer.ID,
+			Encrypt: true,
+		})
+	}
+
+	otherPeerConn := client.GetOtherPeerConn()
+	if otherPeerConn == nil {
+		return
+	}
+
+	if _, err := otherPeerConn.GetSecret(); err == nil {
+		otherPeerConn.Send(&shared.Message{
+			Type:    "bye",
+			PeerID:  currentPeer.ID,
+			Encrypt: true,
+		})
+	}
 }
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+// Password words of the pairing codes, short and easy to read out loud
+var codeWords = []string{
+	"acid", "acorn", "actor", "adobe", "agent", "alarm", "album", "alpha", "amber", "anchor", "angle",
+	"apple", "apron", "arena", "arrow", "aspen", "atlas", "attic", "audio", "autumn", "avocado",
+	"bacon", "badge", "bagel", "baker", "bamboo", "banjo", "barley", "basil", "basket", "beacon",
+	"beaver", "berry", "bison", "blanket", "blossom", "bonsai", "border", "bottle", "bramble",
+	"breeze", "brick", "bridge", "bronze", "bucket", "buffalo", "bugle", "butter", "cabin", "cactus",
+	"camel", "candle", "canoe", "canyon", "carbon", "cargo", "carpet", "castle", "cedar", "cello",
+	"chalk", "cherry", "chess", "chimney", "cider", "cinema", "circus", "citrus", "clover", "cobalt",
+	"cocoa", "comet", "copper", "coral", "cotton", "cougar", "crater", "crayon", "cricket",
+	"crossword", "crystal", "cumin", "cycle", "daisy", "dawn", "delta", "denim", "desert", "diesel",
+	"dinner", "dolphin", "domino", "dragon", "drum", "dune", "eagle", "easel", "echo", "eclipse",
+	"ember", "emerald", "engine", "falcon", "fennel", "ferry", "fiddle", "fig", "flame", "flute",
+	"forest", "fossil", "fox", "galaxy", "garden", "garlic", "geyser", "ginger", "glacier", "globe",
+	"granite", "grape", "gravel", "guitar", "hammock", "harbor", "harvest", "hazel", "helmet",
+	"hermit", "hickory", "honey", "horizon", "iceberg", "igloo", "indigo", "iris", "island", "ivory",
+	"jacket", "jaguar", "jasmine", "jelly", "jigsaw", "jungle", "kayak", "kernel", "kettle", "kiwi",
+	"koala", "ladder", "lagoon", "lantern", "laser", "lemon", "lilac", "linen", "lizard", "llama",
+	"lobster", "lotus", "magnet", "mango", "maple", "marble", "meadow", "melon", "meteor", "mint",
+	"mirror", "mocha", "monsoon", "mosaic", "moss", "muffin", "nectar", "needle", "nickel", "nutmeg",
+	"oasis", "ocean", "olive", "onion", "orbit", "orchid", "otter", "oyster", "paddle", "panda",
+	"papaya", "parrot", "pebble", "pepper", "piano", "pigeon", "pillow", "pine", "pixel", "planet",
+	"plum", "pollen", "poppy", "prairie", "pumpkin", "quartz", "quill", "rabbit", "radar", "radish",
+	"raven", "reef", "ribbon", "river", "robin", "rocket", "saddle", "saffron", "salmon", "sandal",
+	"satin", "scarf", "sequoia", "shadow", "signal", "silver", "sketch", "sparrow", "spruce",
+	"squash", "summit", "sunset", "swan", "tango", "teapot", "thistle", "thunder", "tiger", "timber",
+	"tomato", "topaz", "tulip", "tundra", "turtle", "umbrella", "valley", "vanilla", "velvet",
+	"violet", "walnut", "walrus", "willow", "window", "winter", "wizard", "yarrow", "zebra", "zephyr",
+}
+
+// Words appended to the nameplate, they never leave the peers
+const passwordWords = 2
+
+// Pick the password words of a pairing code, such as crossword-maple
+func genPassword() (string, error) {
+	words := make([]string, passwordWords)
+	for i := range words {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(codeWords))))
+		if err != nil {
+			return "", err
+		}
+
+		words[i] = codeWords[n.Int64()]
+	}
+
+	return strings.Join(words, "-"), nil
+}
+
+// Codes are typed by people, case, spaces and hyphens do not matter: " 7 Crossword-maple" is 7-crossword-maple
+func normalizeCode(code string) string {
+	return strings.Join(strings.Fields(strings.ReplaceAll(strings.ToLower(code), "-", " ")), "-")
+}
+
+// Split a normalized pairing code into the nameplate the server knows and the password only the peers know
+func splitCode(code string) (string, string, error) {
+	nameplate, password, _ := strings.Cut(code, "-")
+	if nameplate == "" || password == "" {
+		return "", "", errors.New("pairing code must be a nameplate followed by words, such as 7-crossword-maple")
+	}
+
+	return nameplate, password, nil
+}
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"strings"
+	"testing"
+
+	"p2p/crypto"
+)
+
+func TestNormalizeCode(t *testing.T) {
+	for input, expected := range map[string]string{
+		"7-crossword-maple":       "7-crossword-maple",
+		" 7-Crossword-MAPLE\n":    "7-crossword-maple",
+		"7 crossword maple":       "7-crossword-maple",
+		"7 - crossword -- maple ": "7-crossword-maple",
+	} {
+		if code := normalizeCode(input); code != expected {
+			t.Errorf("normalizeCode(%q) = %q, expected %q", input, code, expected)
+		}
+	}
+}
+
+func TestSplitCode(t *testing.T) {
+	nameplate, password, err := splitCode("7-crossword-maple")
+	if err != nil || nameplate != "7" || password != "crossword-maple" {
+		t.Fatalf("unexpected split %q %q %v", nameplate, password, err)
+	}
+
+	// Without its password words, a code would authenticate nothing the server does not know
+	for _, code := range []string{"", "7", "-maple"} {
+		if _, _, err := splitCode(code); err == nil {
+			t.Errorf("expected %q to be rejected", code)
+		}
+	}
+}
+
+func TestGenPassword(t *testing.T) {
+	password, err := genPassword()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if words := strings.Split(password, "-"); len(words) != passwordWords {
+		t.Fatalf("expected %d words, got %q", passwordWords, password)
+	}
+}
+
+// Both peers derive the same key however the code was typed
+func TestPairingCodeSpellings(t *testing.T) {
+	created, err := crypto.NewSPAKE2([]byte(normalizeCode("7-crossword-maple")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	joined, err := crypto.NewSPAKE2([]byte(normalizeCode(" 7 Crossword-Maple ")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := created.Finish(joined.Message()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := joined.Finish(created.Message()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := created.VerifyConfirmation(joined.Confirmation()); err != nil {
+		t.Fatalf("expected the confirmations to match: %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"sort"
+
+	"p2p/shared"
+)
+
+// Accept the establish request of a peer, the rendez-vous server then introduces us to each other
+func (client *Client) Accept(peerID string) error {
+	return client.sendConsent(peerID, true)
+}
+
+// Decline the establish request of a peer, which never learns our endpoint
+func (client *Client) Decline(peerID string) error {
+	return client.sendConsent(peerID, false)
+}
+
+func (client *Client) sendConsent(peerID string, accept bool) error {
+	return client.send(&shared.Message{
+		Type:    "consent",
+		PeerID:  client.GetCurrentPeer().ID,
+		Content: &shared.Consent{PeerID: peerID, Accept: accept},
+	})
+}
+
+// Decline every establish request of the peer with this identity key fingerprint, without calling the incoming callback
+func (client *Client) Block(fingerprint string) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	client.blocked[fingerprint] = true
+}
+
+func (client *Client) Unblock(fingerprint string) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	delete(client.blocked, fingerprint)
+}
+
+// Blocked fingerprints, sorted
+func (client *Client) GetBlocked() []string {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	fingerprints := make([]string, 0, len(client.blocked))
+	for fingerprint := range client.blocked {
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	sort.Strings(fingerprints)
+
+	return fingerprints
+}
+
+func (client *Client) isBlocked(fingerprint string) bool {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	return client.blocked[fingerprint]
+}
+
+// Called when a peer asks to connect with us, answer with Accept or Decline.
+// Requests are declined when no callback is set.
+func (client *Client) OnIncoming(callback func(client *Client, peer *shared.Peer)) {
+	client.incomingCallback = callback
+}
+
+// Called when our establish request was declined, expired or failed
+func (client *Client) OnEstablishFailed(callback func(client *Client, err error)) {
+	client.establishFailedCallback = callback
+}
@@ -0,0 +1,394 @@
+package client
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"p2p/shared"
+)
+
+const (
+	// Raw bytes per datagram, keeps the encrypted JSON payload under the receiver buffer size
+	forwardChunkSize = 1024
+	// Number of chunks in flight before the sender waits for an ack
+	forwardWindowSize = 32
+	// Delay before an unacked chunk is sent again
+	forwardRetransmitInterval = 200 * time.Millisecond
+	// Delay without any ack before the stream is considered dead
+	forwardTimeout = 15 * time.Second
+	// Number of forward-open messages sent before giving up
+	forwardOpenAttempts = 5
+)
+
+type unackedChunk struct {
+	data   *shared.ForwardData
+	sentAt time.Time
+}
+
+// A forwarded TCP connection carried over the encrypted peer conn
+type stream struct {
+	id        uint32
+	initiator bool
+	client    *Client
+	conn      net.Conn
+
+	mutex        *sync.Mutex
+	sendSeq      uint32
+	unacked      map[uint32]*unackedChunk
+	recvSeq      uint32
+	pending      map[uint32]*shared.ForwardData
+	lastAck      time.Time
+	localClosed  bool
+	remoteClosed bool
+
+	opened    chan error
+	window    chan struct{}
+	done      chan struct{}
+	closeOnce *sync.Once
+}
+
+func newStream(client *Client, id uint32, initiator bool, conn net.Conn) *stream {
+	return &stream{
+		id:        id,
+		initiator: initiator,
+		client:    client,
+		conn:      conn,
+		mutex:     &sync.Mutex{},
+		unacked:   make(map[uint32]*unackedChunk),
+		pending:   make(map[uint32]*shared.ForwardData),
+		lastAck:   time.Now(),
+		opened:    make(chan error, 1),
+		window:    make(chan struct{}, forwardWindowSize),
+		done:      make(chan struct{}),
+		closeOnce: &sync.Once{},
+	}
+}
+
+func (stream *stream) run() {
+	go stream.retransmitter()
+
+	stream.reader()
+}
+
+// Read the local TCP conn and send it to the other peer chunk by chunk
+func (stream *stream) reader() {
+	buffer := make([]byte, forwardChunkSize)
+
+	for {
+		n, err := stream.conn.Read(buffer)
+		if n > 0 {
+			if !stream.send(base64.StdEncoding.EncodeToString(buffer[:n]), false) {
+				return
+			}
+		}
+
+		if err != nil {
+			if err != io.EOF {
+				stream.client.warn("Forward stream failed", "stream", stream.id, "err", err)
+			}
+
+			stream.send("", true)
+			return
+		}
+	}
+}
+
+func (stream *stream) send(data string, close bool) bool {
+	// Wait for a free slot in the window
+	select {
+	case stream.window <- struct{}{}:
+	case <-stream.done:
+		return false
+	}
+
+	stream.mutex.Lock()
+	chunk := &shared.ForwardData{
+		StreamID: stream.id,
+		Seq:      stream.sendSeq,
+		Data:     data,
+		Close:    close,
+	}
+	stream.sendSeq += 1
+	stream.unacked[chunk.Seq] = &unackedChunk{data: chunk, sentAt: time.Now()}
+	if close {
+		stream.localClosed = true
+	}
+	stream.mutex.Unlock()
+
+	return stream.client.sendForward("forward-data", chunk) == nil
+}
+
+func (stream *stream) retransmitter() {
+	ticker := time.NewTicker(forwardRetransmitInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stream.done:
+			return
+		case now := <-ticker.C:
+			stream.mutex.Lock()
+			if len(stream.unacked) > 0 && now.Sub(stream.lastAck) > forwardTimeout {
+				stream.mutex.Unlock()
+				stream.client.warn("Forward stream timed out", "stream", stream.id)
+				stream.close()
+				return
+			}
+
+			var chunks []*shared.ForwardData
+			for _, chunk := range stream.unacked {
+				if now.Sub(chunk.sentAt) > forwardRetransmitInterval {
+					chunk.sentAt = now
+					chunks = append(chunks, chunk.data)
+				}
+			}
+			stream.mutex.Unlock()
+
+			for _, chunk := range chunks {
+				stream.client.sendForward("forward-data", chunk)
+			}
+		}
+	}
+}
+
+// Deliver a chunk received from the other peer, in order, to the local TCP conn
+func (stream *stream) receive(chunk *shared.ForwardData) error {
+	stream.mutex.Lock()
+
+	if chunk.Seq >= stream.recvSeq && chunk.Seq < stream.recvSeq+2*forwardWindowSize {
+		stream.pending[chunk.Seq] = chunk
+	}
+
+	var err error
+	for {
+		next, ok := stream.pending[stream.recvSeq]
+		if !ok {
+			break
+		}
+
+		delete(stream.pending, stream.recvSeq)
+		stream.recvSeq += 1
+
+		if next.Close {
+			stream.remoteClosed = true
+			if tcpConn, ok := stream.conn.(*net.TCPConn); ok {
+				tcpConn.CloseWrite()
+			}
+			continue
+		}
+
+		var bytes []byte
+		bytes, err = base64.StdEncoding.DecodeString(next.Data)
+		if err != nil {
+			break
+		}
+
+		_, err = stream.conn.Write(bytes)
+		if err != nil {
+			break
+		}
+	}
+
+	ack := &shared.ForwardAck{
+		StreamID: stream.id,
+		Seq:      stream.recvSeq,
+	}
+	finished := stream.isFinished()
+	stream.mutex.Unlock()
+
+	stream.client.sendForward("forward-ack", ack)
+
+	if err != nil || finished {
+		stream.close()
+	}
+
+	return err
+}
+
+// Release every chunk acknowledged by the other peer
+func (stream *stream) ack(seq uint32) {
+	stream.mutex.Lock()
+
+	for s := range stream.unacked {
+		if s < seq {
+			delete(stream.unacked, s)
+			<-stream.window
+		}
+	}
+	stream.lastAck = time.Now()
+	finished := stream.isFinished()
+
+	stream.mutex.Unlock()
+
+	if finished {
+		stream.close()
+	}
+}
+
+// Must be called with the mutex held
+func (stream *stream) isFinished() bool {
+	return stream.localClosed && stream.remoteClosed && len(stream.unacked) == 0
+}
+
+func (stream *stream) close() {
+	stream.closeOnce.Do(func() {
+		close(stream.done)
+		stream.conn.Close()
+		stream.client.removeStream(stream.id)
+	})
+}
+
+// Allow the other peer to open forwarded streams to addr (host:port)
+func (client *Client) Expose(addr string) {
+	client.streamsMutex.Lock()
+	defer client.streamsMutex.Unlock()
+
+	client.exposed[addr] = true
+}
+
+func (client *Client) isExposed(addr string) bool {
+	client.streamsMutex.Lock()
+	defer client.streamsMutex.Unlock()
+
+	return client.exposed[addr]
+}
+
+// Listen on localAddr and forward every accepted TCP connection to remoteAddr,
+// which must be exposed by the other peer. Close the listener to stop forwarding.
+func (client *Client) Forward(localAddr string, remoteAddr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					client.error("Could not accept forwarded connection", "addr", localAddr, "err", err)
+				}
+				return
+			}
+
+			go func() {
+				if err := client.openStream(conn, remoteAddr); err != nil {
+					client.warn("Could not open forward stream", "remote", remoteAddr, "err", err)
+				}
+			}()
+		}
+	}()
+
+	return listener, nil
+}
+
+func (client *Client) openStream(conn net.Conn, remoteAddr string) error {
+	otherPeerConn := client.GetOtherPeerConn()
+	if otherPeerConn == nil {
+		conn.Close()
+		return errors.New("cannot forward connection, no peer connected yet")
+	}
+
+	if _, err := otherPeerConn.GetSecret(); err != nil {
+		conn.Close()
+		return errors.New("cannot forward connection, peer channel is not encrypted yet")
+	}
+
+	stream := newStream(client, client.nextStreamID(), true, conn)
+	client.addStream(stream)
+
+	open := &shared.ForwardOpen{
+		StreamID: stream.id,
+		Addr:     remoteAddr,
+	}
+
+	for i := 0; i < forwardOpenAttempts; i += 1 {
+		if err := client.sendForward("forward-open", open); err != nil {
+			stream.close()
+			return err
+		}
+
+		select {
+		case err := <-stream.opened:
+			if err != nil {
+				stream.close()
+				return err
+			}
+
+			stream.run()
+			return nil
+		case <-time.After(time.Second):
+		}
+	}
+
+	stream.close()
+	return fmt.Errorf("peer did not answer forward request to %s", remoteAddr)
+}
+
+func (client *Client) sendForward(messageType string, content interface{}) error {
+	otherPeerConn := client.GetOtherPeerConn()
+	if otherPeerConn == nil {
+		return errors.New("no peer connected")
+	}
+
+	return otherPeerConn.Send(&shared.Message{
+		Type:    messageType,
+		PeerID:  client.GetCurrentPeer().ID,
+		Content: content,
+		Encrypt: true,
+	})
+}
+
+// Streams opened by each side use a different parity so that IDs never collide
+func (client *Client) nextStreamID() uint32 {
+	client.streamsMutex.Lock()
+	defer client.streamsMutex.Unlock()
+
+	if client.lastStreamID == 0 && client.GetCurrentPeer().ID < client.GetOtherPeer().ID {
+		client.lastStreamID = 1
+	} else {
+		client.lastStreamID += 2
+	}
+
+	return client.lastStreamID
+}
+
+func (client *Client) getStream(id uint32) (*stream, bool) {
+	client.streamsMutex.Lock()
+	defer client.streamsMutex.Unlock()
+
+	stream, ok := client.streams[id]
+	return stream, ok
+}
+
+func (client *Client) addStream(stream *stream) {
+	client.streamsMutex.Lock()
+	defer client.streamsMutex.Unlock()
+
+	client.streams[stream.id] = stream
+}
+
+func (client *Client) removeStream(id uint32) {
+	client.streamsMutex.Lock()
+	defer client.streamsMutex.Unlock()
+
+	delete(client.streams, id)
+}
+
+func (client *Client) closeStreams() {
+	client.streamsMutex.Lock()
+	streams := make([]*stream, 0, len(client.streams))
+	for _, stream := range client.streams {
+		streams = append(streams, stream)
+	}
+	client.streamsMutex.Unlock()
+
+	for _, stream := range streams {
+		stream.close()
+	}
+}
@@ -0,0 +1,173 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// UDP relay between two peers which drops every fifth datagram and swaps every third one with the next
+type lossyRelay struct {
+	conn  *net.UDPConn
+	peers [2]*net.UDPAddr
+}
+
+func newLossyRelay(t testing.TB) *lossyRelay {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &lossyRelay{conn: conn}
+}
+
+func (relay *lossyRelay) run() {
+	var held []byte
+	var heldAddr *net.UDPAddr
+
+	buffer := make([]byte, 2048)
+	for count := 1; ; count += 1 {
+		relay.conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+		n, addr, err := relay.conn.ReadFromUDP(buffer)
+		if err != nil {
+			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+				// Nothing came after the held datagram, release it
+				if held != nil {
+					relay.conn.WriteToUDP(held, heldAddr)
+					held = nil
+				}
+				continue
+			}
+			return
+		}
+
+		to := relay.peers[0]
+		if addr.String() == to.String() {
+			to = relay.peers[1]
+		}
+
+		switch {
+		case count%5 == 0:
+		case count%3 == 0 && held == nil:
+			held, heldAddr = append([]byte(nil), buffer[:n]...), to
+		default:
+			relay.conn.WriteToUDP(buffer[:n], to)
+			if held != nil {
+				relay.conn.WriteToUDP(held, heldAddr)
+				held = nil
+			}
+		}
+	}
+}
+
+// Client whose peer conn goes through the relay, the rendez-vous server is never reached
+func newForwardingClient(t testing.TB, username string, relay *lossyRelay, secret [32]byte) *Client {
+	t.Helper()
+
+	options := testOptions()
+	options.ServerAddr = "127.0.0.1:9"
+
+	client := newTestClient(t, username, options)
+
+	conn, err := client.GetTransport().CreateConn(relay.conn.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetSecret(secret)
+	client.SetOtherPeerConn(conn)
+
+	return client
+}
+
+func TestForwardOverLossyPath(t *testing.T) {
+	relay := newLossyRelay(t)
+
+	var secret [32]byte
+	copy(secret[:], "the secret of alice and bob.....")
+
+	alice := newForwardingClient(t, "alice", relay, secret)
+	bob := newForwardingClient(t, "bob", relay, secret)
+	alice.SetOtherPeer(bob.GetCurrentPeer())
+	bob.SetOtherPeer(alice.GetCurrentPeer())
+
+	relay.peers = [2]*net.UDPAddr{
+		alice.GetTransport().LocalAddr().(*net.UDPAddr),
+		bob.GetTransport().LocalAddr().(*net.UDPAddr),
+	}
+	go relay.run()
+
+	// The peers are set before the clients receive anything
+	for _, client := range []*Client{alice, bob} {
+		if err := client.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Bob exposes an echo server
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				io.Copy(conn, conn)
+				conn.(*net.TCPConn).CloseWrite()
+			}()
+		}
+	}()
+	bob.Expose(echo.Addr().String())
+
+	listener, err := alice.Forward("127.0.0.1:0", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(20 * time.Second))
+
+	// Enough chunks to fill the window more than once
+	sent := make([]byte, 3*forwardWindowSize*forwardChunkSize/2)
+	rand.Read(sent)
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(sent)
+		if err == nil {
+			err = conn.(*net.TCPConn).CloseWrite()
+		}
+		written <- err
+	}()
+
+	received, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-written; err != nil && !errors.Is(err, net.ErrClosed) {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(received, sent) {
+		t.Fatalf("expected the %d bytes back intact, got %d bytes", len(sent), len(received))
+	}
+}
@@ -0,0 +1,726 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"p2p/crypto"
+	"p2p/shared"
+)
+
+const (
+	// Largest group message text, it is encrypted twice and must still fit in a datagram
+	maxGroupMessageSize = 400
+	// Number of recent sequence numbers remembered per sender to drop replayed messages
+	groupReplayWindow = 64
+)
+
+// Member of a group, reached directly once punched or through another member otherwise
+type groupMember struct {
+	peer *shared.Peer
+	conn shared.Conn
+	// Diffie-Hellman secret of the pairwise channel, whichever path is used
+	secret [32]byte
+	// The member answered our connect messages, the direct path works both ways
+	connected bool
+	punched   chan struct{}
+
+	// Keys announced by the member, nil until received
+	senderKey  *[32]byte
+	signingKey ed25519.PublicKey
+	// Highest sequence number received and the bitmap of the ones before it
+	lastSeq  uint64
+	seenSeqs uint64
+}
+
+// Group session, every message is fanned out by its sender to every other member
+type group struct {
+	name    string
+	members map[string]*groupMember
+	// Proves to the rendez-vous server that we know the secret of the group
+	verifier string
+
+	// Each message we send is encrypted once with our sender key and signed with our signing key
+	senderKey  [32]byte
+	signingKey ed25519.PrivateKey
+	seq        uint64
+}
+
+func newGroup(name string, secret string) (*group, error) {
+	group := &group{
+		name:     name,
+		members:  make(map[string]*groupMember),
+		verifier: groupVerifier(name, secret),
+	}
+
+	_, err := rand.Read(group.senderKey[:])
+	if err != nil {
+		return nil, err
+	}
+
+	_, group.signingKey, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return group, nil
+}
+
+// Accept each sequence number once, within a window of the latest ones
+func (member *groupMember) acceptSeq(seq uint64) bool {
+	switch {
+	case seq == 0:
+		return false
+	case seq > member.lastSeq:
+		shift := seq - member.lastSeq
+		if shift >= groupReplayWindow {
+			member.seenSeqs = 0
+		} else {
+			member.seenSeqs <<= shift
+		}
+		member.seenSeqs |= 1
+		member.lastSeq = seq
+		return true
+	case member.lastSeq-seq >= groupReplayWindow:
+		return false
+	default:
+		bit := uint64(1) << (member.lastSeq - seq)
+		if member.seenSeqs&bit != 0 {
+			return false
+		}
+		member.seenSeqs |= bit
+		return true
+	}
+}
+
+// MAC of the group name keyed with the secret, the rendez-vous server never learns the secret
+func groupVerifier(name string, secret string) string {
+	return base64.StdEncoding.EncodeToString(crypto.MAC(sha256.Sum256([]byte(secret)), "Joining group", []byte(name)))
+}
+
+// Join a group, the rendez-vous server introduces us to every member and every member to us.
+// Only the peers joining with the same secret as the members are introduced.
+func (client *Client) JoinGroup(name string, secret string) error {
+	name = strings.TrimSpace(name)
+
+	if secret == "" {
+		return errors.New("group secret must not be empty")
+	}
+
+	client.groupsMutex.Lock()
+	group, ok := client.groups[name]
+	if !ok {
+		var err error
+		group, err = newGroup(name, secret)
+		if err != nil {
+			client.groupsMutex.Unlock()
+			return err
+		}
+
+		client.groups[name] = group
+	}
+	verifier := group.verifier
+	client.groupsMutex.Unlock()
+
+	return client.send(&shared.Message{
+		Type:    "group-join",
+		PeerID:  client.GetCurrentPeer().ID,
+		Content: &shared.Group{Name: name, Verifier: verifier},
+	})
+}
+
+// Leave a group, the rendez-vous server tells the remaining members
+func (client *Client) LeaveGroup(name string) error {
+	name = strings.TrimSpace(name)
+
+	client.groupsMutex.Lock()
+	delete(client.groups, name)
+	client.groupsMutex.Unlock()
+
+	return client.send(&shared.Message{
+		Type:    "group-leave",
+		PeerID:  client.GetCurrentPeer().ID,
+		Content: name,
+	})
+}
+
+// Members of a group we joined, sorted by ID
+func (client *Client) GetGroupMembers(name string) []*shared.Peer {
+	client.groupsMutex.Lock()
+	defer client.groupsMutex.Unlock()
+
+	group, ok := client.groups[strings.TrimSpace(name)]
+	if !ok {
+		return nil
+	}
+
+	peers := make([]*shared.Peer, 0, len(group.members))
+	for _, member := range group.members {
+		peers = append(peers, member.peer)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+
+	return peers
+}
+
+// Send text to every member of a group
+func (client *Client) SendGroupMessage(name string, text string) error {
+	if len(text) > maxGroupMessageSize {
+		return fmt.Errorf("group messages are limited to %d bytes", maxGroupMessageSize)
+	}
+
+	client.groupsMutex.Lock()
+
+	group, ok := client.groups[strings.TrimSpace(name)]
+	if !ok {
+		client.groupsMutex.Unlock()
+		return fmt.Errorf("not a member of group %s", name)
+	}
+
+	ciphertext, err := crypto.Encrypt([]byte(text), group.senderKey)
+	if err != nil {
+		client.groupsMutex.Unlock()
+		return err
+	}
+
+	group.seq += 1
+	content := &shared.GroupMessage{
+		Group:  group.name,
+		Sender: client.GetCurrentPeer().ID,
+		Seq:    group.seq,
+		Data:   base64.StdEncoding.EncodeToString(ciphertext),
+	}
+	content.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(group.signingKey, groupSignedData(content)))
+
+	conns, messages, err := client.fanOut(group, "group-message", content)
+	client.groupsMutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	for i, conn := range conns {
+		conn.Send(messages[i])
+	}
+
+	return nil
+}
+
+func (client *Client) OnGroupJoin(callback func(client *Client, group string, peer *shared.Peer)) {
+	client.groupJoinCallback = callback
+}
+
+func (client *Client) OnGroupLeave(callback func(client *Client, group string, peer *shared.Peer)) {
+	client.groupLeaveCallback = callback
+}
+
+func (client *Client) OnGroupMessage(callback func(client *Client, group string, peer *shared.Peer, text string)) {
+	client.groupMessageCallback = callback
+}
+
+// Bytes covered by the signature of a group message
+func groupSignedData(message *shared.GroupMessage) []byte {
+	var data []byte
+	for _, part := range []string{"p2p group message", message.Group, message.Sender, message.Data} {
+		data = binary.BigEndian.AppendUint64(data, uint64(len(part)))
+		data = append(data, part...)
+	}
+
+	return binary.BigEndian.AppendUint64(data, message.Seq)
+}
+
+// Add a member introduced by the rendez-vous server and start punching it
+func (client *Client) addGroupMember(name string, peer *shared.Peer) error {
+	if peer.ID == client.GetCurrentPeer().ID {
+		return nil
+	}
+
+	// The ID must be derived from the announced key
+	pubKey, err := peer.GetPublicKey()
+	if err != nil {
+		return err
+	}
+
+	if shared.GenPeerID(pubKey) != peer.ID {
+		return fmt.Errorf("public key of group member %s does not match its ID", peer.ID)
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", peer.Endpoint.String())
+	if err != nil {
+		return err
+	}
+
+	client.groupsMutex.Lock()
+
+	group, ok := client.groups[name]
+	if !ok {
+		client.groupsMutex.Unlock()
+		return nil
+	}
+
+	if member, ok := group.members[peer.ID]; ok && member.peer.Endpoint == peer.Endpoint {
+		client.groupsMutex.Unlock()
+		return nil
+	}
+
+	// Reuse the conn if we already talk to this address, e.g. the member is also the other peer
+	conn, ok := client.GetTransport().GetConn(addr.String())
+	if !ok {
+		conn, err = client.GetTransport().CreateConn(addr)
+		if err != nil {
+			client.groupsMutex.Unlock()
+			return err
+		}
+	}
+
+	member := &groupMember{
+		peer: &shared.Peer{
+			ID:        peer.ID,
+			Username:  peer.Username,
+			Endpoint:  peer.Endpoint,
+			PublicKey: peer.PublicKey,
+		},
+		conn:    conn,
+		secret:  crypto.GenSharedSecret(client.GetCurrentPeer().PrivateKey, pubKey),
+		punched: make(chan struct{}),
+	}
+	group.members[peer.ID] = member
+
+	client.groupsMutex.Unlock()
+
+	client.groupJoinCallback(client, name, member.peer)
+
+	client.spawn(func() { client.punchGroupMember(name, member) })
+
+	return nil
+}
+
+func (client *Client) removeGroupMember(name string, peerID string) {
+	client.groupsMutex.Lock()
+
+	group, ok := client.groups[name]
+	if !ok {
+		client.groupsMutex.Unlock()
+		return
+	}
+
+	member, ok := group.members[peerID]
+	if !ok {
+		client.groupsMutex.Unlock()
+		return
+	}
+
+	delete(group.members, peerID)
+
+	// The member that left must not read the next messages
+	var conns []shared.Conn
+	var messages []*shared.Message
+	_, err := rand.Read(group.senderKey[:])
+	if err == nil {
+		conns, messages, err = client.fanOut(group, "group-sender-key", client.senderKeyContent(group))
+	}
+
+	client.groupsMutex.Unlock()
+
+	if err != nil {
+		client.error("Could not rotate the sender key", "group", name, "err", err)
+	}
+
+	for i, conn := range conns {
+		conn.Send(messages[i])
+	}
+
+	client.groupLeaveCallback(client, name, member.peer)
+}
+
+// Send connect messages until the member answers, then announce our keys.
+// A member that never answers is reached through another member.
+func (client *Client) punchGroupMember(name string, member *groupMember) {
+punching:
+	for i := 0; i < client.options.PunchAttempts; i += 1 {
+		client.groupsMutex.Lock()
+		if !client.isGroupMember(name, member) {
+			client.groupsMutex.Unlock()
+			return
+		}
+		message, err := client.sealGroupMessage(member, "group-connect", name)
+		client.groupsMutex.Unlock()
+
+		if err != nil {
+			client.error("Could not punch group member", "group", name, "member", member.peer.ID, "err", err)
+			return
+		}
+
+		member.conn.Send(message)
+
+		select {
+		case <-client.exit:
+			return
+		case <-member.punched:
+			break punching
+		case <-time.After(client.options.PunchInterval):
+		}
+	}
+
+	client.groupsMutex.Lock()
+	if !member.connected {
+		client.warn("Could not punch group member, relaying through another member", "group", name, "member", member.peer.ID)
+	}
+	client.groupsMutex.Unlock()
+
+	client.sendSenderKey(name, member)
+}
+
+func (client *Client) sendSenderKey(name string, member *groupMember) {
+	client.groupsMutex.Lock()
+	if !client.isGroupMember(name, member) {
+		client.groupsMutex.Unlock()
+		return
+	}
+
+	group := client.groups[name]
+	message, err := client.sealGroupMessage(member, "group-sender-key", client.senderKeyContent(group))
+	conn := group.route(member)
+	client.groupsMutex.Unlock()
+
+	if err != nil {
+		client.error("Could not send the sender key", "group", name, "member", member.peer.ID, "err", err)
+		return
+	}
+
+	conn.Send(message)
+}
+
+// Must be called with the groups mutex held
+func (client *Client) isGroupMember(name string, member *groupMember) bool {
+	group, ok := client.groups[name]
+	return ok && group.members[member.peer.ID] == member
+}
+
+// Must be called with the groups mutex held
+func (client *Client) senderKeyContent(group *group) *shared.GroupSenderKey {
+	return &shared.GroupSenderKey{
+		Group:      group.name,
+		Key:        base64.StdEncoding.EncodeToString(group.senderKey[:]),
+		SigningKey: base64.StdEncoding.EncodeToString(group.signingKey.Public().(ed25519.PublicKey)),
+	}
+}
+
+// Seal the message for every member and pick the conn to reach each of them,
+// must be called with the groups mutex held
+func (client *Client) fanOut(group *group, messageType string, content interface{}) ([]shared.Conn, []*shared.Message, error) {
+	conns := make([]shared.Conn, 0, len(group.members))
+	messages := make([]*shared.Message, 0, len(group.members))
+
+	for _, member := range group.members {
+		message, err := client.sealGroupMessage(member, messageType, content)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		conns = append(conns, group.route(member))
+		messages = append(messages, message)
+	}
+
+	return conns, messages, nil
+}
+
+// Directly to the member once punched, otherwise through the first punched member,
+// which forwards the envelope if it reaches the member itself
+func (group *group) route(member *groupMember) shared.Conn {
+	if member.connected {
+		return member.conn
+	}
+
+	var relay *groupMember
+	for _, other := range group.members {
+		if other != member && other.connected && (relay == nil || other.peer.ID < relay.peer.ID) {
+			relay = other
+		}
+	}
+
+	if relay == nil {
+		return member.conn
+	}
+
+	return relay.conn
+}
+
+// Wrap a message in an envelope only the member can open, whichever path it takes
+func (client *Client) sealGroupMessage(member *groupMember, messageType string, content interface{}) (*shared.Message, error) {
+	currentPeer := client.GetCurrentPeer()
+
+	bytes, err := json.Marshal(&shared.Message{
+		Type:    messageType,
+		PeerID:  currentPeer.ID,
+		Content: content,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err = crypto.Encrypt(bytes, member.secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return &shared.Message{
+		Type:   "group",
+		PeerID: currentPeer.ID,
+		Content: &shared.GroupEnvelope{
+			From: currentPeer.ID,
+			To:   member.peer.ID,
+			Data: base64.StdEncoding.EncodeToString(bytes),
+		},
+	}, nil
+}
+
+// Any group member with the given ID, the pairwise secret is the same in every group.
+// Must be called with the groups mutex held.
+func (client *Client) findGroupMember(peerID string) (*groupMember, bool) {
+	for _, group := range client.groups {
+		if member, ok := group.members[peerID]; ok {
+			return member, true
+		}
+	}
+
+	return nil, false
+}
+
+// Forward an envelope between two members of a group we share with both of them, over a punched path only
+func (client *Client) relayGroupEnvelope(envelope *shared.GroupEnvelope) error {
+	client.groupsMutex.Lock()
+
+	var to *groupMember
+	for _, group := range client.groups {
+		member, ok := group.members[envelope.To]
+		if _, joined := group.members[envelope.From]; ok && joined && member.connected {
+			to = member
+			break
+		}
+	}
+
+	client.groupsMutex.Unlock()
+
+	if to == nil {
+		return fmt.Errorf("cannot relay group envelope from %s to %s", envelope.From, envelope.To)
+	}
+
+	return to.conn.Send(&shared.Message{
+		Type:    "group",
+		PeerID:  client.GetCurrentPeer().ID,
+		Content: envelope,
+	})
+}
+
+// Open an envelope addressed to us, returns the inner message and whether it came over the direct path
+func (client *Client) openGroupEnvelope(peerConn shared.Conn, envelope *shared.GroupEnvelope) (*shared.Message, bool, error) {
+	client.groupsMutex.Lock()
+	member, ok := client.findGroupMember(envelope.From)
+	client.groupsMutex.Unlock()
+
+	if !ok {
+		return nil, false, fmt.Errorf("received group envelope from unknown member %s", envelope.From)
+	}
+
+	bytes, err := base64.StdEncoding.DecodeString(envelope.Data)
+	if err != nil {
+		return nil, false, err
+	}
+
+	bytes, err = crypto.Decrypt(bytes, member.secret)
+	if err != nil {
+		return nil, false, err
+	}
+
+	message := &shared.Message{}
+	err = json.Unmarshal(bytes, message)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if message.PeerID != envelope.From {
+		return nil, false, errors.New("group envelope sender does not match its content")
+	}
+
+	return message, peerConn.GetAddr().String() == member.conn.GetAddr().String(), nil
+}
+
+// A member punched us, answer over the same path
+func (client *Client) groupConnect(name string, peerID string, direct bool) (*shared.Message, error) {
+	if !direct {
+		return nil, nil
+	}
+
+	client.groupsMutex.Lock()
+	defer client.groupsMutex.Unlock()
+
+	group, ok := client.groups[name]
+	if !ok {
+		return nil, nil
+	}
+
+	member, ok := group.members[peerID]
+	if !ok {
+		return nil, nil
+	}
+
+	return client.sealGroupMessage(member, "group-connected", name)
+}
+
+// A member answered our connect message, the direct path works both ways
+func (client *Client) groupConnected(name string, peerID string, direct bool) {
+	if !direct {
+		return
+	}
+
+	client.groupsMutex.Lock()
+	defer client.groupsMutex.Unlock()
+
+	group, ok := client.groups[name]
+	if !ok {
+		return
+	}
+
+	member, ok := group.members[peerID]
+	if !ok || member.connected {
+		return
+	}
+
+	member.connected = true
+	close(member.punched)
+}
+
+func (client *Client) setGroupSenderKey(peerID string, senderKey *shared.GroupSenderKey) error {
+	key, err := base64.StdEncoding.DecodeString(senderKey.Key)
+	if err != nil || len(key) != 32 {
+		return errors.New("malformed group sender key")
+	}
+
+	signingKey, err := base64.StdEncoding.DecodeString(senderKey.SigningKey)
+	if err != nil || len(signingKey) != ed25519.PublicKeySize {
+		return errors.New("malformed group signing key")
+	}
+
+	client.groupsMutex.Lock()
+	defer client.groupsMutex.Unlock()
+
+	group, ok := client.groups[senderKey.Group]
+	if !ok {
+		return nil
+	}
+
+	member, ok := group.members[peerID]
+	if !ok {
+		return nil
+	}
+
+	member.senderKey = new([32]byte)
+	copy(member.senderKey[:], key)
+	member.signingKey = ed25519.PublicKey(signingKey)
+
+	return nil
+}
+
+// Check, decrypt and deliver a message of another member
+func (client *Client) receiveGroupMessage(peerID string, message *shared.GroupMessage) error {
+	if message.Sender != peerID {
+		return errors.New("group message sender does not match its envelope")
+	}
+
+	client.groupsMutex.Lock()
+
+	group, ok := client.groups[message.Group]
+	if !ok {
+		client.groupsMutex.Unlock()
+		return nil
+	}
+
+	member, ok := group.members[message.Sender]
+	if !ok {
+		client.groupsMutex.Unlock()
+		return fmt.Errorf("received group message from unknown member %s", message.Sender)
+	}
+
+	// The sender key was lost, ask for it again
+	if member.senderKey == nil {
+		client.groupsMutex.Unlock()
+		client.spawn(func() { client.requestSenderKey(group.name, member) })
+		return fmt.Errorf("no sender key yet for group member %s", member.peer.ID)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(message.Signature)
+	if err != nil || !ed25519.Verify(member.signingKey, groupSignedData(message), signature) {
+		client.groupsMutex.Unlock()
+		return fmt.Errorf("invalid signature on group message from %s", member.peer.ID)
+	}
+
+	if !member.acceptSeq(message.Seq) {
+		client.groupsMutex.Unlock()
+		return fmt.Errorf("dropped replayed group message from %s", member.peer.ID)
+	}
+
+	senderKey := *member.senderKey
+	peer := member.peer
+	client.groupsMutex.Unlock()
+
+	ciphertext, err := base64.StdEncoding.DecodeString(message.Data)
+	if err != nil {
+		return err
+	}
+
+	text, err := crypto.Decrypt(ciphertext, senderKey)
+	if err != nil {
+		return err
+	}
+
+	client.groupMessageCallback(client, message.Group, peer, string(text))
+
+	return nil
+}
+
+func (client *Client) requestSenderKey(name string, member *groupMember) {
+	client.groupsMutex.Lock()
+	if !client.isGroupMember(name, member) {
+		client.groupsMutex.Unlock()
+		return
+	}
+
+	message, err := client.sealGroupMessage(member, "group-sender-key-request", name)
+	conn := client.groups[name].route(member)
+	client.groupsMutex.Unlock()
+
+	if err != nil {
+		client.error("Could not request the sender key", "group", name, "member", member.peer.ID, "err", err)
+		return
+	}
+
+	conn.Send(message)
+}
+
+// A member lost our sender key
+func (client *Client) groupSenderKeyRequest(name string, peerID string) {
+	client.groupsMutex.Lock()
+
+	group, ok := client.groups[name]
+	var member *groupMember
+	if ok {
+		member, ok = group.members[peerID]
+	}
+
+	client.groupsMutex.Unlock()
+
+	if ok {
+		client.sendSenderKey(name, member)
+	}
+}
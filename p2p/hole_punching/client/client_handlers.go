@@ -1,23 +1,62 @@
 package client
 
 import (
+	"crypto/ed25519"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"net"
-	"p2p/crypto"
+	"time"
 
+	"p2p/crypto"
 	"p2p/shared"
 
 	"github.com/mitchellh/mapstructure"
 )
 
-func createMessageCallback(client *Client) func(shared.Conns, shared.Conn, *shared.Message) {
-	return func(conns shared.Conns, conn shared.Conn, message *shared.Message) {
+func createMessageCallback(client *Client) func(shared.Conn, *shared.Message) {
+	return func(conn shared.Conn, message *shared.Message) {
+		if message.Encrypt && conn == client.GetRDVServerConn() {
+			client.serverSeen()
+		}
+
+		// The other peer may have moved, its new address is only used once it answers a challenge
+		if otherPeer := client.GetOtherPeer(); otherPeer != nil && message.PeerID == otherPeer.ID && message.Type != "path-response" &&
+			conn != client.GetOtherPeerConn() && conn != client.GetRDVServerConn() {
+			if err := client.challengePath(conn); err != nil {
+				client.error("Could not challenge the new path", "addr", conn.GetAddr(), "err", err)
+			}
+		}
+
+		// Errors answered by the rendez-vous server, with their code
+		if err := message.Err(); err != nil && conn == client.GetRDVServerConn() {
+			client.errorCallback(client, err)
+		}
+
+		// Answers of our requests, only the first answer of a retransmitted request is handled
+		var pending *pendingRequest
+		if message.RequestID != 0 && conn == client.GetRDVServerConn() {
+			var ok bool
+			pending, ok = client.answered(message)
+			if !ok {
+				client.debug("Dropped answer of an answered request", "type", message.Type, "requestID", message.RequestID)
+				return
+			}
+		}
+
 		// Ensure there was no error during registration
-		res, err := route(client, conns, conn, message)
+		res, err := route(client, conn, message)
+		client.observeMessage(message.Type, err)
 		if err != nil {
-			fmt.Println(err)
+			client.warn("Could not handle message", "type", message.Type, "addr", conn.GetAddr(), "err", err)
+		}
+
+		// The callers waiting for the answer get the answered error first
+		if pending != nil {
+			if answerErr := message.Err(); answerErr != nil {
+				err = answerErr
+			}
+			pending.resolve(message, err)
 		}
 
 		if res != nil {
@@ -26,29 +65,118 @@ func createMessageCallback(client *Client) func(shared.Conns, shared.Conn, *shar
 	}
 }
 
-func route(client *Client, conns shared.Conns, conn shared.Conn, message *shared.Message) (*shared.Message, error) {
+func route(client *Client, conn shared.Conn, message *shared.Message) (*shared.Message, error) {
 	switch message.Type {
+	case "cookie":
+		return cookieHandler(client, conn, message)
 	case "greeting":
 		return greetingHandler(client, conn, message)
 	case "register":
 		return registerHandler(client, conn, message)
+	case "unknown-session":
+		return unknownSessionHandler(client, conn, message)
+	case "resume":
+		return resumeHandler(client, conn, message)
+	case "resume-connect", "resume-connected":
+		return resumeConnectHandler(client, conn, message)
+	case "path-challenge":
+		return pathChallengeHandler(client, conn, message)
+	case "path-response":
+		return pathResponseHandler(client, conn, message)
 	case "establish":
 		return establishHandler(client, conn, message)
+	case "establish-pending", "consent":
+		return pendingHandler(client, conn, message)
+	case "incoming":
+		return incomingHandler(client, conn, message)
+	case "keepalive":
+		return keepaliveHandler(client, conn, message)
+	case "bye":
+		return byeHandler(client, conn, message)
+	case "code-create":
+		return codeCreateHandler(client, conn, message)
+	case "code-join":
+		return codeJoinHandler(client, conn, message)
 	case "connect":
 		return connectHandler(client, conn, message)
+	case "key":
+		return keyHandler(client, conn, message)
 	case "message":
 		return messageHandler(client, conn, message)
+	case "pake":
+		return pakeHandler(client, conn, message)
+	case "pake-confirm":
+		return pakeConfirmHandler(client, conn, message)
+	case "quic":
+		return quicHandler(client, conn, message)
+	case "forward-open":
+		return forwardOpenHandler(client, conn, message)
+	case "forward-data":
+		return forwardDataHandler(client, conn, message)
+	case "forward-ack":
+		return forwardAckHandler(client, conn, message)
+	case "group-join":
+		return groupJoinHandler(client, conn, message)
+	case "group-leave":
+		return groupLeaveHandler(client, conn, message)
+	case "group":
+		return groupHandler(client, conn, message)
+	case "list":
+		return listHandler(client, conn, message)
+	case "lookup":
+		return lookupHandler(client, conn, message)
+	case "presence":
+		return presenceHandler(client, conn, message)
+	case "subscribe", "unsubscribe":
+		return subscribeHandler(client, conn, message)
 	}
 
 	return nil, nil
 }
 
+// The rendez-vous server checks that we own our source address before greeting us
+func cookieHandler(client *Client, serverConn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	if serverConn != client.GetRDVServerConn() {
+		return nil, errors.New("rejected cookie not sent by the rendez-vous server")
+	}
+
+	cookie, ok := message.Content.(string)
+	if !ok || cookie == "" {
+		return nil, errors.New("expected to receive a cookie")
+	}
+
+	// Greet again with the cookie
+	return nil, client.greet(cookie)
+}
+
+// The rendez-vous server restarted and lost our session, greet it and register again
+func unknownSessionHandler(client *Client, serverConn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	if serverConn != client.GetRDVServerConn() {
+		return nil, errors.New("rejected unknown session not sent by the rendez-vous server")
+	}
+
+	// Every request sent before the greeting completes is answered the same way
+	client.mutex.Lock()
+	now := time.Now()
+	if now.Sub(client.lastUnknownSession) < time.Second {
+		client.mutex.Unlock()
+		return nil, nil
+	}
+	client.lastUnknownSession = now
+	client.mutex.Unlock()
+
+	client.info("Rendez-vous server lost our session, registering again", "server", client.addr)
+
+	return nil, client.greet("")
+}
+
 func greetingHandler(client *Client, serverConn shared.Conn, message *shared.Message) (*shared.Message, error) {
 	currentPeer := client.GetCurrentPeer()
 
 	// Quit the client if greeting fails
-	if message.Error != "" {
-		return nil, errors.New(message.Error)
+	if err := message.Err(); err != nil {
+		client.handshakeDone(err)
+		return nil, err
 	}
 
 	// Ensure that server sent back a public key string
@@ -57,6 +185,11 @@ func greetingHandler(client *Client, serverConn shared.Conn, message *shared.Mes
 		return nil, errors.New("expected to receive public key with greeting")
 	}
 
+	// Make sure we are talking to the expected rendez-vous server
+	if client.options.ServerKey != "" && client.options.ServerKey != str {
+		return nil, errors.New("rendez-vous server public key does not match the expected key")
+	}
+
 	// Get server public key
 	bytes, err := base64.StdEncoding.DecodeString(str)
 	if err != nil {
@@ -74,37 +207,173 @@ func greetingHandler(client *Client, serverConn shared.Conn, message *shared.Mes
 	// Create and store secret
 	serverConn.SetSecret(crypto.GenSharedSecret(currentPeer.PrivateKey, pubKey))
 
+	// Prove that we own the identity key the username is bound to
+	registration := &shared.Registration{
+		Username:    currentPeer.Username,
+		Namespace:   currentPeer.Namespace,
+		PublicKey:   base64.StdEncoding.EncodeToString(serverPubKey[:]),
+		Visible:     client.options.Visible,
+		IdentityKey: currentPeer.IdentityKey,
+	}
+	registration.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(client.options.IdentityKey, registration.SignedData(pubKey)))
+
 	// Send register message to server
-	return &shared.Message{
-		Type:   "register",
-		PeerID: currentPeer.ID,
-		Content: shared.Registration{
-			Username:  currentPeer.Username,
-			PublicKey: base64.StdEncoding.EncodeToString(serverPubKey[:]),
-		},
-	}, nil
+	return nil, client.send(&shared.Message{
+		Type:    "register",
+		PeerID:  currentPeer.ID,
+		Content: registration,
+		Encrypt: true,
+	})
 }
 
 func registerHandler(client *Client, serverConn shared.Conn, message *shared.Message) (*shared.Message, error) {
 	// Quit the client if registration fails
-	if message.Error != "" {
-		return nil, errors.New(message.Error)
+	if err := message.Err(); err != nil {
+		client.handshakeDone(err)
+		return nil, err
+	}
+
+	// Older servers do not send back our endpoint
+	var endpoint shared.Endpoint
+	mapstructure.Decode(message.Content, &endpoint)
+
+	client.mutex.Lock()
+	registered := client.registered
+	client.registered = true
+	subscription := client.subscription
+	moved := endpoint.IP != "" && client.endpoint != "" && endpoint.String() != client.endpoint
+	if endpoint.IP != "" {
+		client.endpoint = endpoint.String()
 	}
+	client.mutex.Unlock()
+
+	client.metrics.registrations.Inc()
+	client.handshakeDone(nil)
+
+	if !registered {
+		client.spawn(client.keepalive)
+
+		client.registeredCallback(client)
+
+		return nil, nil
+	}
+
+	// Registered again from another endpoint, the other peer has to punch it
+	if moved {
+		client.info("Our endpoint changed", "endpoint", endpoint)
 
-	client.registeredCallback(client)
+		if err := client.resume(); err != nil {
+			client.error("Could not resume the session", "err", err)
+		}
+	}
+
+	// Registered again after a restart of the server, which may have forgotten our subscription and groups
+	if subscription != nil {
+		client.Subscribe(*subscription)
+	}
+
+	client.groupsMutex.Lock()
+	joins := make([]*shared.Group, 0, len(client.groups))
+	for name, group := range client.groups {
+		joins = append(joins, &shared.Group{Name: name, Verifier: group.verifier})
+	}
+	client.groupsMutex.Unlock()
+
+	for _, join := range joins {
+		client.send(&shared.Message{
+			Type:    "group-join",
+			PeerID:  client.GetCurrentPeer().ID,
+			Content: join,
+		})
+	}
+
+	return nil, nil
+}
+
+func keepaliveHandler(client *Client, serverConn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	if err := message.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// The rendez-vous server or the other peer is leaving, only trusted over the encrypted channel
+func byeHandler(client *Client, conn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	if !message.Encrypt {
+		return nil, errors.New("rejected bye not sent over the encrypted channel")
+	}
+
+	switch conn {
+	case client.GetRDVServerConn():
+		// Greeted again once it is back, see the reconnect timeout
+		client.warn("Rendez-vous server is shutting down", "server", client.addr)
+	case client.GetOtherPeerConn():
+		client.mutex.Lock()
+		client.resumption = nil
+		client.mutex.Unlock()
+
+		client.info("Other peer disconnected", "peer", message.PeerID)
+		client.disconnectedCallback(client)
+	}
+
+	return nil, nil
+}
+
+func codeCreateHandler(client *Client, serverConn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	if err := message.Err(); err != nil {
+		return nil, err
+	}
+
+	nameplate, ok := message.Content.(string)
+	if !ok || nameplate == "" {
+		return nil, errors.New("expected to receive the nameplate of a pairing code")
+	}
+
+	// The server only knows the nameplate, the password words authenticate the other peer once connected
+	password, err := genPassword()
+	if err != nil {
+		return nil, err
+	}
+
+	code := normalizeCode(nameplate + "-" + password)
+	err = client.setPairingCode(code)
+	if err != nil {
+		return nil, err
+	}
+
+	client.codeCallback(client, code)
+
+	return nil, nil
+}
+
+// Successful joins are answered with an establish message, only errors come back as code-join
+func codeJoinHandler(client *Client, serverConn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	if err := message.Err(); err != nil {
+		return nil, err
+	}
 
 	return nil, nil
 }
 
 func establishHandler(client *Client, serverConn shared.Conn, message *shared.Message) (*shared.Message, error) {
-	if message.Error != "" {
-		return nil, errors.New(message.Error)
+	// Anyone else could make us punch the endpoint of its choice
+	if serverConn != client.GetRDVServerConn() {
+		return nil, fmt.Errorf("rejected %s message not sent by the rendez-vous server", message.Type)
+	}
+
+	if err := message.Err(); err != nil {
+		client.establishFailedCallback(client, err)
+		return nil, err
+	}
+
+	if err := ensureRDVServer(client, serverConn, message); err != nil {
+		return nil, err
 	}
 
 	var peer shared.Peer
 	err := mapstructure.Decode(message.Content, &peer)
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
 
@@ -131,19 +400,46 @@ func establishHandler(client *Client, serverConn shared.Conn, message *shared.Me
 		return nil, nil
 	}
 
-	go func() {
-		otherPeerConn, err := client.GetRDVServer().CreateConn(addr)
+	client.spawn(func() {
+		otherPeerConn, err := client.GetTransport().CreateConn(addr)
 		if err != nil {
 			return
 		}
 
 		client.SetOtherPeerConn(otherPeerConn)
+		client.info("Punching the other peer", "addr", addr)
 
-		go client.Connect()
+		client.spawn(client.Connect)
 
 		// Call the callback after the connection
 		client.connectingCallback(client)
-	}()
+	})
+
+	return nil, nil
+}
+
+// Our establish request waits for the consent of the other peer, and our consent was received
+func pendingHandler(client *Client, serverConn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	return nil, ensureRDVServer(client, serverConn, message)
+}
+
+// A peer asks to connect with us, its endpoint and ours are only exchanged once we accept
+func incomingHandler(client *Client, serverConn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	if err := ensureRDVServer(client, serverConn, message); err != nil {
+		return nil, err
+	}
+
+	var peer shared.Peer
+	err := mapstructure.Decode(message.Content, &peer)
+	if err != nil {
+		return nil, err
+	}
+
+	if client.isBlocked(peer.Fingerprint()) {
+		return nil, client.Decline(peer.ID)
+	}
+
+	client.incomingCallback(client, &peer)
 
 	return nil, nil
 }
@@ -176,6 +472,10 @@ func connectHandler(client *Client, peerConn shared.Conn, message *shared.Messag
 }
 
 func messageHandler(client *Client, peerConn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	if peerConn != client.GetOtherPeerConn() {
+		return nil, errors.New("received chat message from unknown peer")
+	}
+
 	text, ok := message.Content.(string)
 	if !ok {
 		return nil, errors.New("message message must send some text in content field")
@@ -185,3 +485,391 @@ func messageHandler(client *Client, peerConn shared.Conn, message *shared.Messag
 
 	return nil, nil
 }
+
+// Create the encrypted channel from the other peer's public key
+func keyHandler(client *Client, peerConn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	if peerConn != client.GetOtherPeerConn() {
+		return nil, errors.New("received key message from unknown peer")
+	}
+
+	str, ok := message.Content.(string)
+	if !ok {
+		return nil, errors.New("key message must send a public key in content field")
+	}
+
+	bytes, err := base64.StdEncoding.DecodeString(str)
+	if err != nil {
+		return nil, err
+	}
+	var pubKey [32]byte
+	copy(pubKey[:], bytes)
+
+	secret := crypto.GenSharedSecret(client.GetCurrentPeer().PrivateKey, pubKey)
+
+	// Wait for the pairing code to be confirmed before using the secret
+	if pake := client.getPAKE(); pake != nil {
+		return client.startPAKE(pake, secret), nil
+	}
+
+	peerConn.SetSecret(secret)
+
+	return nil, client.onSecret()
+}
+
+// Derive the key from the pairing code and the other peer's SPAKE2 message, then prove we know it
+func pakeHandler(client *Client, peerConn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	if peerConn != client.GetOtherPeerConn() {
+		return nil, errors.New("received pake message from unknown peer")
+	}
+
+	pake := client.getPAKE()
+	if pake == nil {
+		return nil, errors.New("received pake message but no pairing code was used")
+	}
+
+	str, ok := message.Content.(string)
+	if !ok {
+		return nil, errors.New("pake message must send a SPAKE2 message in content field")
+	}
+
+	bytes, err := base64.StdEncoding.DecodeString(str)
+	if err != nil {
+		return nil, err
+	}
+
+	confirmation, err := pake.finish(bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &shared.Message{
+		Type:    "pake-confirm",
+		PeerID:  client.GetCurrentPeer().ID,
+		Content: base64.StdEncoding.EncodeToString(confirmation),
+	}, nil
+}
+
+// Check that the other peer derived the same key, which means it used the same pairing code
+func pakeConfirmHandler(client *Client, peerConn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	if peerConn != client.GetOtherPeerConn() {
+		return nil, errors.New("received pake-confirm message from unknown peer")
+	}
+
+	pake := client.getPAKE()
+	if pake == nil {
+		return nil, errors.New("received pake-confirm message but no pairing code was used")
+	}
+
+	str, ok := message.Content.(string)
+	if !ok {
+		return nil, errors.New("pake-confirm message must send a confirmation in content field")
+	}
+
+	bytes, err := base64.StdEncoding.DecodeString(str)
+	if err != nil {
+		return nil, err
+	}
+
+	authenticated, err := pake.confirm(peerConn, bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if authenticated {
+		client.authenticatedCallback(client)
+	}
+
+	return nil, client.onSecret()
+}
+
+// Peer messages carrying sensitive content are only accepted from the connected peer over the encrypted channel
+func ensureEncryptedPeer(client *Client, peerConn shared.Conn, message *shared.Message) error {
+	if peerConn != client.GetOtherPeerConn() || !message.Encrypt {
+		return fmt.Errorf("rejected %s message from unknown or unencrypted peer", message.Type)
+	}
+
+	return nil
+}
+
+// Receive the other peer's certificate fingerprint and start QUIC
+func quicHandler(client *Client, peerConn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	if err := ensureEncryptedPeer(client, peerConn, message); err != nil {
+		return nil, err
+	}
+
+	if client.quic == nil {
+		return nil, errors.New("received quic message but QUIC is not enabled")
+	}
+
+	str, ok := message.Content.(string)
+	if !ok {
+		return nil, errors.New("quic message must send a certificate fingerprint in content field")
+	}
+
+	fingerprint, err := base64.StdEncoding.DecodeString(str)
+	if err != nil {
+		return nil, err
+	}
+
+	client.startQUIC(fingerprint)
+
+	return nil, nil
+}
+
+func forwardOpenHandler(client *Client, peerConn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	if err := ensureEncryptedPeer(client, peerConn, message); err != nil {
+		return nil, err
+	}
+
+	var open shared.ForwardOpen
+	err := mapstructure.Decode(message.Content, &open)
+	if err != nil {
+		return nil, err
+	}
+
+	// Answer to our own forward request
+	if stream, ok := client.getStream(open.StreamID); ok && stream.initiator {
+		err := message.Err()
+
+		select {
+		case stream.opened <- err:
+		default:
+		}
+
+		return nil, nil
+	}
+
+	res := &shared.Message{
+		Type:    "forward-open",
+		PeerID:  client.GetCurrentPeer().ID,
+		Content: &shared.ForwardOpen{StreamID: open.StreamID},
+		Encrypt: true,
+	}
+
+	// Request already accepted, the answer was lost
+	if _, ok := client.getStream(open.StreamID); ok {
+		return res, nil
+	}
+
+	if !client.isExposed(open.Addr) {
+		res.Error = fmt.Sprintf("address %s is not exposed", open.Addr)
+		return res, nil
+	}
+
+	conn, err := net.DialTimeout("tcp", open.Addr, 5*time.Second)
+	if err != nil {
+		res.Error = err.Error()
+		return res, nil
+	}
+
+	stream := newStream(client, open.StreamID, false, conn)
+	client.addStream(stream)
+
+	go stream.run()
+
+	return res, nil
+}
+
+func forwardDataHandler(client *Client, peerConn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	if err := ensureEncryptedPeer(client, peerConn, message); err != nil {
+		return nil, err
+	}
+
+	var chunk shared.ForwardData
+	err := mapstructure.Decode(message.Content, &chunk)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, ok := client.getStream(chunk.StreamID)
+	if !ok {
+		return nil, nil
+	}
+
+	return nil, stream.receive(&chunk)
+}
+
+func forwardAckHandler(client *Client, peerConn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	if err := ensureEncryptedPeer(client, peerConn, message); err != nil {
+		return nil, err
+	}
+
+	var ack shared.ForwardAck
+	err := mapstructure.Decode(message.Content, &ack)
+	if err != nil {
+		return nil, err
+	}
+
+	if stream, ok := client.getStream(ack.StreamID); ok {
+		stream.ack(ack.Seq)
+	}
+
+	return nil, nil
+}
+
+// Answers and events of the rendez-vous server are only accepted over its encrypted channel
+func ensureRDVServer(client *Client, serverConn shared.Conn, message *shared.Message) error {
+	if err := message.Err(); err != nil {
+		return err
+	}
+
+	if serverConn != client.GetRDVServerConn() || !message.Encrypt {
+		return fmt.Errorf("rejected %s message not sent by the rendez-vous server", message.Type)
+	}
+
+	return nil
+}
+
+func decodeGroupEvent(client *Client, serverConn shared.Conn, message *shared.Message) (*shared.Group, error) {
+	if err := ensureRDVServer(client, serverConn, message); err != nil {
+		return nil, err
+	}
+
+	var group shared.Group
+	err := mapstructure.Decode(message.Content, &group)
+	if err != nil {
+		return nil, err
+	}
+
+	return &group, nil
+}
+
+// New members of a group, our own join is confirmed without members
+func groupJoinHandler(client *Client, serverConn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	group, err := decodeGroupEvent(client, serverConn, message)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, peer := range group.Members {
+		if err := client.addGroupMember(group.Name, peer); err != nil {
+			client.error("Could not add group member", "group", group.Name, "member", peer.ID, "err", err)
+		}
+	}
+
+	return nil, nil
+}
+
+// Members that left a group, our own leave is confirmed without members
+func groupLeaveHandler(client *Client, serverConn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	group, err := decodeGroupEvent(client, serverConn, message)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, peer := range group.Members {
+		client.removeGroupMember(group.Name, peer.ID)
+	}
+
+	return nil, nil
+}
+
+// Envelope from another group member, relayed if it is not addressed to us
+func groupHandler(client *Client, peerConn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	var envelope shared.GroupEnvelope
+	err := mapstructure.Decode(message.Content, &envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	if envelope.To != client.GetCurrentPeer().ID {
+		return nil, client.relayGroupEnvelope(&envelope)
+	}
+
+	inner, direct, err := client.openGroupEnvelope(peerConn, &envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	switch inner.Type {
+	case "group-connect", "group-connected", "group-sender-key-request":
+		name, ok := inner.Content.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s message must send a group name in content field", inner.Type)
+		}
+
+		switch inner.Type {
+		case "group-connect":
+			return client.groupConnect(name, envelope.From, direct)
+		case "group-connected":
+			client.groupConnected(name, envelope.From, direct)
+		default:
+			client.groupSenderKeyRequest(name, envelope.From)
+		}
+	case "group-sender-key":
+		var senderKey shared.GroupSenderKey
+		err := mapstructure.Decode(inner.Content, &senderKey)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, client.setGroupSenderKey(envelope.From, &senderKey)
+	case "group-message":
+		var groupMessage shared.GroupMessage
+		err := mapstructure.Decode(inner.Content, &groupMessage)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, client.receiveGroupMessage(envelope.From, &groupMessage)
+	}
+
+	return nil, nil
+}
+
+func listHandler(client *Client, serverConn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	if err := ensureRDVServer(client, serverConn, message); err != nil {
+		return nil, err
+	}
+
+	var list shared.PeerList
+	err := mapstructure.Decode(message.Content, &list)
+	if err != nil {
+		return nil, err
+	}
+
+	client.listCallback(client, &list)
+
+	return nil, nil
+}
+
+func lookupHandler(client *Client, serverConn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	if err := ensureRDVServer(client, serverConn, message); err != nil {
+		return nil, err
+	}
+
+	var peer shared.Peer
+	err := mapstructure.Decode(message.Content, &peer)
+	if err != nil {
+		return nil, err
+	}
+
+	client.lookupCallback(client, &peer)
+
+	return nil, nil
+}
+
+func presenceHandler(client *Client, serverConn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	if err := ensureRDVServer(client, serverConn, message); err != nil {
+		return nil, err
+	}
+
+	var presence shared.Presence
+	err := mapstructure.Decode(message.Content, &presence)
+	if err != nil {
+		return nil, err
+	}
+
+	if presence.Peer == nil {
+		return nil, errors.New("presence message must send a peer in content field")
+	}
+
+	client.presenceCallback(client, presence.Peer, presence.Online)
+
+	return nil, nil
+}
+
+// Subscriptions are confirmed without content, only errors matter
+func subscribeHandler(client *Client, serverConn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	return nil, ensureRDVServer(client, serverConn, message)
+}
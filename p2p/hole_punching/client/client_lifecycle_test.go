@@ -0,0 +1,204 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"testing"
+	"time"
+
+	"p2p/hole_punching/server"
+	"p2p/shared"
+)
+
+// Rendez-vous server listening on a loopback port until ctx is done, returns once Listen returned
+func startTestServer(t testing.TB, ctx context.Context) (*server.Server, <-chan struct{}) {
+	t.Helper()
+
+	rdv, err := server.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdv.SetLogger(slog.New(slog.DiscardHandler))
+
+	stopped := make(chan struct{})
+	go func() {
+		rdv.Listen(ctx)
+		close(stopped)
+	}()
+	t.Cleanup(rdv.Stop)
+
+	return rdv, stopped
+}
+
+func serverOptions(rdv *server.Server) Options {
+	options := testOptions()
+	options.ServerAddr = rdv.LocalAddr().String()
+
+	return options
+}
+
+func register(t testing.TB, client *Client) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Register(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Fail unless the goroutines get back to the baseline count, those of the stopped clients and servers return shortly after Stop
+func expectGoroutines(t testing.TB, baseline int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("expected at most %d goroutines, got %d\n%s", baseline, runtime.NumGoroutine(), buf[:runtime.Stack(buf, true)])
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func waitPeers(t testing.TB, rdv *server.Server, count int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(rdv.Peers()) != count {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d registered peers, got %d", count, len(rdv.Peers()))
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStartStopRepeatedly(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rdv, stopped := startTestServer(t, ctx)
+
+	// Usernames stay bound to the key of their first peer, every client has its own
+	for i := range 20 {
+		client, err := NewClient(fmt.Sprintf("alice%d", i), serverOptions(rdv))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := client.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		register(t, client)
+		waitPeers(t, rdv, 1)
+
+		// The client says bye, the server forgets it
+		client.Stop()
+		client.Stop()
+		waitPeers(t, rdv, 0)
+	}
+
+	rdv.Stop()
+	rdv.Stop()
+	<-stopped
+
+	expectGoroutines(t, baseline)
+}
+
+func TestStopBeforeStart(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rdv, _ := startTestServer(t, ctx)
+
+	client, err := NewClient("alice", serverOptions(rdv))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.Stop()
+
+	if err := client.Register(context.Background()); err != ErrClientStopped {
+		t.Fatalf("expected the client to be stopped, got %v", err)
+	}
+
+	// A stopped server returns from Listen right away
+	stopped, err := server.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped.SetLogger(slog.New(slog.DiscardHandler))
+	stopped.Stop()
+	stopped.Listen(context.Background())
+
+	rdv.Stop()
+	expectGoroutines(t, baseline)
+}
+
+func TestCancelStopsClientsAndServer(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rdv, stopped := startTestServer(t, ctx)
+
+	var clients []*Client
+	for _, username := range []string{"alice", "bob"} {
+		client, err := NewClient(username, serverOptions(rdv))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(client.Stop)
+
+		// Connection requests are left unanswered
+		client.OnIncoming(func(client *Client, peer *shared.Peer) {})
+
+		if err := client.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		register(t, client)
+
+		clients = append(clients, client)
+	}
+
+	waitPeers(t, rdv, 2)
+
+	// Bob never answers, the establish request is still waiting for his consent when the context is cancelled
+	established := make(chan error, 1)
+	go func() {
+		_, err := clients[0].Establish(ctx, clients[1].GetCurrentPeer().ID)
+		established <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-established:
+		if !errors.Is(err, context.Canceled) && !errors.Is(err, ErrClientStopped) {
+			t.Fatalf("expected the establish request to be cancelled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the establish request to return once the context is cancelled")
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the server to stop once the context is cancelled")
+	}
+
+	// Cancelling the context alone stops the clients and the server
+	expectGoroutines(t, baseline)
+}
@@ -0,0 +1,34 @@
+package client
+
+import (
+	"context"
+	"log/slog"
+
+	"p2p/shared"
+)
+
+// Records carry our peer ID, and the session ID once we connect with another peer,
+// the rendez-vous server logs the same session ID
+func (client *Client) log(level slog.Level, msg string, args ...any) {
+	if otherPeer := client.GetOtherPeer(); otherPeer != nil && otherPeer.ID != "" {
+		args = append(args, "session", shared.SessionID(client.GetCurrentPeer().ID, otherPeer.ID))
+	}
+
+	client.logger.Log(context.Background(), level, msg, args...)
+}
+
+func (client *Client) debug(msg string, args ...any) {
+	client.log(slog.LevelDebug, msg, args...)
+}
+
+func (client *Client) info(msg string, args ...any) {
+	client.log(slog.LevelInfo, msg, args...)
+}
+
+func (client *Client) warn(msg string, args ...any) {
+	client.log(slog.LevelWarn, msg, args...)
+}
+
+func (client *Client) error(msg string, args ...any) {
+	client.log(slog.LevelError, msg, args...)
+}
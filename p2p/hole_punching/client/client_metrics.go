@@ -0,0 +1,111 @@
+package client
+
+import (
+	"time"
+
+	"p2p/metrics"
+)
+
+// Types of the messages the client handles, the others are counted as unknown so that peers cannot add series
+var messageTypes = map[string]bool{
+	"cookie":            true,
+	"greeting":          true,
+	"register":          true,
+	"unknown-session":   true,
+	"resume":            true,
+	"resume-connect":    true,
+	"resume-connected":  true,
+	"path-challenge":    true,
+	"path-response":     true,
+	"establish":         true,
+	"establish-pending": true,
+	"consent":           true,
+	"incoming":          true,
+	"keepalive":         true,
+	"code-create":       true,
+	"code-join":         true,
+	"connect":           true,
+	"key":               true,
+	"message":           true,
+	"pake":              true,
+	"pake-confirm":      true,
+	"quic":              true,
+	"forward-open":      true,
+	"forward-data":      true,
+	"forward-ack":       true,
+	"group-join":        true,
+	"group-leave":       true,
+	"group":             true,
+	"list":              true,
+	"lookup":            true,
+	"presence":          true,
+	"subscribe":         true,
+	"unsubscribe":       true,
+}
+
+type clientMetrics struct {
+	registrations *metrics.Counter
+	// Messages received and messages whose handling failed, by type
+	messages *metrics.Counter
+	errors   *metrics.Counter
+	// Punches by result: success once the encrypted channel is up, failure when the connect messages run out
+	punches      *metrics.Counter
+	punchLatency *metrics.Histogram
+}
+
+// Export the metrics of the client to the registry, e.g. served by the app next to its own metrics.
+// The series are labelled with our peer ID, several clients can share a registry.
+func (client *Client) SetMetrics(registry *metrics.Registry) {
+	labels := metrics.Labels{"peer": client.GetCurrentPeer().ID}
+
+	client.metrics = &clientMetrics{
+		registrations: registry.Counter("p2p_client_registrations_total", "Registrations with the rendez-vous server.", labels),
+		messages:      registry.Counter("p2p_client_messages_total", "Messages received, by type.", labels, "type"),
+		errors:        registry.Counter("p2p_client_errors_total", "Messages whose handling failed, by type.", labels, "type"),
+		punches:       registry.Counter("p2p_client_punches_total", "Hole punching attempts with another peer, by result.", labels, "result"),
+		punchLatency:  registry.Histogram("p2p_client_punch_duration_seconds", "Time from the first connect message to the encrypted channel with the other peer.", labels, nil),
+	}
+
+	registry.GaugeFunc("p2p_client_send_queue_length", "Datagrams waiting to be written to the socket.", labels, func() float64 {
+		return float64(client.GetTransport().QueueLength())
+	})
+}
+
+func (client *Client) observeMessage(messageType string, err error) {
+	if !messageTypes[messageType] {
+		messageType = "unknown"
+	}
+
+	client.metrics.messages.Inc(messageType)
+	if err != nil {
+		client.metrics.errors.Inc(messageType)
+	}
+}
+
+func (client *Client) punchStarted() {
+	client.mutex.Lock()
+	client.punching = time.Now()
+	client.mutex.Unlock()
+}
+
+// Count the punch in progress once, as a success when the encrypted channel is up
+func (client *Client) punchEnded(success bool) {
+	client.mutex.Lock()
+	started := client.punching
+	client.punching = time.Time{}
+	client.mutex.Unlock()
+
+	if started.IsZero() {
+		return
+	}
+
+	if !success {
+		client.metrics.punches.Inc("failure")
+		client.warn("Could not punch the other peer", "attempts", client.options.PunchAttempts)
+		return
+	}
+
+	client.metrics.punches.Inc("success")
+	client.metrics.punchLatency.Observe(time.Since(started))
+	client.info("Encrypted channel with the other peer is up", "duration", time.Since(started))
+}
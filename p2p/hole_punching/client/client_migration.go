@@ -0,0 +1,163 @@
+package client
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"p2p/crypto"
+	"p2p/shared"
+)
+
+const (
+	// Challenges sent to the same address are at least this far apart
+	challengeInterval = time.Second
+	// Addresses challenged at once, so that other sources cannot keep the real one from being challenged
+	maxChallenges = 8
+)
+
+// Challenge sent to a new address of the other peer, the session moves there once it is answered
+type pathChallenge struct {
+	nonce string
+	sent  time.Time
+}
+
+// Whether a datagram the conn could not decrypt comes from the other peer at a new address.
+// A captured datagram can be replayed from any address, so the path is challenged before it is used.
+func (client *Client) isOtherPeerMoving(conn shared.Conn, bytes []byte) bool {
+	otherPeer := client.GetOtherPeer()
+	otherPeerConn := client.GetOtherPeerConn()
+	if otherPeer == nil || otherPeerConn == nil || conn == otherPeerConn || conn == client.GetRDVServerConn() {
+		return false
+	}
+
+	secret, err := otherPeerConn.GetSecret()
+	if err != nil {
+		return false
+	}
+
+	// QUIC packets are not ours to decrypt, QUIC authenticates them itself
+	if client.quic != nil {
+		return true
+	}
+
+	plaintext, err := crypto.Decrypt(bytes, secret)
+	if err != nil {
+		return false
+	}
+
+	var message shared.Message
+	err = json.Unmarshal(plaintext, &message)
+
+	return err == nil && message.PeerID == otherPeer.ID
+}
+
+// Ask the new address to prove that it holds the secret of our session
+func (client *Client) challengePath(conn shared.Conn) error {
+	otherPeerConn := client.GetOtherPeerConn()
+	if otherPeerConn == nil {
+		return nil
+	}
+
+	secret, err := otherPeerConn.GetSecret()
+	if err != nil {
+		return nil
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	addr := conn.GetAddr().String()
+
+	client.mutex.Lock()
+	for challenged, challenge := range client.challenges {
+		if now.Sub(challenge.sent) > challengeInterval {
+			delete(client.challenges, challenged)
+		}
+	}
+
+	if _, ok := client.challenges[addr]; ok || len(client.challenges) >= maxChallenges {
+		client.mutex.Unlock()
+		return nil
+	}
+
+	challenge := &pathChallenge{
+		nonce: base64.StdEncoding.EncodeToString(nonce),
+		sent:  now,
+	}
+	client.challenges[addr] = challenge
+	client.mutex.Unlock()
+
+	client.info("Received datagrams of the other peer from a new address, challenging the new path", "addr", addr)
+
+	// The conn is not the one of the other peer until it answers, the handlers keep rejecting it
+	conn.SetSecret(secret)
+
+	// Without our ID the challenge stays about as small as the datagrams which trigger it
+	return conn.Send(&shared.Message{
+		Type:    "path-challenge",
+		Content: challenge.nonce,
+		Encrypt: true,
+	})
+}
+
+// The other peer saw our datagrams arrive from a new address, only answer over the current path
+// so that nobody else can have us answer the challenge of a path it wants to take over
+func pathChallengeHandler(client *Client, peerConn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	if err := ensureEncryptedPeer(client, peerConn, message); err != nil {
+		return nil, err
+	}
+
+	nonce, ok := message.Content.(string)
+	if !ok || nonce == "" {
+		return nil, errors.New("path-challenge message must send a nonce in content field")
+	}
+
+	return &shared.Message{
+		Type:    "path-response",
+		PeerID:  client.GetCurrentPeer().ID,
+		Content: nonce,
+		Encrypt: true,
+	}, nil
+}
+
+// The new address answered the challenge with the secret of our session, move the session there
+func pathResponseHandler(client *Client, peerConn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	nonce, ok := message.Content.(string)
+	if !ok || !message.Encrypt {
+		return nil, errors.New("path-response message must send the nonce over the encrypted channel")
+	}
+
+	addr := peerConn.GetAddr().String()
+
+	client.mutex.Lock()
+	challenge, ok := client.challenges[addr]
+	valid := ok && subtle.ConstantTimeCompare([]byte(challenge.nonce), []byte(nonce)) == 1
+	if valid {
+		clear(client.challenges)
+	}
+	client.mutex.Unlock()
+
+	if !valid {
+		return nil, errors.New("rejected path-response which does not answer our challenge")
+	}
+
+	otherPeerConn := client.GetOtherPeerConn()
+	if otherPeerConn == nil || otherPeerConn == peerConn {
+		return nil, nil
+	}
+
+	client.SetOtherPeerConn(peerConn)
+	client.GetTransport().DeleteConn(otherPeerConn.GetAddr().String())
+
+	client.info("Other peer moved", "from", otherPeerConn.GetAddr(), "addr", addr)
+	client.resumedCallback(client)
+
+	return nil, nil
+}
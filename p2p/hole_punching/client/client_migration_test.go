@@ -0,0 +1,167 @@
+package client
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"p2p/crypto"
+	"p2p/shared"
+)
+
+// Datagram of a message encrypted with the secret of the session
+func sealed(t testing.TB, client *Client, message *shared.Message) []byte {
+	t.Helper()
+
+	secret, err := client.GetOtherPeerConn().GetSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bytes, err := crypto.Encrypt(plaintext, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bytes
+}
+
+func newConn(t testing.TB, client *Client, port int) shared.Conn {
+	t.Helper()
+
+	conn, err := client.GetTransport().CreateConn(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn
+}
+
+func challengeNonce(client *Client, conn shared.Conn) string {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if challenge, ok := client.challenges[conn.GetAddr().String()]; ok {
+		return challenge.nonce
+	}
+
+	return ""
+}
+
+func TestOtherPeerMoving(t *testing.T) {
+	client, _ := newResumableClient(t)
+	moved := newConn(t, client, 20001)
+
+	bob := sealed(t, client, &shared.Message{Type: "keepalive", PeerID: "bob"})
+
+	if !client.isOtherPeerMoving(moved, bob) {
+		t.Fatal("expected a datagram of bob from a new address to be noticed")
+	}
+
+	for name, test := range map[string]struct {
+		conn  shared.Conn
+		bytes []byte
+	}{
+		"current path":     {client.GetOtherPeerConn(), bob},
+		"server":           {client.GetRDVServerConn(), bob},
+		"another peer":     {moved, sealed(t, client, &shared.Message{Type: "keepalive", PeerID: "carol"})},
+		"another secret":   {moved, []byte("not encrypted with the secret of the session")},
+		"plaintext of bob": {moved, []byte(`{"type":"keepalive","peerID":"bob"}`)},
+	} {
+		if client.isOtherPeerMoving(test.conn, test.bytes) {
+			t.Errorf("%s: expected the datagram not to move the session", name)
+		}
+	}
+
+	// The new address is challenged, the session stays on its path meanwhile
+	previous := client.GetOtherPeerConn()
+	client.handleUnknownPayload(moved, bob, nil)
+
+	if challengeNonce(client, moved) == "" {
+		t.Fatal("expected the new address to be challenged")
+	}
+	if client.GetOtherPeerConn() != previous {
+		t.Fatal("expected the session to stay on its path until the challenge is answered")
+	}
+}
+
+func TestMigrationNeedsPathResponse(t *testing.T) {
+	client, _ := newResumableClient(t)
+	previous := client.GetOtherPeerConn()
+	callback := createMessageCallback(client)
+
+	resumed := 0
+	client.OnResumed(func(*Client) { resumed += 1 })
+
+	moved := newConn(t, client, 20001)
+	spoofed := newConn(t, client, 20002)
+
+	// A message of bob from a new address only challenges it
+	callback(moved, &shared.Message{Type: "keepalive", PeerID: "bob", Encrypt: true})
+
+	nonce := challengeNonce(client, moved)
+	if nonce == "" || client.GetOtherPeerConn() != previous {
+		t.Fatal("expected the new address to be challenged without moving the session")
+	}
+
+	// Challenges to the same address are not sent again right away
+	client.challengePath(moved)
+	if challengeNonce(client, moved) != nonce {
+		t.Fatal("expected the challenge not to be sent again")
+	}
+
+	for name, test := range map[string]struct {
+		conn    shared.Conn
+		message *shared.Message
+	}{
+		"wrong nonce":    {moved, &shared.Message{Type: "path-response", PeerID: "bob", Content: "guess", Encrypt: true}},
+		"not encrypted":  {moved, &shared.Message{Type: "path-response", PeerID: "bob", Content: nonce}},
+		"spoofed source": {spoofed, &shared.Message{Type: "path-response", PeerID: "bob", Content: nonce, Encrypt: true}},
+	} {
+		if _, err := route(client, test.conn, test.message); err == nil {
+			t.Errorf("%s: expected the path-response to be rejected", name)
+		}
+	}
+
+	if client.GetOtherPeerConn() != previous || resumed != 0 {
+		t.Fatal("expected the session to stay on its path")
+	}
+
+	_, err := route(client, moved, &shared.Message{Type: "path-response", PeerID: "bob", Content: nonce, Encrypt: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if client.GetOtherPeerConn() != moved || resumed != 1 {
+		t.Fatal("expected the session to move to the new address")
+	}
+	if _, ok := client.GetTransport().GetConn(previous.GetAddr().String()); ok {
+		t.Fatal("expected the conn of the old address to be deleted")
+	}
+
+	// The answered challenge cannot be replayed
+	if _, err := route(client, moved, &shared.Message{Type: "path-response", PeerID: "bob", Content: nonce, Encrypt: true}); err == nil {
+		t.Fatal("expected a replayed path-response to be rejected")
+	}
+}
+
+func TestChallengesAreBounded(t *testing.T) {
+	client, _ := newResumableClient(t)
+
+	for port := 20001; port <= 20001+maxChallenges; port++ {
+		client.challengePath(newConn(t, client, port))
+	}
+
+	client.mutex.Lock()
+	challenges := len(client.challenges)
+	client.mutex.Unlock()
+
+	if challenges != maxChallenges {
+		t.Fatalf("expected %d addresses to be challenged at once, got %d", maxChallenges, challenges)
+	}
+}
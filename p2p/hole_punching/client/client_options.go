@@ -0,0 +1,128 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"p2p/hole_punching/transport"
+)
+
+type Options struct {
+	// Address of the rendez-vous server
+	ServerAddr string
+	// Expected base64 public key of the rendez-vous server, any key is accepted when empty
+	ServerKey string
+
+	// Local address to bind, every interface when empty
+	BindAddr string
+	// Range of local ports, a random free port is picked in [PortMin, PortMax].
+	// Set both to the same port to bind a fixed port, or both to 0 to let the system pick.
+	PortMin int
+	PortMax int
+	// Number of ports tried when the picked port is already in use
+	BindAttempts int
+
+	// Number of connect messages sent to punch the NAT of the other peer
+	PunchAttempts int
+	PunchInterval time.Duration
+	// Must stay below the peer timeout of the rendez-vous server
+	KeepaliveInterval time.Duration
+	// Greet the rendez-vous server again when it has not answered for this long,
+	// e.g. after a network change (0 disables it)
+	ReconnectTimeout time.Duration
+	// Requests to the rendez-vous server are sent again when it has not answered for this long,
+	// and given up after RequestAttempts sends
+	RequestTimeout  time.Duration
+	RequestAttempts int
+	// Time an acknowledged request waits for its answer, e.g. an establish request waiting for the consent
+	// of the other peer. Must stay above the request timeout of the rendez-vous server.
+	PendingTimeout time.Duration
+
+	// Let the other peers list and look us up on the rendez-vous server
+	Visible bool
+	// Usernames are unique within a namespace of the rendez-vous server
+	Namespace string
+	// Long-term key the username is bound to on the rendez-vous server, a new key is generated
+	// when nil so the username can only be registered again by the same client
+	IdentityKey ed25519.PrivateKey
+
+	// Structured logger, its handler decides of the level. Records carry our peer ID and the session ID,
+	// and the sensitive attributes are redacted whatever the handler.
+	Logger *slog.Logger
+}
+
+func DefaultOptions() Options {
+	return Options{
+		ServerAddr:        "127.0.0.1:9001",
+		PortMin:           10000,
+		PortMax:           65534,
+		BindAttempts:      10,
+		PunchAttempts:     5,
+		PunchInterval:     3 * time.Second,
+		KeepaliveInterval: 20 * time.Second,
+		ReconnectTimeout:  time.Minute,
+		RequestTimeout:    2 * time.Second,
+		RequestAttempts:   3,
+		PendingTimeout:    90 * time.Second,
+		Logger:            slog.Default(),
+	}
+}
+
+func (options Options) validate() error {
+	if options.ServerAddr == "" {
+		return errors.New("rendez-vous server address must not be empty")
+	}
+
+	if options.PortMin < 0 || options.PortMax > 65535 || options.PortMin > options.PortMax {
+		return fmt.Errorf("invalid local port range %d-%d", options.PortMin, options.PortMax)
+	}
+
+	if options.PunchAttempts < 1 || options.PunchInterval <= 0 || options.KeepaliveInterval <= 0 {
+		return errors.New("punch attempts, punch interval and keepalive interval must be positive")
+	}
+
+	if options.ReconnectTimeout < 0 {
+		return errors.New("reconnect timeout must not be negative")
+	}
+
+	if options.RequestTimeout <= 0 || options.RequestAttempts < 1 || options.PendingTimeout <= 0 {
+		return errors.New("request timeout, request attempts and pending timeout must be positive")
+	}
+
+	return nil
+}
+
+// Bind the UDP socket on a port of the range, trying another port on collision
+func bind(options Options) (*transport.Transport, error) {
+	attempts := options.BindAttempts
+	if attempts < 1 || options.PortMin == options.PortMax {
+		attempts = 1
+	}
+
+	var err error
+	for i := 0; i < attempts; i += 1 {
+		port := options.PortMin
+		if options.PortMax > options.PortMin {
+			port += rand.IntN(options.PortMax - options.PortMin + 1)
+		}
+
+		var t *transport.Transport
+		t, err = transport.NewTransport(net.JoinHostPort(options.BindAddr, strconv.Itoa(port)))
+		if err == nil {
+			return t, nil
+		}
+
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("could not find a free port in %d-%d: %w", options.PortMin, options.PortMax, err)
+}
@@ -0,0 +1,139 @@
+package client
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+
+	"p2p/crypto"
+	"p2p/shared"
+)
+
+// Peers introduced by a pairing code authenticate each other with it, so that
+// the rendez-vous server cannot substitute its own keys to read the session
+type pakeState struct {
+	spake *crypto.SPAKE2
+
+	mutex         *sync.Mutex
+	ecdhSecret    *[32]byte
+	authenticated bool
+}
+
+func (client *Client) setPairingCode(code string) error {
+	spake, err := crypto.NewSPAKE2([]byte(code))
+	if err != nil {
+		return err
+	}
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	client.pake = &pakeState{
+		spake: spake,
+		mutex: &sync.Mutex{},
+	}
+
+	return nil
+}
+
+func (client *Client) getPAKE() *pakeState {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	return client.pake
+}
+
+// True once the other peer proved it knows the pairing code
+func (client *Client) IsAuthenticated() bool {
+	pake := client.getPAKE()
+	if pake == nil {
+		return false
+	}
+
+	pake.mutex.Lock()
+	defer pake.mutex.Unlock()
+
+	return pake.authenticated
+}
+
+// Keep the Diffie-Hellman secret until the pairing code is confirmed and send our SPAKE2 message
+func (client *Client) startPAKE(pake *pakeState, ecdhSecret [32]byte) *shared.Message {
+	pake.mutex.Lock()
+	pake.ecdhSecret = &ecdhSecret
+	pake.mutex.Unlock()
+
+	return &shared.Message{
+		Type:    "pake",
+		PeerID:  client.GetCurrentPeer().ID,
+		Content: base64.StdEncoding.EncodeToString(pake.spake.Message()),
+	}
+}
+
+// Finish the exchange with the other peer's SPAKE2 message, returns our confirmation
+func (pake *pakeState) finish(otherMessage []byte) ([]byte, error) {
+	pake.mutex.Lock()
+	defer pake.mutex.Unlock()
+
+	_, err := pake.spake.Finish(otherMessage)
+	if err != nil {
+		return nil, err
+	}
+
+	return pake.spake.Confirmation(), nil
+}
+
+// Check the other peer's confirmation and set the session secret, which mixes
+// the Diffie-Hellman secret with the key derived from the pairing code.
+// Returns true the first time the other peer is authenticated.
+func (pake *pakeState) confirm(peerConn shared.Conn, confirmation []byte) (bool, error) {
+	pake.mutex.Lock()
+	defer pake.mutex.Unlock()
+
+	err := pake.spake.VerifyConfirmation(confirmation)
+	if errors.Is(err, crypto.ErrSPAKE2NotFinished) {
+		// The other peer's SPAKE2 message was lost or reordered, it is sent again with the next key message
+		return false, err
+	}
+	if err != nil {
+		return false, fmt.Errorf("peer could not prove it knows the pairing code, the connection may be intercepted: %w", err)
+	}
+
+	if pake.ecdhSecret == nil {
+		return false, errors.New("received pake confirmation before the peer key")
+	}
+
+	if pake.authenticated {
+		return false, nil
+	}
+
+	key := pake.spake.Key()
+
+	var secret [32]byte
+	copy(secret[:], crypto.Hash("Mixing peer secret with pairing code key", append(pake.ecdhSecret[:], key[:]...)))
+
+	peerConn.SetSecret(secret)
+	pake.authenticated = true
+
+	return true, nil
+}
+
+// Called every time the secret of the peer conn is known to be shared with the other peer
+func (client *Client) onSecret() error {
+	client.punchEnded(true)
+	client.saveResumption()
+
+	client.mutex.Lock()
+	select {
+	case <-client.encrypted:
+	default:
+		close(client.encrypted)
+	}
+	client.mutex.Unlock()
+
+	if client.quic != nil {
+		return client.sendQUICFingerprint()
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"p2p/shared"
+)
+
+// Ask the rendez-vous server for the visible online peers matching filter, received by the list callback
+func (client *Client) List(filter shared.PeerFilter) error {
+	return client.send(&shared.Message{
+		Type:    "list",
+		PeerID:  client.GetCurrentPeer().ID,
+		Content: filter,
+	})
+}
+
+// Ask the rendez-vous server for a visible online peer, received by the lookup callback
+func (client *Client) Lookup(peerID string) error {
+	return client.send(&shared.Message{
+		Type:    "lookup",
+		PeerID:  client.GetCurrentPeer().ID,
+		Content: &shared.Lookup{ID: peerID},
+	})
+}
+
+// Same as Lookup with the username of the peer, in our namespace
+func (client *Client) LookupUsername(username string) error {
+	return client.send(&shared.Message{
+		Type:   "lookup",
+		PeerID: client.GetCurrentPeer().ID,
+		Content: &shared.Lookup{
+			Username:  username,
+			Namespace: client.options.Namespace,
+		},
+	})
+}
+
+// Get notified by the presence callback when a visible peer matching filter comes online or goes offline
+func (client *Client) Subscribe(filter shared.PeerFilter) error {
+	client.mutex.Lock()
+	client.subscription = &filter
+	client.mutex.Unlock()
+
+	return client.send(&shared.Message{
+		Type:    "subscribe",
+		PeerID:  client.GetCurrentPeer().ID,
+		Content: filter,
+	})
+}
+
+func (client *Client) Unsubscribe() error {
+	client.mutex.Lock()
+	client.subscription = nil
+	client.mutex.Unlock()
+
+	return client.send(&shared.Message{
+		Type:   "unsubscribe",
+		PeerID: client.GetCurrentPeer().ID,
+	})
+}
+
+func (client *Client) OnList(callback func(client *Client, list *shared.PeerList)) {
+	client.listCallback = callback
+}
+
+func (client *Client) OnLookup(callback func(client *Client, peer *shared.Peer)) {
+	client.lookupCallback = callback
+}
+
+func (client *Client) OnPresence(callback func(client *Client, peer *shared.Peer, online bool)) {
+	client.presenceCallback = callback
+}
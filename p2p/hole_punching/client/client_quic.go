@@ -0,0 +1,411 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	"p2p/hole_punching/transport"
+	"p2p/shared"
+)
+
+const (
+	quicALPN = "p2p-hole-punching"
+	// Number of dial attempts made by the QUIC client role
+	quicDialAttempts = 3
+	quicDialTimeout  = 10 * time.Second
+)
+
+// net.PacketConn fed with the datagrams of the punched UDP socket that are not control messages
+type quicPacketConn struct {
+	transport *transport.Transport
+	packets   chan *shared.UDPPayload
+
+	mutex           *sync.Mutex
+	readDeadline    time.Time
+	deadlineChanged chan struct{}
+
+	closed    chan struct{}
+	closeOnce *sync.Once
+}
+
+func newQUICPacketConn(transport *transport.Transport) *quicPacketConn {
+	return &quicPacketConn{
+		transport:       transport,
+		packets:         make(chan *shared.UDPPayload, 100),
+		mutex:           &sync.Mutex{},
+		deadlineChanged: make(chan struct{}),
+		closed:          make(chan struct{}),
+		closeOnce:       &sync.Once{},
+	}
+}
+
+// Queue a datagram received on the UDP socket, dropped if QUIC does not keep up.
+// The bytes are copied since the transport reuses its receive buffers.
+func (conn *quicPacketConn) push(bytes []byte, addr *net.UDPAddr) {
+	payload := make([]byte, len(bytes))
+	copy(payload, bytes)
+
+	select {
+	case conn.packets <- &shared.UDPPayload{Bytes: payload, Addr: addr}:
+	default:
+	}
+}
+
+func (conn *quicPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		conn.mutex.Lock()
+		deadline := conn.readDeadline
+		deadlineChanged := conn.deadlineChanged
+		conn.mutex.Unlock()
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+
+			timer := time.NewTimer(d)
+			timeout = timer.C
+			defer timer.Stop()
+		}
+
+		select {
+		case payload := <-conn.packets:
+			return copy(p, payload.Bytes), payload.Addr, nil
+		case <-conn.closed:
+			return 0, nil, net.ErrClosed
+		case <-timeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-deadlineChanged:
+		}
+	}
+}
+
+func (conn *quicPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, errors.New("could not assert net.Addr to *net.UDPAddr")
+	}
+
+	select {
+	case <-conn.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	conn.transport.SendBytes(p, udpAddr)
+
+	return len(p), nil
+}
+
+func (conn *quicPacketConn) Close() error {
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+	})
+
+	return nil
+}
+
+func (conn *quicPacketConn) LocalAddr() net.Addr {
+	return conn.transport.LocalAddr()
+}
+
+func (conn *quicPacketConn) SetDeadline(t time.Time) error {
+	return conn.SetReadDeadline(t)
+}
+
+func (conn *quicPacketConn) SetReadDeadline(t time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	conn.readDeadline = t
+	close(conn.deadlineChanged)
+	conn.deadlineChanged = make(chan struct{})
+
+	return nil
+}
+
+// Let QUIC size the buffers of the underlying UDP socket
+func (conn *quicPacketConn) SetReadBuffer(bytes int) error {
+	return conn.transport.SetReadBuffer(bytes)
+}
+
+func (conn *quicPacketConn) SetWriteBuffer(bytes int) error {
+	return conn.transport.SetWriteBuffer(bytes)
+}
+
+// Writes go through the transport send channel and never block on the socket
+func (conn *quicPacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type quicState struct {
+	packetConn  *quicPacketConn
+	transport   *quic.Transport
+	certificate tls.Certificate
+	fingerprint []byte
+
+	mutex           *sync.Mutex
+	peerFingerprint []byte
+	started         bool
+	conn            *quic.Conn
+	listener        *quic.Listener
+}
+
+// Carry a QUIC connection over the punched UDP socket once the peer channel is encrypted.
+// The peer with the lowest ID takes the client role, the other one the server role.
+// Must be called before Start.
+func (client *Client) EnableQUIC() error {
+	certificate, fingerprint, err := genCertificate()
+	if err != nil {
+		return err
+	}
+
+	packetConn := newQUICPacketConn(client.transport)
+
+	client.quic = &quicState{
+		packetConn:  packetConn,
+		transport:   &quic.Transport{Conn: packetConn},
+		certificate: certificate,
+		fingerprint: fingerprint,
+		mutex:       &sync.Mutex{},
+	}
+
+	return nil
+}
+
+func (client *Client) OnQUIC(callback func(client *Client, conn *quic.Conn)) {
+	client.quicCallback = callback
+}
+
+// Established QUIC connection with the other peer, nil if there is none yet
+func (client *Client) GetQUICConn() *quic.Conn {
+	if client.quic == nil {
+		return nil
+	}
+
+	client.quic.mutex.Lock()
+	defer client.quic.mutex.Unlock()
+
+	return client.quic.conn
+}
+
+func (client *Client) isQUICClient() bool {
+	return client.GetCurrentPeer().ID < client.GetOtherPeer().ID
+}
+
+// Datagrams from the other peer that are not control messages belong to QUIC
+func (client *Client) handleUnknownPayload(conn shared.Conn, bytes []byte, err error) {
+	otherPeerConn := client.GetOtherPeerConn()
+	if client.quic != nil && otherPeerConn != nil && conn.GetAddr().String() == otherPeerConn.GetAddr().String() {
+		client.quic.packetConn.push(bytes, conn.GetAddr().(*net.UDPAddr))
+		return
+	}
+
+	if client.isOtherPeerMoving(conn, bytes) {
+		if err := client.challengePath(conn); err != nil {
+			client.error("Could not challenge the new path", "addr", conn.GetAddr(), "err", err)
+		}
+		return
+	}
+
+	client.debug("Dropped datagram", "addr", conn.GetAddr(), "err", err)
+}
+
+// Announce our certificate fingerprint over the encrypted peer channel
+func (client *Client) sendQUICFingerprint() error {
+	otherPeerConn := client.GetOtherPeerConn()
+	if otherPeerConn == nil {
+		return errors.New("no peer connected")
+	}
+
+	return otherPeerConn.Send(&shared.Message{
+		Type:    "quic",
+		PeerID:  client.GetCurrentPeer().ID,
+		Content: base64.StdEncoding.EncodeToString(client.quic.fingerprint),
+		Encrypt: true,
+	})
+}
+
+// Start the QUIC role of this peer once the other peer's fingerprint is known
+func (client *Client) startQUIC(peerFingerprint []byte) {
+	state := client.quic
+
+	state.mutex.Lock()
+	state.peerFingerprint = peerFingerprint
+	if state.started {
+		state.mutex.Unlock()
+		return
+	}
+	state.started = true
+	state.mutex.Unlock()
+
+	if client.isQUICClient() {
+		client.spawn(client.dialQUIC)
+	} else {
+		client.spawn(client.listenQUIC)
+	}
+}
+
+func (client *Client) dialQUIC() {
+	state := client.quic
+	addr := client.GetOtherPeerConn().GetAddr()
+
+	for i := 0; i < quicDialAttempts; i += 1 {
+		select {
+		case <-client.exit:
+			return
+		default:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), quicDialTimeout)
+		conn, err := state.transport.Dial(ctx, addr, client.quicTLSConfig(), quicConfig())
+		cancel()
+
+		if err != nil {
+			client.warn("Could not dial QUIC", "addr", addr, "err", err)
+			continue
+		}
+
+		client.setQUICConn(conn)
+		return
+	}
+}
+
+func (client *Client) listenQUIC() {
+	state := client.quic
+
+	listener, err := state.transport.Listen(client.quicTLSConfig(), quicConfig())
+	if err != nil {
+		client.error("Could not listen for QUIC", "err", err)
+		return
+	}
+
+	state.mutex.Lock()
+	state.listener = listener
+	state.mutex.Unlock()
+
+	for {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			return
+		}
+
+		if conn.RemoteAddr().String() != client.GetOtherPeerConn().GetAddr().String() {
+			conn.CloseWithError(0, "unknown peer")
+			continue
+		}
+
+		client.setQUICConn(conn)
+	}
+}
+
+func (client *Client) setQUICConn(conn *quic.Conn) {
+	client.quic.mutex.Lock()
+	if client.quic.conn != nil {
+		client.quic.conn.CloseWithError(0, "replaced")
+	}
+	client.quic.conn = conn
+	client.quic.mutex.Unlock()
+
+	client.quicCallback(client, conn)
+}
+
+func (client *Client) stopQUIC() {
+	if client.quic == nil {
+		return
+	}
+
+	client.quic.mutex.Lock()
+	if client.quic.conn != nil {
+		client.quic.conn.CloseWithError(0, "client stopped")
+	}
+	if client.quic.listener != nil {
+		client.quic.listener.Close()
+	}
+	client.quic.mutex.Unlock()
+
+	client.quic.transport.Close()
+	client.quic.packetConn.Close()
+}
+
+// Both sides present a self-signed certificate whose fingerprint was exchanged over the encrypted peer channel
+func (client *Client) quicTLSConfig() *tls.Config {
+	state := client.quic
+
+	return &tls.Config{
+		Certificates:       []tls.Certificate{state.certificate},
+		ClientAuth:         tls.RequireAnyClientCert,
+		InsecureSkipVerify: true,
+		NextProtos:         []string{quicALPN},
+		MinVersion:         tls.VersionTLS13,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("peer did not present a certificate")
+			}
+
+			state.mutex.Lock()
+			peerFingerprint := state.peerFingerprint
+			state.mutex.Unlock()
+
+			fingerprint := sha256.Sum256(rawCerts[0])
+			if !bytes.Equal(fingerprint[:], peerFingerprint) {
+				return errors.New("peer certificate does not match the announced fingerprint")
+			}
+
+			return nil
+		},
+	}
+}
+
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		KeepAlivePeriod: 10 * time.Second,
+	}
+}
+
+// Self-signed ed25519 certificate and the SHA-256 fingerprint of its DER encoding
+func genCertificate() (tls.Certificate, []byte, error) {
+	pub, pri, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, pub, pri)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	fingerprint := sha256.Sum256(der)
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  pri,
+	}, fingerprint[:], nil
+}
@@ -0,0 +1,102 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestQUICDatagramsDemuxed(t *testing.T) {
+	options := testOptions()
+	options.ServerAddr = "127.0.0.1:9"
+
+	client := newTestClient(t, "alice", options)
+	if err := client.EnableQUIC(); err != nil {
+		t.Fatal(err)
+	}
+
+	var sockets []*net.UDPConn
+	for range 2 {
+		socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { socket.Close() })
+
+		sockets = append(sockets, socket)
+	}
+	peer, stranger := sockets[0], sockets[1]
+
+	conn, err := client.GetTransport().CreateConn(peer.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetOtherPeerConn(conn)
+
+	if err := client.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	clientAddr := client.GetTransport().LocalAddr().(*net.UDPAddr)
+	quicPacket := []byte{0xc0, 0, 0, 0, 1, 'q', 'u', 'i', 'c'}
+
+	// Control messages are routed, only the other datagrams of the other peer reach QUIC
+	peer.WriteToUDP([]byte(`{"type":"unknown"}`), clientAddr)
+	stranger.WriteToUDP([]byte{0xc0, 's', 't', 'r', 'a', 'n', 'g', 'e', 'r'}, clientAddr)
+	peer.WriteToUDP(quicPacket, clientAddr)
+
+	packetConn := client.quic.packetConn
+	buffer := make([]byte, 2048)
+
+	packetConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, addr, err := packetConn.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buffer[:n], quicPacket) || addr.String() != peer.LocalAddr().String() {
+		t.Fatalf("expected the QUIC packet of the peer, got %q from %s", buffer[:n], addr)
+	}
+
+	packetConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _, err := packetConn.ReadFrom(buffer); err != os.ErrDeadlineExceeded {
+		t.Fatalf("expected no other datagram, got %q, %v", buffer[:n], err)
+	}
+}
+
+func TestQUICRejectsWrongCertificate(t *testing.T) {
+	client := newTestClient(t, "alice", testOptions())
+	if err := client.EnableQUIC(); err != nil {
+		t.Fatal(err)
+	}
+
+	announced, fingerprint, err := genCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := genCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fingerprint announced by the other peer, without starting QUIC
+	client.quic.mutex.Lock()
+	client.quic.peerFingerprint = fingerprint
+	client.quic.mutex.Unlock()
+
+	verify := client.quicTLSConfig().VerifyPeerCertificate
+
+	if err := verify(announced.Certificate, nil); err != nil {
+		t.Fatalf("expected the announced certificate to be accepted, got %v", err)
+	}
+
+	if err := verify(other.Certificate, nil); err == nil {
+		t.Fatal("expected another certificate to be rejected")
+	}
+
+	if err := verify(nil, nil); err == nil {
+		t.Fatal("expected a missing certificate to be rejected")
+	}
+}
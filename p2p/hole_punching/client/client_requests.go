@@ -0,0 +1,238 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"p2p/shared"
+)
+
+// Returned when the rendez-vous server did not answer a request after every retransmission
+var ErrRequestTimeout = errors.New("rendez-vous server did not answer the request")
+
+// Returned to the callers still waiting when the client stops
+var ErrClientStopped = errors.New("client stopped")
+
+// Answers telling that the request was received, its final answer comes once the other peer decided
+var acknowledgements = map[string]bool{
+	"establish-pending": true,
+}
+
+// Request to the rendez-vous server waiting for its answer, by request ID
+type pendingRequest struct {
+	message  *shared.Message
+	attempts int
+	// When the request is sent again, or given up
+	deadline time.Time
+	// Whether the server received the request, it is then no longer sent again
+	acknowledged bool
+	// Receives the answer, buffered so that nobody has to wait for it
+	answer chan requestAnswer
+}
+
+type requestAnswer struct {
+	message *shared.Message
+	err     error
+}
+
+// Send a request to the rendez-vous server, sent again until it answers or the attempts run out.
+// The answer goes to the handlers as any other message.
+func (client *Client) send(message *shared.Message) error {
+	_, err := client.track(message)
+	return err
+}
+
+func (client *Client) track(message *shared.Message) (*pendingRequest, error) {
+	// Only the greeting is sent before the channel with the server is encrypted
+	message.Encrypt = message.Type != "greeting"
+
+	pending := &pendingRequest{
+		message:  message,
+		attempts: 1,
+		deadline: time.Now().Add(client.options.RequestTimeout),
+		answer:   make(chan requestAnswer, 1),
+	}
+
+	client.requestsMutex.Lock()
+	client.lastRequestID += 1
+	message.RequestID = client.lastRequestID
+	client.requests[message.RequestID] = pending
+	client.requestsMutex.Unlock()
+
+	err := client.GetRDVServerConn().Send(message)
+	if err != nil {
+		client.forget(message.RequestID)
+		return nil, err
+	}
+
+	return pending, nil
+}
+
+// Send a request to the rendez-vous server and wait for its answer, the answered errors are returned as *shared.Error
+func (client *Client) request(ctx context.Context, message *shared.Message) (*shared.Message, error) {
+	pending, err := client.track(message)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case answer := <-pending.answer:
+		return answer.message, answer.err
+	case <-ctx.Done():
+		client.forget(message.RequestID)
+		return nil, ctx.Err()
+	case <-client.exit:
+		return nil, ErrClientStopped
+	}
+}
+
+func (client *Client) forget(requestID uint64) {
+	client.requestsMutex.Lock()
+	delete(client.requests, requestID)
+	client.requestsMutex.Unlock()
+}
+
+// Request answered by the message, false when it was already answered, e.g. the answer of a retransmitted copy.
+// The request is nil while waiting for the final answer after an acknowledgement.
+func (client *Client) answered(message *shared.Message) (*pendingRequest, bool) {
+	client.requestsMutex.Lock()
+	defer client.requestsMutex.Unlock()
+
+	pending, ok := client.requests[message.RequestID]
+	if !ok {
+		return nil, false
+	}
+
+	if acknowledgements[message.Type] && message.Error == "" {
+		if !pending.acknowledged {
+			pending.acknowledged = true
+			pending.deadline = time.Now().Add(client.options.PendingTimeout)
+		}
+
+		return nil, true
+	}
+
+	delete(client.requests, message.RequestID)
+
+	return pending, true
+}
+
+func (pending *pendingRequest) resolve(message *shared.Message, err error) {
+	select {
+	case pending.answer <- requestAnswer{message: message, err: err}:
+	default:
+	}
+}
+
+// Stop sending the requests of a handshake with the rendez-vous server, a new one started
+func (client *Client) forgetHandshake() {
+	client.requestsMutex.Lock()
+	defer client.requestsMutex.Unlock()
+
+	for id, pending := range client.requests {
+		if pending.message.Type == "greeting" || pending.message.Type == "register" {
+			delete(client.requests, id)
+		}
+	}
+}
+
+// Send the requests again until the rendez-vous server answers them, and give up once the attempts run out
+func (client *Client) retransmit() {
+	ticker := time.NewTicker(client.options.RequestTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-client.exit:
+			return
+		case now := <-ticker.C:
+			var resend, expired []*pendingRequest
+
+			client.requestsMutex.Lock()
+			for id, pending := range client.requests {
+				if now.Before(pending.deadline) {
+					continue
+				}
+
+				if pending.acknowledged || pending.attempts >= client.options.RequestAttempts {
+					delete(client.requests, id)
+					expired = append(expired, pending)
+					continue
+				}
+
+				pending.attempts += 1
+				pending.deadline = now.Add(client.options.RequestTimeout)
+				resend = append(resend, pending)
+			}
+			client.requestsMutex.Unlock()
+
+			for _, pending := range resend {
+				client.debug("Sending request again", "type", pending.message.Type, "requestID", pending.message.RequestID, "attempt", pending.attempts)
+				client.GetRDVServerConn().Send(pending.message)
+			}
+
+			for _, pending := range expired {
+				client.requestExpired(pending)
+			}
+		}
+	}
+}
+
+func (client *Client) requestExpired(pending *pendingRequest) {
+	client.warn("Rendez-vous server did not answer the request", "type", pending.message.Type, "requestID", pending.message.RequestID)
+
+	pending.resolve(nil, ErrRequestTimeout)
+
+	switch pending.message.Type {
+	case "greeting", "register":
+		client.handshakeDone(ErrRequestTimeout)
+	case "establish":
+		client.establishFailedCallback(client, ErrRequestTimeout)
+	}
+}
+
+// Tell the callers of Register that the handshake with the rendez-vous server completed or failed
+func (client *Client) handshakeDone(err error) {
+	client.mutex.Lock()
+	waiters := client.registering
+	client.registering = nil
+	client.mutex.Unlock()
+
+	for _, waiter := range waiters {
+		waiter <- err
+	}
+}
+
+// Wait until the rendez-vous server registered us, once the client started
+func (client *Client) Register(ctx context.Context) error {
+	registered := make(chan error, 1)
+
+	client.mutex.Lock()
+	if client.registered {
+		client.mutex.Unlock()
+		return nil
+	}
+	client.registering = append(client.registering, registered)
+	client.mutex.Unlock()
+
+	var err error
+	select {
+	case err = <-registered:
+		return err
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-client.exit:
+		err = ErrClientStopped
+	}
+
+	// Callers giving up do not pile up until the next handshake
+	client.mutex.Lock()
+	client.registering = slices.DeleteFunc(client.registering, func(waiter chan error) bool {
+		return waiter == registered
+	})
+	client.mutex.Unlock()
+
+	return err
+}
@@ -0,0 +1,268 @@
+package client
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+
+	"p2p/crypto"
+	"p2p/shared"
+)
+
+// Nonces of the resume requests remembered to reject their replays
+const maxResumeNonces = 64
+
+// Encrypted session with the other peer, kept to resume it from a new endpoint without a new key exchange
+type resumption struct {
+	peerID string
+	secret [32]byte
+	// Nonces of the resume requests of the other peer already handled, oldest first
+	nonces []string
+	// Whether we are punching a new path and waiting for the other peer to answer
+	pending bool
+}
+
+// Token of a resume request, only the peers holding the secret of the session can compute it
+func resumeToken(secret [32]byte, peerID string, nonce string) string {
+	return base64.StdEncoding.EncodeToString(crypto.MAC(secret, "Resuming peer session", []byte(peerID+"/"+nonce)))
+}
+
+// Remember the session with the other peer once its secret is shared
+func (client *Client) saveResumption() {
+	otherPeer := client.GetOtherPeer()
+	otherPeerConn := client.GetOtherPeerConn()
+	if otherPeer == nil || otherPeerConn == nil {
+		return
+	}
+
+	secret, err := otherPeerConn.GetSecret()
+	if err != nil {
+		return
+	}
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	client.resumption = &resumption{
+		peerID: otherPeer.ID,
+		secret: secret,
+	}
+}
+
+func (client *Client) getResumption() *resumption {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	return client.resumption
+}
+
+func (client *Client) serverSeen() {
+	client.mutex.Lock()
+	client.lastServerMessage = time.Now()
+	client.mutex.Unlock()
+}
+
+// Whether the rendez-vous server has not answered for longer than the reconnect timeout
+func (client *Client) isServerSilent(now time.Time) bool {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	timeout := client.options.ReconnectTimeout
+	return timeout > 0 && client.registered && now.Sub(client.lastServerMessage) > timeout
+}
+
+// Greet the rendez-vous server again, e.g. when the app notices a network change.
+// If our endpoint changed, the session with the other peer is resumed once registered again.
+func (client *Client) Reconnect() error {
+	return client.greet("")
+}
+
+// Ask the other peer, through the rendez-vous server, to punch our new endpoint
+func (client *Client) resume() error {
+	session := client.getResumption()
+	otherPeerConn := client.GetOtherPeerConn()
+	if session == nil || otherPeerConn == nil {
+		return nil
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(nonce)
+
+	// Punch from our new endpoint meanwhile, the other peer has not moved unless it asks us to resume too
+	client.spawn(func() { client.punchResumed(otherPeerConn) })
+
+	return client.GetRDVServerConn().Send(&shared.Message{
+		Type:   "resume",
+		PeerID: client.GetCurrentPeer().ID,
+		Content: &shared.Resume{
+			PeerID: session.peerID,
+			Nonce:  encoded,
+			Token:  resumeToken(session.secret, client.GetCurrentPeer().ID, encoded),
+		},
+		Encrypt: true,
+	})
+}
+
+// Send resume-connect messages over the encrypted channel until the other peer answers
+func (client *Client) punchResumed(otherPeerConn shared.Conn) {
+	client.mutex.Lock()
+	if client.resumption != nil {
+		client.resumption.pending = true
+	}
+	client.mutex.Unlock()
+
+	for i := 0; i < client.options.PunchAttempts; i += 1 {
+		session := client.getResumption()
+		if session == nil || !session.pending || client.GetOtherPeerConn() != otherPeerConn {
+			return
+		}
+
+		otherPeerConn.Send(&shared.Message{
+			Type:    "resume-connect",
+			PeerID:  client.GetCurrentPeer().ID,
+			Encrypt: true,
+		})
+
+		if !client.pause(client.options.PunchInterval) {
+			return
+		}
+	}
+}
+
+// Whether the token of a resume request of the other peer is valid and was never used, the nonce is remembered
+func (client *Client) validResumeToken(session *resumption, resume *shared.Resume) bool {
+	expected := resumeToken(session.secret, session.peerID, resume.Nonce)
+	if resume.Nonce == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(resume.Token)) != 1 {
+		return false
+	}
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if slices.Contains(session.nonces, resume.Nonce) {
+		return false
+	}
+
+	if len(session.nonces) >= maxResumeNonces {
+		session.nonces = session.nonces[1:]
+	}
+	session.nonces = append(session.nonces, resume.Nonce)
+
+	return true
+}
+
+// The other peer moved and asks us to punch its new endpoint, it proves it holds the secret of our session.
+// The request may come from the server and the endpoint is the one the server saw, so the session only moves
+// there once the endpoint answers a challenge.
+func resumeHandler(client *Client, serverConn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	if err := ensureRDVServer(client, serverConn, message); err != nil {
+		return nil, err
+	}
+
+	var resume shared.Resume
+	err := mapstructure.Decode(message.Content, &resume)
+	if err != nil {
+		return nil, err
+	}
+
+	session := client.getResumption()
+	if session == nil || session.peerID != resume.PeerID || resume.Peer == nil || resume.Peer.ID != resume.PeerID {
+		return nil, fmt.Errorf("no session to resume with peer %s", resume.PeerID)
+	}
+
+	if !client.validResumeToken(session, &resume) {
+		return nil, errors.New("rejected resume request with an invalid or replayed token")
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", resume.Peer.Endpoint.String())
+	if err != nil {
+		return nil, err
+	}
+
+	// The session already moved there, when the datagrams of the other peer answered our challenge first
+	previous := client.GetOtherPeerConn()
+	if previous != nil && previous.GetAddr().String() == addr.String() {
+		return nil, nil
+	}
+
+	// Datagrams of the other peer may already have created the conn
+	otherPeerConn, ok := client.GetTransport().GetConn(addr.String())
+	if !ok {
+		otherPeerConn, err = client.GetTransport().CreateConn(addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	client.spawn(func() { client.challengeResumed(otherPeerConn) })
+
+	return nil, nil
+}
+
+// Challenge the new endpoint of the other peer until it answers, which moves the session there.
+// The challenges also open our NAT to the endpoint.
+func (client *Client) challengeResumed(conn shared.Conn) {
+	for i := 0; i < client.options.PunchAttempts; i += 1 {
+		if client.GetOtherPeerConn() == conn {
+			return
+		}
+
+		if err := client.challengePath(conn); err != nil {
+			client.error("Could not challenge the new path", "addr", conn.GetAddr(), "err", err)
+			return
+		}
+
+		if !client.pause(client.options.PunchInterval) {
+			return
+		}
+	}
+}
+
+// The new path works, answer once so that the other peer stops punching too
+func resumeConnectHandler(client *Client, peerConn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	if err := ensureEncryptedPeer(client, peerConn, message); err != nil {
+		return nil, err
+	}
+
+	client.mutex.Lock()
+	pending := client.resumption != nil && client.resumption.pending
+	if pending {
+		client.resumption.pending = false
+	}
+	client.mutex.Unlock()
+
+	if pending {
+		client.info("Resumed session", "addr", peerConn.GetAddr())
+		client.resumedCallback(client)
+	}
+
+	if message.Type == "resume-connected" {
+		return nil, nil
+	}
+
+	return &shared.Message{
+		Type:    "resume-connected",
+		PeerID:  client.GetCurrentPeer().ID,
+		Encrypt: true,
+	}, nil
+}
+
+// Called once the session with the other peer is resumed over a new path
+func (client *Client) OnResumed(callback func(client *Client)) {
+	client.resumedCallback = callback
+}
+
+// Called when the other peer says bye, its session can no longer be resumed
+func (client *Client) OnDisconnected(callback func(client *Client)) {
+	client.disconnectedCallback = callback
+}
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"p2p/shared"
+)
+
+// Client connected to bob through the conn of 127.0.0.1:20000, with a session it can resume
+func newResumableClient(t testing.TB) (*Client, *resumption) {
+	t.Helper()
+
+	client := newTestClient(t, "alice", testOptions())
+	transport := client.GetTransport()
+
+	serverConn, err := transport.CreateConn(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetRDVServerConn(serverConn)
+
+	otherPeerConn, err := transport.CreateConn(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 20000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var secret [32]byte
+	copy(secret[:], "the secret of alice and bob.....")
+	otherPeerConn.SetSecret(secret)
+
+	client.SetOtherPeer(&shared.Peer{ID: "bob"})
+	client.SetOtherPeerConn(otherPeerConn)
+	client.saveResumption()
+
+	return client, client.getResumption()
+}
+
+func resumeRequest(session *resumption, peerID string, nonce string) *shared.Resume {
+	return &shared.Resume{
+		PeerID: "bob",
+		Nonce:  nonce,
+		Token:  resumeToken(session.secret, peerID, nonce),
+		Peer:   &shared.Peer{ID: "bob", Endpoint: shared.Endpoint{IP: "127.0.0.1", Port: 20001}},
+	}
+}
+
+func TestResumeToken(t *testing.T) {
+	client, session := newResumableClient(t)
+
+	if !client.validResumeToken(session, resumeRequest(session, "bob", "first")) {
+		t.Fatal("expected the token of bob to be valid")
+	}
+
+	if client.validResumeToken(session, resumeRequest(session, "bob", "first")) {
+		t.Fatal("expected a replayed token to be rejected")
+	}
+
+	// Our own requests cannot be reflected back to us
+	if client.validResumeToken(session, resumeRequest(session, "alice", "second")) {
+		t.Fatal("expected a token of another peer to be rejected")
+	}
+
+	forged := resumeRequest(session, "bob", "third")
+	forged.Nonce = "fourth"
+	if client.validResumeToken(session, forged) {
+		t.Fatal("expected a token of another nonce to be rejected")
+	}
+
+	// Only the latest nonces are remembered
+	for i := range maxResumeNonces + 1 {
+		client.validResumeToken(session, resumeRequest(session, "bob", string(rune('a'+i))))
+	}
+	if len(session.nonces) != maxResumeNonces {
+		t.Fatalf("expected %d nonces, got %d", maxResumeNonces, len(session.nonces))
+	}
+}
+
+func TestResumeChallengesTheNewEndpoint(t *testing.T) {
+	client, session := newResumableClient(t)
+	previous := client.GetOtherPeerConn()
+
+	message := &shared.Message{Type: "resume", Content: resumeRequest(session, "bob", "nonce"), Encrypt: true}
+
+	if _, err := route(client, client.GetRDVServerConn(), message); err != nil {
+		t.Fatal(err)
+	}
+
+	// The session stays on its path until the new endpoint answers
+	if client.GetOtherPeerConn() != previous {
+		t.Fatal("expected the session to stay on its path")
+	}
+
+	conn, ok := client.GetTransport().GetConn("127.0.0.1:20001")
+	if !ok {
+		t.Fatal("expected a conn for the new endpoint")
+	}
+
+	// Answer the challenge sent to the new endpoint, as bob would
+	var nonce string
+	for deadline := time.Now().Add(2 * time.Second); nonce == ""; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the challenge")
+		}
+
+		client.mutex.Lock()
+		if challenge, ok := client.challenges["127.0.0.1:20001"]; ok {
+			nonce = challenge.nonce
+		}
+		client.mutex.Unlock()
+	}
+
+	_, err := route(client, conn, &shared.Message{Type: "path-response", PeerID: "bob", Content: nonce, Encrypt: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if client.GetOtherPeerConn() != conn {
+		t.Fatal("expected the session to move to the new endpoint")
+	}
+
+	// The same request cannot move the session again
+	if _, err := route(client, client.GetRDVServerConn(), message); err == nil {
+		t.Fatal("expected a replayed resume request to be rejected")
+	}
+}
@@ -0,0 +1,135 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"p2p/shared"
+)
+
+func testOptions() Options {
+	options := DefaultOptions()
+	options.BindAddr = "127.0.0.1"
+	options.Logger = slog.New(slog.DiscardHandler)
+
+	return options
+}
+
+// Client which is never started, its handlers are called directly
+func newTestClient(t testing.TB, username string, options Options) *Client {
+	t.Helper()
+
+	client, err := NewClient(username, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Stop)
+
+	return client
+}
+
+func TestNewClientBindsItsOwnSocket(t *testing.T) {
+	options := testOptions()
+	options.PortMin, options.PortMax = 40000, 40100
+
+	client := newTestClient(t, "alice", options)
+
+	port := client.GetTransport().LocalAddr().(*net.UDPAddr).Port
+	if port < options.PortMin || port > options.PortMax {
+		t.Fatalf("expected a port in %d-%d, got %d", options.PortMin, options.PortMax, port)
+	}
+
+	peer := client.GetCurrentPeer()
+	if peer.Username != "alice" || peer.ID == "" {
+		t.Fatalf("unexpected current peer %+v", peer)
+	}
+
+	other := newTestClient(t, "alice", options)
+	if other.GetCurrentPeer().ID == peer.ID {
+		t.Fatal("expected every client to get its own key pair and ID")
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for name, change := range map[string]func(*Options){
+		"server address": func(options *Options) { options.ServerAddr = "" },
+		"port range":     func(options *Options) { options.PortMin, options.PortMax = 2000, 1000 },
+		"punch attempts": func(options *Options) { options.PunchAttempts = 0 },
+		"request":        func(options *Options) { options.RequestTimeout = 0 },
+	} {
+		options := testOptions()
+		change(&options)
+
+		if _, err := NewClient("alice", options); err == nil {
+			t.Errorf("expected an invalid %s to be rejected", name)
+		}
+	}
+}
+
+func TestRouteIgnoresUnknownTypes(t *testing.T) {
+	client := newTestClient(t, "alice", testOptions())
+
+	conn, err := client.GetTransport().CreateConn(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := route(client, conn, &shared.Message{Type: "unknown"})
+	if res != nil || err != nil {
+		t.Fatalf("expected the message to be ignored, got %v, %v", res, err)
+	}
+}
+
+func TestEstablishOnlyFromTheServer(t *testing.T) {
+	client := newTestClient(t, "alice", testOptions())
+	transport := client.GetTransport()
+
+	serverConn, err := transport.CreateConn(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetRDVServerConn(serverConn)
+
+	otherConn, err := transport.CreateConn(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := &shared.Message{
+		Type:    "establish",
+		Content: &shared.Peer{ID: "mallory", Endpoint: shared.Endpoint{IP: "127.0.0.1", Port: 11}},
+		Encrypt: true,
+	}
+
+	if _, err := route(client, otherConn, message); err == nil {
+		t.Fatal("expected an establish message from another source to be rejected")
+	}
+
+	if client.GetOtherPeer() != nil {
+		t.Fatal("expected the other peer to be left alone")
+	}
+}
+
+func TestRegisterForgetsCancelledCallers(t *testing.T) {
+	client := newTestClient(t, "alice", testOptions())
+
+	for range 3 {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		if err := client.Register(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected the deadline to be exceeded, got %v", err)
+		}
+		cancel()
+	}
+
+	client.mutex.Lock()
+	waiters := len(client.registering)
+	client.mutex.Unlock()
+
+	if waiters != 0 {
+		t.Fatalf("expected no callers left waiting, got %d", waiters)
+	}
+}
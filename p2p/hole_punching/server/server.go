@@ -1,140 +1,385 @@
 package server
 
 import (
-	"errors"
-	"log"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"log/slog"
 	"net"
+	"runtime"
 	"sync"
 	"time"
 
 	"p2p/crypto"
+	"p2p/hole_punching/transport"
+	"p2p/logging"
+	"p2p/metrics"
 	"p2p/shared"
 )
 
+// Datagrams read or written per syscall
+const batchSize = 32
+
+// Rendez-vous server, registers the peers and introduces them to each other
 type Server struct {
-	conn            *net.UDPConn
-	publicKey       [32]byte
-	privateKey      [32]byte
-	conns           shared.Conns
-	sendChan        chan *shared.UDPPayload
-	messageCallback func(shared.Conns, shared.Conn, *shared.Message)
-	exit            chan bool
-	wg              *sync.WaitGroup
+	transport  *transport.Transport
+	publicKey  [32]byte
+	privateKey [32]byte
+	peers      shared.Peers
+	codes      map[string]*pairingCode
+	// Establish requests waiting for consent, by requester and target IDs
+	requests map[string]*establishRequest
+	// Answers of the recent requests, by source address and request ID
+	replies map[string]map[uint64]*cachedReply
+	groups  map[string]map[string]bool
+	// Verifiers of the group secrets, by group name
+	groupVerifiers map[string]string
+	// Presence filters by subscribed peer ID
+	subscriptions map[string]*shared.PeerFilter
+	// Usernames bound to identity keys, by namespace and username
+	reservations map[string]*reservation
+	mutex        *sync.Mutex
+	options      Options
+	optionsMutex *sync.RWMutex
+	// Records carry the listen address of the server, the sensitive attributes are redacted
+	logger  *slog.Logger
+	limiter *rateLimiter
+	// Rate limiter of the requests which reach another peer
+	introductions *rateLimiter
+	// Random key of the greeting cookies
+	cookieKey [32]byte
+	// Greeted conns waiting for their registration, by address
+	handshakes map[string]time.Time
+	stats      *stats
+	// Peers of every server of the cluster, by default only the peers of this server
+	directory Directory
+	// Cluster address of this server and of the other servers
+	owner   string
+	members map[string]bool
+	// When the registered peers were last published in the directory, by ID
+	published map[string]time.Time
+	// Changes of the directory not applied yet, in order
+	updates []directoryUpdate
+	// Applies the updates one batch after the other, taken before the mutex
+	directoryMutex *sync.Mutex
+	// Peers of the other servers named by the recent requests, by ID
+	remotes map[string]*remotePeer
+	// Requests waiting for the lookup of their target, bounded by the capacity of the slots
+	lookups     *sync.WaitGroup
+	lookupSlots chan struct{}
+	// Store the registrations are saved to, nil if they are only kept in memory
+	registry *Registry
+	bucket   []byte
+	// Peers and reservations changed since the last flush of the registry
+	dirtyPeers        map[string]bool
+	dirtyReservations map[string]bool
+	// Endpoints the registered peers registered from, by ID
+	endpoints map[string]*endpointHistory
+	// Expiry of the banned IPs and identity key fingerprints, zero when the ban never expires
+	bans      map[string]time.Time
+	bansMutex *sync.RWMutex
+	// Exported to a private registry unless SetMetrics is called
+	metrics *serverMetrics
+	// Closed when the server stops, every goroutine of the server returns then
+	exit     chan struct{}
+	stopOnce *sync.Once
+	wg       *sync.WaitGroup
+	// Guards the closing of exit, so that Listen never adds to wg once Stop waits for it
+	lifecycle *sync.Mutex
 }
 
-func (server *Server) sender() {
-	server.wg.Add(1)
+// Remove the peers which have not been seen for longer than the peer timeout, from their groups too,
+// the conns greeted but never registered, the expired pairing codes and establish requests, and the usernames not used for longer than the reservation timeout
+func (server *Server) janitor() {
 	defer server.wg.Done()
 
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case <-server.exit:
-			log.Print("Exiting UDP sender")
 			return
-		case payload := <-server.sendChan:
-			_, err := server.conn.WriteToUDP(payload.Bytes, payload.Addr)
-			if err != nil {
-				log.Print(err)
+		case now := <-ticker.C:
+			options := server.GetOptions()
+
+			server.limiter.prune(now)
+			server.introductions.prune(now)
+			server.pruneBans(now)
+
+			server.mutex.Lock()
+			for code, pairing := range server.codes {
+				if now.After(pairing.expires) {
+					delete(server.codes, code)
+				}
+			}
+
+			if options.PeerTimeout > 0 {
+				for id, peer := range server.peers {
+					if now.Sub(peer.LastSeen) > options.PeerTimeout {
+						server.removePeer(peer)
+						server.info("Peer timed out", "peer", id)
+					}
+				}
 			}
+
+			for addr, greeted := range server.handshakes {
+				if now.Sub(greeted) > handshakeTimeout {
+					delete(server.handshakes, addr)
+					server.transport.DeleteConn(addr)
+				}
+			}
+
+			server.pruneRequests(now)
+			server.pruneReplies(now)
+			server.pruneReservations(now, options.ReservationTimeout)
+			server.pruneRemotes(now, options.RequestTimeout)
+			server.refreshDirectory(now)
+			server.mutex.Unlock()
+
+			server.syncDirectory()
+			server.flushRegistry()
 		}
 	}
 }
 
-func (server *Server) serve(b []byte, conn shared.Conn) {
-	defer server.wg.Done()
+// Remove a registered peer, from its groups and the directory too. Must be called with the mutex held.
+func (server *Server) removePeer(peer *shared.Peer) {
+	server.presenceChange(peer, func() {
+		delete(server.peers, peer.ID)
+		server.leaveGroups(peer)
+	})
+	delete(server.subscriptions, peer.ID)
+	delete(server.published, peer.ID)
+	server.unpublish(peer.ID)
+	delete(server.endpoints, peer.ID)
+	server.savePeer(peer.ID)
+	server.forgetReplies(peer.Endpoint.String())
+	server.transport.DeleteConn(peer.Endpoint.String())
+}
 
-	message, err := shared.MessageIn(conn, b)
-	if err != nil {
-		conn.Send(&shared.Message{
-			Error: "Malformed payload was sent",
-		})
-		return
+func (server *Server) allow(addr *net.UDPAddr) bool {
+	if server.members[addr.String()] {
+		return true
 	}
 
-	go server.messageCallback(server.conns, conn, message)
-}
+	now := time.Now()
 
-func (server *Server) receiver() {
-	server.wg.Add(1)
-	defer server.wg.Done()
+	if server.isBanned("ip", addr.IP.String(), now) {
+		server.stats.banned.Add(1)
+		return false
+	}
 
-	for {
-		select {
-		case <-server.exit:
-			log.Print("Exiting UDP receiver")
-			server.conn.Close()
-			return
-		default:
-		}
+	if !server.limiter.allow(addr.IP.String(), now) {
+		server.stats.rateLimited.Add(1)
+		server.debug("Dropped datagram, rate limit exceeded", "addr", addr)
+		return false
+	}
 
-		buffer := make([]byte, 2048)
-		server.conn.SetDeadline(time.Now().Add(time.Second))
-		n, addr, err := server.conn.ReadFromUDP(buffer)
-		if err != nil {
-			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
-				continue
-			}
+	return true
+}
 
-			delete(server.conns, addr.String())
-			log.Print(err)
-			return
-		}
+// Requests which reach another peer have their own, lower, rate limit
+func (server *Server) allowIntroduction(conn shared.Conn) error {
+	if !server.introductions.allow(conn.GetAddr().(*net.UDPAddr).IP.String(), time.Now()) {
+		server.stats.introductionLimited.Add(1)
+		return shared.ErrRateLimited
+	}
 
-		conn, ok := server.conns[addr.String()]
-		if !ok {
-			conn = shared.NewUDPConn(server.sendChan, addr)
-			server.conns[addr.String()] = conn
-		}
+	return nil
+}
+
+// Whether the conn completed the greeting, the others only get an answer to their greeting
+func (server *Server) isKnown(conn shared.Conn) bool {
+	_, ok := server.transport.GetConn(conn.GetAddr().String())
+	return ok
+}
 
-		// Process message
-		server.wg.Add(1)
+// Tell a source that its session is unknown so that it greets and registers again.
+// The reply is never larger than the request, it cannot be used to amplify traffic.
+func (server *Server) unknownSession(conn shared.Conn, size int) {
+	reply := &shared.Message{Type: "unknown-session"}
 
-		go server.serve(buffer[:n], conn)
+	bytes, err := json.Marshal(reply)
+	if err != nil || len(bytes) > size {
+		return
 	}
+
+	conn.Send(reply)
 }
 
-func (server *Server) CreateConn(addr net.Addr) (shared.Conn, error) {
-	if addr == nil {
-		return nil, errors.New("conns addr must not be nil")
+// Send a message to a registered peer, through its server when it registered with another server of the cluster.
+// Must be called with the mutex held.
+func (server *Server) sendTo(peer *shared.Peer, message *shared.Message) error {
+	if _, ok := server.peers[peer.ID]; !ok {
+		_, owner, ok := server.findPeer(peer.ID)
+		if !ok || owner == "" {
+			return shared.NewError(shared.ErrorCodeUnknownPeer, "could not resolve the peer: %s's conn", peer.ID)
+		}
+
+		return server.sendMember(owner, &shared.Message{
+			Type: "cluster-forward",
+			Content: &shared.ClusterForward{
+				PeerID:    peer.ID,
+				Type:      message.Type,
+				RequestID: message.RequestID,
+				Error:     message.Error,
+				Code:      message.Code,
+				Content:   message.Content,
+			},
+		})
 	}
 
-	udpAddr, ok := addr.(*net.UDPAddr)
+	conn, ok := server.transport.GetConn(peer.Endpoint.String())
 	if !ok {
-		return nil, errors.New("could not assert net.Addr to *net.UDPAddr")
+		return shared.NewError(shared.ErrorCodeUnknownPeer, "could not resolve the peer: %s's conn", peer.ID)
+	}
+
+	err := conn.Send(message)
+	if err != nil {
+		server.error("Could not send message", "peer", peer.ID, "type", message.Type, "err", err)
+	}
+
+	return err
+}
+
+func (server *Server) malformedPayloadCallback(conn shared.Conn, bytes []byte, err error) {
+	server.stats.malformed.Add(1)
+	server.debug("Malformed payload", "addr", conn.GetAddr(), "err", err)
+
+	// Never answer spoofable sources, except to tell a peer the server lost its session
+	if !server.isKnown(conn) {
+		server.unknownSession(conn, len(bytes))
+		return
 	}
 
-	conn := shared.NewUDPConn(server.sendChan, udpAddr)
-	server.conns[addr.String()] = conn
+	conn.Send(&shared.Message{
+		Error: "Malformed payload was sent",
+		Code:  shared.ErrorCodeMalformed,
+	})
+}
+
+func (server *Server) LocalAddr() net.Addr {
+	return server.transport.LocalAddr()
+}
+
+// Set the identity of the server, used to create the shared secrets with the clients
+func (server *Server) SetKeyPair(privateKey [32]byte, publicKey [32]byte) {
+	server.privateKey = privateKey
+	server.publicKey = publicKey
+}
+
+func (server *Server) GetOptions() Options {
+	server.optionsMutex.RLock()
+	defer server.optionsMutex.RUnlock()
+
+	return server.options
+}
+
+// Options can be changed while the server is listening
+func (server *Server) SetOptions(options Options) {
+	server.optionsMutex.Lock()
+	server.options = options
+	server.optionsMutex.Unlock()
+
+	server.limiter.configure(options.RateLimit, options.RateBurst)
+	server.introductions.configure(options.IntroductionRate, options.IntroductionBurst)
+}
 
-	return conn, nil
+// Log with this logger instead of the default slog logger, must be called before Listen.
+// The level of the options still applies, and the sensitive attributes are redacted.
+func (server *Server) SetLogger(logger *slog.Logger) {
+	server.logger = slog.New(logging.Redact(logger.Handler())).With("server", server.LocalAddr().String())
 }
 
-func (server *Server) OnMessage(callback func(conns shared.Conns, conn shared.Conn, message *shared.Message)) {
-	server.messageCallback = callback
+// Counters of the dropped and rejected traffic since the server was created
+func (server *Server) GetStats() Stats {
+	return server.stats.snapshot()
 }
 
+// Say bye to the registered peers, drain the in-flight handlers, flush the queued responses and close the socket.
+// The later calls wait until the server stopped and do nothing.
 func (server *Server) Stop() {
+	server.stopOnce.Do(server.stop)
+}
+
+// The byes are queued before the transport stops, which sends them. The registry is only flushed once the
+// transport drained its handlers and the lookups finished, so that it saves the registrations they made.
+func (server *Server) stop() {
+	server.lifecycle.Lock()
 	close(server.exit)
+	server.lifecycle.Unlock()
+
 	server.wg.Wait()
 
-	log.Print("UDP server exited")
+	server.sayBye()
+	server.transport.Stop()
+	server.lookups.Wait()
+	server.flushRegistry()
+
+	// The other servers of the cluster can no longer reach our peers
+	server.mutex.Lock()
+	for id := range server.published {
+		server.unpublish(id)
+	}
+	server.mutex.Unlock()
+
+	server.syncDirectory()
+
+	server.info("UDP server exited")
 }
 
-func (server *Server) Listen() {
-	go server.sender()
+// Tell the peers registered with this server that it is leaving, they greet it again once it is back
+func (server *Server) sayBye() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	for _, peer := range server.peers {
+		conn, ok := server.transport.GetConn(peer.Endpoint.String())
+		if !ok {
+			continue
+		}
 
-	server.receiver()
+		err := conn.Send(&shared.Message{
+			Type:    "bye",
+			Encrypt: true,
+		})
+		if err != nil {
+			server.error("Could not say bye", "peer", peer.ID, "err", err)
+		}
+	}
 }
 
-func NewServer(addrStr string) (*Server, error) {
-	// Create UDP addr
-	addr, err := net.ResolveUDPAddr("udp", addrStr)
-	if err != nil {
-		return nil, err
+// Serve until the context is done or Stop is called, returns once the server stopped
+func (server *Server) Listen(ctx context.Context) {
+	server.lifecycle.Lock()
+	select {
+	case <-server.exit:
+		server.lifecycle.Unlock()
+		return
+	default:
 	}
+	server.wg.Add(1)
+	server.lifecycle.Unlock()
+
+	go server.janitor()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			server.Stop()
+		case <-server.exit:
+		}
+	}()
 
-	// Create UDP conn
-	conn, err := net.ListenUDP("udp", addr)
+	server.transport.Listen()
+
+	// The socket also stops on errors
+	server.Stop()
+}
+
+func NewServer(addrStr string) (*Server, error) {
+	transport, err := transport.NewTransport(addrStr)
 	if err != nil {
 		return nil, err
 	}
@@ -146,18 +391,61 @@ func NewServer(addrStr string) (*Server, error) {
 	}
 
 	server := &Server{
-		conn:            conn,
-		publicKey:       publicKey,
-		privateKey:      privateKey,
-		conns:           make(shared.Conns),
-		sendChan:        make(chan *shared.UDPPayload, 100),
-		messageCallback: func(conns shared.Conns, conn shared.Conn, message *shared.Message) {},
-		exit:            make(chan bool),
-		wg:              &sync.WaitGroup{},
-	}
-
-	udpPeers := make(shared.Peers)
-	server.OnMessage(createMessageCallback(server, udpPeers))
+		transport:         transport,
+		publicKey:         publicKey,
+		privateKey:        privateKey,
+		peers:             make(shared.Peers),
+		codes:             make(map[string]*pairingCode),
+		requests:          make(map[string]*establishRequest),
+		replies:           make(map[string]map[uint64]*cachedReply),
+		groups:            make(map[string]map[string]bool),
+		groupVerifiers:    make(map[string]string),
+		subscriptions:     make(map[string]*shared.PeerFilter),
+		reservations:      make(map[string]*reservation),
+		handshakes:        make(map[string]time.Time),
+		stats:             &stats{},
+		directory:         NewMemoryDirectory(),
+		owner:             transport.LocalAddr().String(),
+		members:           make(map[string]bool),
+		published:         make(map[string]time.Time),
+		directoryMutex:    &sync.Mutex{},
+		remotes:           make(map[string]*remotePeer),
+		lookups:           &sync.WaitGroup{},
+		lookupSlots:       make(chan struct{}, maxLookups),
+		dirtyPeers:        make(map[string]bool),
+		dirtyReservations: make(map[string]bool),
+		endpoints:         make(map[string]*endpointHistory),
+		bans:              make(map[string]time.Time),
+		bansMutex:         &sync.RWMutex{},
+		mutex:             &sync.Mutex{},
+		options:           DefaultOptions(),
+		optionsMutex:      &sync.RWMutex{},
+		exit:              make(chan struct{}),
+		stopOnce:          &sync.Once{},
+		wg:                &sync.WaitGroup{},
+		lifecycle:         &sync.Mutex{},
+	}
+
+	server.limiter = newRateLimiter(server.options.RateLimit, server.options.RateBurst)
+	server.introductions = newRateLimiter(server.options.IntroductionRate, server.options.IntroductionBurst)
+
+	server.SetLogger(slog.Default())
+	server.SetMetrics(metrics.NewRegistry())
+
+	_, err = rand.Read(server.cookieKey[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// Handlers serialize on the mutex, so a worker per CPU is enough to decrypt and decode in parallel
+	transport.SetWorkers(runtime.GOMAXPROCS(0))
+	transport.SetBatchSize(batchSize)
+	transport.SetFilter(server.allow)
+	// Conns are only kept once the greeting proved the source address
+	transport.SetConnFilter(func(addr *net.UDPAddr) bool { return false })
+	transport.OnError(func(err error) { server.error("Transport error", "err", err) })
+	transport.OnUnknownPayload(server.malformedPayloadCallback)
+	transport.OnMessage(createMessageCallback(server, server.peers))
 
 	return server, nil
 }
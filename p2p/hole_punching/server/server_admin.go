@@ -0,0 +1,300 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"p2p/shared"
+)
+
+// Registered peer as shown to the operators of the server
+type PeerInfo struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	Namespace string    `json:"namespace,omitempty"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Visible   bool      `json:"visible"`
+	// Identity key fingerprint the username is bound to
+	Fingerprint string   `json:"fingerprint,omitempty"`
+	Groups      []string `json:"groups,omitempty"`
+	Subscribed  bool     `json:"subscribed"`
+	NAT         NATInfo  `json:"nat"`
+}
+
+// What the server knows of the NAT of a peer, it only sees the public side of the mapping
+type NATInfo struct {
+	// Public endpoint the server sees the peer at
+	Endpoint string `json:"endpoint"`
+	// Endpoint before the last change, empty if it never changed
+	PreviousEndpoint string `json:"previousEndpoint,omitempty"`
+	// Times the endpoint changed since the first registration, after a network change or a NAT rebinding
+	EndpointChanges int `json:"endpointChanges"`
+	// First registration of the peer with this server
+	RegisteredAt time.Time `json:"registeredAt"`
+}
+
+// Endpoints a peer registered from, by peer ID
+type endpointHistory struct {
+	previous     string
+	changes      int
+	registeredAt time.Time
+}
+
+// Conn of the transport, greeted, registered or of another server of the cluster
+type ConnInfo struct {
+	Addr string `json:"addr"`
+	// greeted, registered or member
+	State  string `json:"state"`
+	PeerID string `json:"peerID,omitempty"`
+}
+
+// Banned source IP or identity key fingerprint
+type Ban struct {
+	// ip or identity
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+	// Zero when the ban never expires
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+// Counters of the state of the server, with the dropped traffic
+type Status struct {
+	Addr     string `json:"addr"`
+	Peers    int    `json:"peers"`
+	Conns    int    `json:"conns"`
+	Groups   int    `json:"groups"`
+	Codes    int    `json:"codes"`
+	Requests int    `json:"requests"`
+	Bans     int    `json:"bans"`
+	Stats    Stats  `json:"stats"`
+}
+
+// Must be called with the mutex held
+func (server *Server) peerInfo(peer *shared.Peer) PeerInfo {
+	info := PeerInfo{
+		ID:          peer.ID,
+		Username:    peer.Username,
+		Namespace:   peer.Namespace,
+		LastSeen:    peer.LastSeen,
+		Visible:     peer.Visible,
+		Fingerprint: peer.Fingerprint(),
+		NAT:         NATInfo{Endpoint: peer.Endpoint.String()},
+	}
+
+	for name, members := range server.groups {
+		if members[peer.ID] {
+			info.Groups = append(info.Groups, name)
+		}
+	}
+	sort.Strings(info.Groups)
+
+	_, info.Subscribed = server.subscriptions[peer.ID]
+
+	if history, ok := server.endpoints[peer.ID]; ok {
+		info.NAT.PreviousEndpoint = history.previous
+		info.NAT.EndpointChanges = history.changes
+		info.NAT.RegisteredAt = history.registeredAt
+	}
+
+	return info
+}
+
+// Peers registered with this server, by username
+func (server *Server) Peers() []PeerInfo {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	infos := make([]PeerInfo, 0, len(server.peers))
+	for _, peer := range server.peers {
+		infos = append(infos, server.peerInfo(peer))
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Username != infos[j].Username {
+			return infos[i].Username < infos[j].Username
+		}
+		return infos[i].ID < infos[j].ID
+	})
+
+	return infos
+}
+
+// Peer registered with this server
+func (server *Server) Peer(id string) (PeerInfo, bool) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	peer, ok := server.peers[id]
+	if !ok {
+		return PeerInfo{}, false
+	}
+
+	return server.peerInfo(peer), true
+}
+
+// Conns of the transport, by address
+func (server *Server) Conns() []ConnInfo {
+	addrs := server.transport.Addrs()
+	sort.Strings(addrs)
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	byEndpoint := make(map[string]string, len(server.peers))
+	for id, peer := range server.peers {
+		byEndpoint[peer.Endpoint.String()] = id
+	}
+
+	infos := make([]ConnInfo, len(addrs))
+	for i, addr := range addrs {
+		info := ConnInfo{Addr: addr, State: "greeted"}
+		if id, ok := byEndpoint[addr]; ok {
+			info.State = "registered"
+			info.PeerID = id
+		} else if server.members[addr] {
+			info.State = "member"
+		}
+
+		infos[i] = info
+	}
+
+	return infos
+}
+
+// Remove a registered peer as if it timed out, it registers again unless it is banned
+func (server *Server) Kick(id string) error {
+	server.mutex.Lock()
+	peer, ok := server.peers[id]
+	if !ok {
+		server.mutex.Unlock()
+		return fmt.Errorf("peer %s is not registered with this server", id)
+	}
+
+	server.removePeer(peer)
+	server.mutex.Unlock()
+
+	server.syncDirectory()
+	server.info("Kicked peer", "peer", id)
+
+	return nil
+}
+
+// Kick a registered peer and ban its IP and identity key for this long, forever if 0
+func (server *Server) BanPeer(id string, duration time.Duration) error {
+	server.mutex.Lock()
+	peer, ok := server.peers[id]
+	server.mutex.Unlock()
+
+	if !ok {
+		return fmt.Errorf("peer %s is not registered with this server", id)
+	}
+
+	server.Ban(Ban{Kind: "ip", Value: peer.Endpoint.IP}, duration)
+	if fingerprint := peer.Fingerprint(); fingerprint != "" {
+		server.Ban(Ban{Kind: "identity", Value: fingerprint}, duration)
+	}
+
+	return server.Kick(id)
+}
+
+// Drop the datagrams of an IP, or reject the registrations of an identity key fingerprint, for this long, forever if 0
+func (server *Server) Ban(ban Ban, duration time.Duration) error {
+	switch ban.Kind {
+	case "ip":
+		if net.ParseIP(ban.Value) == nil {
+			return fmt.Errorf("%s is not an IP address", ban.Value)
+		}
+	case "identity":
+		if ban.Value == "" {
+			return fmt.Errorf("identity ban must have a fingerprint")
+		}
+	default:
+		return fmt.Errorf("unknown ban kind %s", ban.Kind)
+	}
+
+	var expires time.Time
+	if duration > 0 {
+		expires = time.Now().Add(duration)
+	}
+
+	server.bansMutex.Lock()
+	server.bans[ban.Kind+"/"+ban.Value] = expires
+	server.bansMutex.Unlock()
+
+	server.info("Banned", "kind", ban.Kind, "value", ban.Value, "duration", duration)
+
+	return nil
+}
+
+func (server *Server) Unban(ban Ban) bool {
+	key := ban.Kind + "/" + ban.Value
+
+	server.bansMutex.Lock()
+	defer server.bansMutex.Unlock()
+
+	_, ok := server.bans[key]
+	delete(server.bans, key)
+
+	return ok
+}
+
+func (server *Server) Bans() []Ban {
+	server.bansMutex.RLock()
+	defer server.bansMutex.RUnlock()
+
+	bans := make([]Ban, 0, len(server.bans))
+	for key, expires := range server.bans {
+		kind, value, _ := strings.Cut(key, "/")
+		bans = append(bans, Ban{Kind: kind, Value: value, Expires: expires})
+	}
+
+	sort.Slice(bans, func(i, j int) bool {
+		if bans[i].Kind != bans[j].Kind {
+			return bans[i].Kind < bans[j].Kind
+		}
+		return bans[i].Value < bans[j].Value
+	})
+
+	return bans
+}
+
+func (server *Server) isBanned(kind string, value string, now time.Time) bool {
+	server.bansMutex.RLock()
+	defer server.bansMutex.RUnlock()
+
+	expires, ok := server.bans[kind+"/"+value]
+	return ok && (expires.IsZero() || now.Before(expires))
+}
+
+func (server *Server) pruneBans(now time.Time) {
+	server.bansMutex.Lock()
+	defer server.bansMutex.Unlock()
+
+	for key, expires := range server.bans {
+		if !expires.IsZero() && now.After(expires) {
+			delete(server.bans, key)
+		}
+	}
+}
+
+func (server *Server) Status() Status {
+	conns := len(server.transport.Addrs())
+	bans := len(server.Bans())
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return Status{
+		Addr:     server.LocalAddr().String(),
+		Peers:    len(server.peers),
+		Conns:    conns,
+		Groups:   len(server.groups),
+		Codes:    len(server.codes),
+		Requests: len(server.requests),
+		Bans:     bans,
+		Stats:    server.GetStats(),
+	}
+}
@@ -0,0 +1,308 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+
+	"p2p/shared"
+)
+
+// Directory entries expire unless their server refreshes them, so that the peers of a stopped server are forgotten
+const directoryTTL = time.Minute
+
+// Directory lookups in flight at once, the requests beyond are dropped and retransmitted by their peer
+const maxLookups = 64
+
+// Rendez-vous servers sharing their registered peers, a peer can establish a connection
+// with a peer registered with another server of the cluster
+type Cluster struct {
+	// UDP address the other servers reach this one at
+	Advertise string
+	// UDP addresses of the other servers
+	Members []string
+	// Secret shared by the servers, encrypts their messages
+	Key       [32]byte
+	Directory Directory
+}
+
+// Join a cluster of servers, must be called before Listen
+func (server *Server) SetCluster(cluster Cluster) error {
+	advertise, err := net.ResolveUDPAddr("udp", cluster.Advertise)
+	if err != nil {
+		return err
+	}
+
+	members := make(map[string]bool)
+	for _, member := range cluster.Members {
+		addr, err := net.ResolveUDPAddr("udp", member)
+		if err != nil {
+			return err
+		}
+
+		conn, err := server.transport.CreateConn(addr)
+		if err != nil {
+			return err
+		}
+
+		conn.SetSecret(cluster.Key)
+		members[addr.String()] = true
+	}
+
+	server.directory = cluster.Directory
+	server.owner = advertise.String()
+	server.members = members
+
+	return nil
+}
+
+// Only the public fields of a peer are published
+func directoryEntry(peer *shared.Peer, owner string) *DirectoryEntry {
+	return &DirectoryEntry{
+		Peer: &shared.Peer{
+			ID:          peer.ID,
+			Username:    peer.Username,
+			Namespace:   peer.Namespace,
+			Endpoint:    peer.Endpoint,
+			PublicKey:   peer.PublicKey,
+			IdentityKey: peer.IdentityKey,
+		},
+		Owner: owner,
+	}
+}
+
+// Change of the directory, queued by the handlers and applied once the mutex is released
+type directoryUpdate struct {
+	id string
+	// Entry to publish, nil to remove the peer
+	entry *DirectoryEntry
+}
+
+// Directory entry of a peer registered with another server, looked up before the handler which needs it takes the mutex
+type remotePeer struct {
+	entry   *DirectoryEntry
+	fetched time.Time
+}
+
+// Publish a peer registered with this server, must be called with the mutex held
+func (server *Server) publish(peer *shared.Peer) {
+	server.updates = append(server.updates, directoryUpdate{id: peer.ID, entry: directoryEntry(peer, server.owner)})
+	server.published[peer.ID] = time.Now()
+}
+
+// Remove a peer from the directory, unless it registered with another server since. Must be called with the mutex held.
+func (server *Server) unpublish(id string) {
+	server.updates = append(server.updates, directoryUpdate{id: id})
+}
+
+// Publish again the peers whose entry is about to expire, must be called with the mutex held
+func (server *Server) refreshDirectory(now time.Time) {
+	for id, published := range server.published {
+		if now.Sub(published) > directoryTTL/2 {
+			server.publish(server.peers[id])
+		}
+	}
+}
+
+// Apply the queued changes of the directory in order, must be called without the mutex held since the directory may be remote
+func (server *Server) syncDirectory() {
+	server.directoryMutex.Lock()
+	defer server.directoryMutex.Unlock()
+
+	server.mutex.Lock()
+	updates := server.updates
+	server.updates = nil
+	server.mutex.Unlock()
+
+	for _, update := range updates {
+		if update.entry == nil {
+			err := server.directory.Delete(update.id, server.owner)
+			if err != nil {
+				server.error("Could not unpublish peer", "peer", update.id, "err", err)
+			}
+			continue
+		}
+
+		err := server.directory.Put(update.entry, directoryTTL)
+		if err != nil {
+			server.error("Could not publish peer", "peer", update.id, "err", err)
+		}
+	}
+}
+
+// Peer named by a request which may be registered with another server
+func directoryTarget(message *shared.Message) string {
+	switch message.Type {
+	case "establish":
+		id, _ := message.Content.(string)
+		return id
+	case "consent":
+		var consent shared.Consent
+		mapstructure.Decode(message.Content, &consent)
+		return consent.PeerID
+	case "resume":
+		var resume shared.Resume
+		mapstructure.Decode(message.Content, &resume)
+		return resume.PeerID
+	case "cluster-establish":
+		var request shared.ClusterEstablish
+		mapstructure.Decode(message.Content, &request)
+		return request.From
+	}
+
+	return ""
+}
+
+// ID of the peer of another server named by a request, which is looked up in the directory before the request is handled.
+// Must be called without the mutex held.
+func (server *Server) remoteTarget(message *shared.Message) string {
+	id := directoryTarget(message)
+	if id == "" || len(server.members) == 0 {
+		return ""
+	}
+
+	server.mutex.Lock()
+	_, local := server.peers[id]
+	server.mutex.Unlock()
+
+	if local {
+		return ""
+	}
+
+	return id
+}
+
+// Look up a peer of another server in the directory, so that findPeer finds it without calling the directory.
+// Must be called without the mutex held since the directory may be remote.
+func (server *Server) lookupTarget(id string) {
+	entry, ok, err := server.directory.Get(id)
+	if err != nil {
+		server.error("Could not look up peer", "peer", id, "err", err)
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if ok {
+		server.remotes[id] = &remotePeer{entry: entry, fetched: time.Now()}
+	} else {
+		delete(server.remotes, id)
+	}
+}
+
+// Forget the entries looked up before the oldest pending establish request, must be called with the mutex held
+func (server *Server) pruneRemotes(now time.Time, timeout time.Duration) {
+	for id, remote := range server.remotes {
+		if now.Sub(remote.fetched) > timeout {
+			delete(server.remotes, id)
+		}
+	}
+}
+
+// Registered peer with this ID, and the cluster address of its server when it is registered with another server.
+// The peers of the other servers are only found once lookupTarget looked them up. Must be called with the mutex held.
+func (server *Server) findPeer(id string) (*shared.Peer, string, bool) {
+	if peer, ok := server.peers[id]; ok {
+		return peer, "", true
+	}
+
+	remote, ok := server.remotes[id]
+	if !ok {
+		return nil, "", false
+	}
+
+	// An entry of this server for a peer it does not know is stale
+	entry := remote.entry
+	if entry.Owner == server.owner || !server.members[entry.Owner] {
+		return nil, "", false
+	}
+
+	return entry.Peer, entry.Owner, true
+}
+
+// Send a message to a server of the cluster
+func (server *Server) sendMember(member string, message *shared.Message) error {
+	conn, ok := server.transport.GetConn(member)
+	if !ok {
+		return fmt.Errorf("%s is not a member of the cluster", member)
+	}
+
+	message.Encrypt = true
+	return conn.Send(message)
+}
+
+// Whether the message was sent by a server of the cluster over the encrypted channel
+func (server *Server) fromMember(conn shared.Conn, message *shared.Message) bool {
+	return message.Encrypt && server.members[conn.GetAddr().String()]
+}
+
+// Run the establish request of a peer registered with the server which sent it,
+// the response is forwarded to the requester
+func clusterEstablishHandler(server *Server, peers shared.Peers, conn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	if !server.fromMember(conn, message) {
+		return nil, shared.NewError(shared.ErrorCodeUnknownType, "request type %s undefined", message.Type)
+	}
+
+	var request shared.ClusterEstablish
+	err := mapstructure.Decode(message.Content, &request)
+	if err != nil {
+		return nil, shared.ErrMalformed
+	}
+
+	rp, owner, ok := server.findPeer(request.From)
+	if !ok || owner != conn.GetAddr().String() {
+		return nil, shared.NewError(shared.ErrorCodeUnknownPeer, "peer %s is not registered with %s", request.From, conn.GetAddr())
+	}
+
+	var res *shared.Message
+
+	op, ok := peers[request.To]
+	if ok {
+		res, err = server.requestConsent(rp, op, request.RequestID)
+	} else {
+		err = shared.NewError(shared.ErrorCodeUnknownPeer, "peer: %s has not registered with the server", request.To)
+	}
+
+	if err != nil {
+		res = &shared.Message{
+			Type:    "establish",
+			Error:   err.Error(),
+			Code:    shared.CodeOf(err),
+			Encrypt: true,
+		}
+	}
+
+	res.RequestID = request.RequestID
+
+	return nil, server.sendTo(rp, res)
+}
+
+// Deliver a message sent by another server to a peer registered with this one
+func clusterForwardHandler(server *Server, peers shared.Peers, conn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	if !server.fromMember(conn, message) {
+		return nil, shared.NewError(shared.ErrorCodeUnknownType, "request type %s undefined", message.Type)
+	}
+
+	var forward shared.ClusterForward
+	err := mapstructure.Decode(message.Content, &forward)
+	if err != nil {
+		return nil, shared.ErrMalformed
+	}
+
+	peer, ok := peers[forward.PeerID]
+	if !ok {
+		server.debug("Dropped message forwarded to unknown peer", "peer", forward.PeerID)
+		return nil, nil
+	}
+
+	return nil, server.sendTo(peer, &shared.Message{
+		Type:      forward.Type,
+		RequestID: forward.RequestID,
+		Error:     forward.Error,
+		Code:      forward.Code,
+		Content:   forward.Content,
+		Encrypt:   true,
+	})
+}
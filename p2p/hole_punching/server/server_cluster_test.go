@@ -0,0 +1,194 @@
+package server
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"p2p/shared"
+)
+
+// Directory failing the test when it is called with the mutex of the server held
+type unlockedDirectory struct {
+	Directory
+	t       testing.TB
+	server  *Server
+	calls   atomic.Int32
+	deletes atomic.Int32
+}
+
+func (directory *unlockedDirectory) check() {
+	directory.calls.Add(1)
+
+	if !directory.server.mutex.TryLock() {
+		directory.t.Error("directory called with the mutex held")
+		return
+	}
+	directory.server.mutex.Unlock()
+}
+
+func (directory *unlockedDirectory) Put(entry *DirectoryEntry, ttl time.Duration) error {
+	directory.check()
+	return directory.Directory.Put(entry, ttl)
+}
+
+func (directory *unlockedDirectory) Get(id string) (*DirectoryEntry, bool, error) {
+	directory.check()
+	return directory.Directory.Get(id)
+}
+
+func (directory *unlockedDirectory) Delete(id string, owner string) error {
+	directory.check()
+	directory.deletes.Add(1)
+	return directory.Directory.Delete(id, owner)
+}
+
+func newClusterServer(t testing.TB, directory Directory) (*Server, *unlockedDirectory) {
+	t.Helper()
+
+	server := newTestServer(t)
+	unlocked := &unlockedDirectory{Directory: directory, t: t, server: server}
+
+	err := server.SetCluster(Cluster{
+		Advertise: "192.0.2.100:5000",
+		Members:   []string{"192.0.2.200:5000"},
+		Directory: unlocked,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return server, unlocked
+}
+
+func TestDirectoryCalledWithoutTheMutex(t *testing.T) {
+	memory := NewMemoryDirectory()
+	server, directory := newClusterServer(t, memory)
+	callback := createMessageCallback(server, server.peers)
+
+	alice := addTestPeer(t, server, "alice", "192.0.2.1:4000")
+
+	// Bob registered with the other server of the cluster
+	memory.Put(&DirectoryEntry{Peer: &shared.Peer{ID: "bob", Username: "bob"}, Owner: "192.0.2.200:5000"}, time.Minute)
+
+	callback(alice, &shared.Message{Type: "establish", PeerID: "alice", Content: "bob", RequestID: 1, Encrypt: true})
+	server.lookups.Wait()
+
+	if directory.calls.Load() == 0 {
+		t.Fatal("expected the directory to be looked up")
+	}
+
+	// The other server answers, alice gets no error from this one
+	if len(alice.sent) != 0 {
+		t.Fatalf("expected the request to be forwarded, got %+v", alice.sent[0])
+	}
+
+	if _, owner, ok := server.findPeer("bob"); !ok || owner != "192.0.2.200:5000" {
+		t.Fatalf("expected bob to be found on the other server, got %q, %v", owner, ok)
+	}
+
+	// Leaving removes the entry once the mutex is released
+	callback(alice, &shared.Message{Type: "bye", PeerID: "alice", RequestID: 2, Encrypt: true})
+
+	if directory.deletes.Load() != 1 {
+		t.Fatalf("expected alice to be unpublished, got %d deletes", directory.deletes.Load())
+	}
+}
+
+// Directory whose lookups wait until the test releases them
+type slowDirectory struct {
+	Directory
+	release chan struct{}
+}
+
+func (directory *slowDirectory) Get(id string) (*DirectoryEntry, bool, error) {
+	<-directory.release
+	return directory.Directory.Get(id)
+}
+
+func TestLookupOffTheWorker(t *testing.T) {
+	memory := NewMemoryDirectory()
+	slow := &slowDirectory{Directory: memory, release: make(chan struct{})}
+	server, _ := newClusterServer(t, slow)
+	callback := createMessageCallback(server, server.peers)
+
+	alice := addTestPeer(t, server, "alice", "192.0.2.1:4000")
+	memory.Put(&DirectoryEntry{Peer: &shared.Peer{ID: "bob", Username: "bob"}, Owner: "192.0.2.200:5000"}, time.Minute)
+
+	// The worker is free again while the directory is looked up
+	returned := make(chan struct{})
+	go func() {
+		callback(alice, &shared.Message{Type: "establish", PeerID: "alice", Content: "bob", RequestID: 1, Encrypt: true})
+		callback(alice, &shared.Message{Type: "keepalive", PeerID: "alice", RequestID: 2, Encrypt: true})
+		close(returned)
+	}()
+
+	select {
+	case <-returned:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the worker not to wait for the directory")
+	}
+
+	if len(alice.received()) != 1 || alice.received()[0].RequestID != 2 {
+		t.Fatalf("expected the keepalive to be answered first, got %+v", alice.received())
+	}
+
+	close(slow.release)
+	server.lookups.Wait()
+
+	server.mutex.Lock()
+	_, owner, ok := server.findPeer("bob")
+	server.mutex.Unlock()
+	if !ok || owner != "192.0.2.200:5000" {
+		t.Fatalf("expected bob to be found once looked up, got %q, %v", owner, ok)
+	}
+
+	// Beyond the lookups in flight, the requests are dropped until their peer sends them again
+	for range maxLookups {
+		server.lookupSlots <- struct{}{}
+	}
+	callback(alice, &shared.Message{Type: "establish", PeerID: "alice", Content: "carol", RequestID: 3, Encrypt: true})
+	server.lookups.Wait()
+
+	if len(alice.received()) != 1 {
+		t.Fatalf("expected the request to be dropped, got %+v", alice.received())
+	}
+}
+
+func TestDirectoryUpdatesInOrder(t *testing.T) {
+	directory := NewMemoryDirectory()
+	server, _ := newClusterServer(t, directory)
+
+	peer := &shared.Peer{ID: "alice", Username: "alice"}
+
+	// A peer leaving and registering again is published
+	server.mutex.Lock()
+	server.publish(peer)
+	server.unpublish(peer.ID)
+	server.publish(peer)
+	server.mutex.Unlock()
+
+	server.syncDirectory()
+
+	entry, ok, _ := directory.Get("alice")
+	if !ok || entry.Owner != server.owner {
+		t.Fatalf("expected alice to be published by the server, got %+v", entry)
+	}
+
+	// Entries of the other servers are not removed
+	directory.Put(&DirectoryEntry{Peer: &shared.Peer{ID: "bob"}, Owner: "192.0.2.200:5000"}, 0)
+
+	server.mutex.Lock()
+	server.unpublish("alice")
+	server.unpublish("bob")
+	server.mutex.Unlock()
+
+	server.syncDirectory()
+
+	if _, ok, _ := directory.Get("alice"); ok {
+		t.Fatal("expected alice to be unpublished")
+	}
+	if _, ok, _ := directory.Get("bob"); !ok {
+		t.Fatal("expected the entry of the other server to be kept")
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"crypto/rand"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"p2p/shared"
+)
+
+// Pairing code created by a peer, by nameplate, used once by another peer to be introduced to it
+type pairingCode struct {
+	peerID  string
+	expires time.Time
+}
+
+func randomInt(max int) (int, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n.Int64()), nil
+}
+
+// Nameplates are picked at random below this number, so that the active codes cannot be listed one by one
+const maxNameplate = 1000
+
+// Pick a free nameplate such as 7, the peer which created the code appends the password words
+// to it and only the nameplate is ever sent to the server. Must be called with the mutex held.
+func (server *Server) genNameplate() (string, error) {
+	for range 16 {
+		n, err := randomInt(maxNameplate - 1)
+		if err != nil {
+			return "", err
+		}
+
+		nameplate := strconv.Itoa(n + 1)
+		if _, ok := server.codes[nameplate]; !ok {
+			return nameplate, nil
+		}
+	}
+
+	return "", shared.NewError(shared.ErrorCodeLimitExceeded, "too many active pairing codes, try again later")
+}
+
+// Nameplate of a pairing code, older clients send the whole code
+func nameplateOf(code string) string {
+	nameplate, _, _ := strings.Cut(strings.TrimSpace(code), "-")
+	return strings.TrimSpace(nameplate)
+}
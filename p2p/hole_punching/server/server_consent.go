@@ -0,0 +1,141 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+
+	"p2p/shared"
+)
+
+// Establish request waiting for the consent of its target, nobody learns an endpoint before
+type establishRequest struct {
+	from    string
+	to      string
+	created time.Time
+	expires time.Time
+	// ID of the establish request of the requester, echoed in the answer it gets once the target decided
+	requestID uint64
+}
+
+func requestKey(from string, to string) string {
+	return from + "/" + to
+}
+
+// Ask the target for its consent, or introduce both peers if the target already asked for us
+func (server *Server) requestConsent(rp *shared.Peer, op *shared.Peer, requestID uint64) (*shared.Message, error) {
+	now := time.Now()
+
+	// Asking for a peer which asked for us accepts its request
+	if reverse, ok := server.requests[requestKey(op.ID, rp.ID)]; ok && now.Before(reverse.expires) {
+		delete(server.requests, requestKey(op.ID, rp.ID))
+		server.observeConsent(reverse, "accepted", now)
+		server.info("Establish request accepted", "peer", op.ID, "target", rp.ID, "session", shared.SessionID(rp.ID, op.ID))
+		return introduce(server, rp, op, reverse.requestID)
+	}
+
+	key := requestKey(rp.ID, op.ID)
+
+	// Ask the target only once per request
+	created := now
+	if request, ok := server.requests[key]; ok {
+		created = request.created
+	} else {
+		server.info("Establish request", "peer", rp.ID, "target", op.ID, "session", shared.SessionID(rp.ID, op.ID))
+		server.sendTo(op, &shared.Message{
+			Type:    "incoming",
+			Content: publicPeer(rp),
+			Encrypt: true,
+		})
+	}
+
+	server.requests[key] = &establishRequest{
+		from:      rp.ID,
+		to:        op.ID,
+		created:   created,
+		expires:   now.Add(server.GetOptions().RequestTimeout),
+		requestID: requestID,
+	}
+
+	return &shared.Message{
+		Type:    "establish-pending",
+		Content: op.ID,
+		Encrypt: true,
+	}, nil
+}
+
+// Accept or decline an establish request, the endpoints are only exchanged once accepted
+func consentHandler(server *Server, peers shared.Peers, message *shared.Message) (*shared.Message, error) {
+	rp, ok := peers[message.PeerID]
+	if !ok {
+		return nil, shared.ErrNotRegistered
+	}
+
+	var consent shared.Consent
+	err := mapstructure.Decode(message.Content, &consent)
+	if err != nil {
+		return nil, shared.ErrMalformed
+	}
+
+	key := requestKey(consent.PeerID, rp.ID)
+
+	request, ok := server.requests[key]
+	if !ok || time.Now().After(request.expires) {
+		return nil, shared.NewError(shared.ErrorCodeNoPendingRequest, "no pending request from peer %s", consent.PeerID)
+	}
+
+	delete(server.requests, key)
+
+	op, _, ok := server.findPeer(consent.PeerID)
+	if !ok {
+		return nil, shared.NewError(shared.ErrorCodeUnknownPeer, "peer %s is no longer registered", consent.PeerID)
+	}
+
+	session := shared.SessionID(rp.ID, op.ID)
+
+	if consent.Accept {
+		server.observeConsent(request, "accepted", time.Now())
+		server.info("Establish request accepted", "peer", op.ID, "target", rp.ID, "session", session)
+		return introduce(server, rp, op, request.requestID)
+	}
+
+	server.observeConsent(request, "declined", time.Now())
+	server.info("Establish request declined", "peer", op.ID, "target", rp.ID, "session", session)
+
+	server.sendTo(op, &shared.Message{
+		Type:      "establish",
+		RequestID: request.requestID,
+		Error:     fmt.Sprintf("peer %s declined the connection", rp.ID),
+		Code:      shared.ErrorCodeDeclined,
+		Encrypt:   true,
+	})
+
+	return &shared.Message{
+		Type:    "consent",
+		Encrypt: true,
+	}, nil
+}
+
+// Tell the requesters whose request was not answered in time, must be called with the mutex held
+func (server *Server) pruneRequests(now time.Time) {
+	for key, request := range server.requests {
+		if now.Before(request.expires) {
+			continue
+		}
+
+		delete(server.requests, key)
+		server.observeConsent(request, "timeout", now)
+		server.info("Establish request timed out", "peer", request.from, "target", request.to, "session", shared.SessionID(request.from, request.to))
+
+		if requester, _, ok := server.findPeer(request.from); ok {
+			server.sendTo(requester, &shared.Message{
+				Type:      "establish",
+				RequestID: request.requestID,
+				Error:     fmt.Sprintf("peer %s did not answer the connection request", request.to),
+				Code:      shared.ErrorCodeTimeout,
+				Encrypt:   true,
+			})
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+const (
+	// Cookies are accepted for this long after they were sent
+	cookieTimeout = 2 * time.Minute
+	// Greeted conns which do not register in time are removed
+	handshakeTimeout = time.Minute
+)
+
+// Stateless cookie proving that the client receives the datagrams sent to its source address,
+// the timestamp followed by a MAC of the address and the timestamp
+func (server *Server) genCookie(addr *net.UDPAddr, now time.Time) string {
+	timestamp := binary.BigEndian.AppendUint64(nil, uint64(now.Unix()))
+
+	return base64.StdEncoding.EncodeToString(append(timestamp, server.cookieMAC(addr, timestamp)...))
+}
+
+func (server *Server) validCookie(addr *net.UDPAddr, cookie string, now time.Time) bool {
+	bytes, err := base64.StdEncoding.DecodeString(cookie)
+	if err != nil || len(bytes) != 8+16 {
+		return false
+	}
+
+	timestamp := bytes[:8]
+	sent := time.Unix(int64(binary.BigEndian.Uint64(timestamp)), 0)
+	if now.Sub(sent) > cookieTimeout || sent.After(now.Add(time.Second)) {
+		return false
+	}
+
+	return hmac.Equal(bytes[8:], server.cookieMAC(addr, timestamp))
+}
+
+func (server *Server) cookieMAC(addr *net.UDPAddr, timestamp []byte) []byte {
+	mac := hmac.New(sha256.New, server.cookieKey[:])
+	mac.Write([]byte(addr.String()))
+	mac.Write(timestamp)
+
+	return mac.Sum(nil)[:16]
+}
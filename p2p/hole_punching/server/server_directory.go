@@ -0,0 +1,90 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"p2p/shared"
+)
+
+// Registered peer published in the directory
+type DirectoryEntry struct {
+	Peer *shared.Peer `json:"peer"`
+	// Cluster address of the server which holds the conn of the peer
+	Owner string `json:"owner"`
+}
+
+// Peers registered with the servers of a cluster, so that a server can reach the peers of the others
+type Directory interface {
+	// Publish the entry for ttl, 0 never expires
+	Put(entry *DirectoryEntry, ttl time.Duration) error
+	Get(id string) (*DirectoryEntry, bool, error)
+	// Remove the entry of the peer, unless another server published it since
+	Delete(id string, owner string) error
+	Close() error
+}
+
+type memoryEntry struct {
+	entry   DirectoryEntry
+	expires time.Time
+}
+
+// Directory kept in memory, shared by the servers of a single process
+type MemoryDirectory struct {
+	entries map[string]*memoryEntry
+	mutex   *sync.Mutex
+}
+
+func (directory *MemoryDirectory) Put(entry *DirectoryEntry, ttl time.Duration) error {
+	directory.mutex.Lock()
+	defer directory.mutex.Unlock()
+
+	stored := &memoryEntry{entry: *entry}
+	if ttl > 0 {
+		stored.expires = time.Now().Add(ttl)
+	}
+
+	directory.entries[entry.Peer.ID] = stored
+
+	return nil
+}
+
+func (directory *MemoryDirectory) Get(id string) (*DirectoryEntry, bool, error) {
+	directory.mutex.Lock()
+	defer directory.mutex.Unlock()
+
+	stored, ok := directory.entries[id]
+	if !ok {
+		return nil, false, nil
+	}
+
+	if !stored.expires.IsZero() && time.Now().After(stored.expires) {
+		delete(directory.entries, id)
+		return nil, false, nil
+	}
+
+	entry := stored.entry
+	return &entry, true, nil
+}
+
+func (directory *MemoryDirectory) Delete(id string, owner string) error {
+	directory.mutex.Lock()
+	defer directory.mutex.Unlock()
+
+	if stored, ok := directory.entries[id]; ok && stored.entry.Owner == owner {
+		delete(directory.entries, id)
+	}
+
+	return nil
+}
+
+func (directory *MemoryDirectory) Close() error {
+	return nil
+}
+
+func NewMemoryDirectory() *MemoryDirectory {
+	return &MemoryDirectory{
+		entries: make(map[string]*memoryEntry),
+		mutex:   &sync.Mutex{},
+	}
+}
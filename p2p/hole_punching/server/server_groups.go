@@ -0,0 +1,168 @@
+package server
+
+import (
+	"crypto/hmac"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+
+	"p2p/shared"
+)
+
+const (
+	// Every member punches every other member, so groups stay small
+	maxGroupMembers    = 32
+	maxGroupNameLength = 64
+)
+
+func groupName(content interface{}) (string, error) {
+	name, ok := content.(string)
+	if !ok {
+		return "", shared.ErrMalformed
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > maxGroupNameLength {
+		return "", shared.NewError(shared.ErrorCodeInvalidRequest, "group name must be between 1 and %d characters", maxGroupNameLength)
+	}
+
+	return name, nil
+}
+
+// Send a group-join or group-leave event about peer to a member of the group
+func (server *Server) notifyMember(member *shared.Peer, messageType string, name string, peer *shared.Peer) {
+	server.sendTo(member, &shared.Message{
+		Type:    messageType,
+		Content: &shared.Group{Name: name, Members: []*shared.Peer{peer}},
+		Encrypt: true,
+	})
+}
+
+// Join a group, the requesting peer and every member are introduced to each other.
+// Only the peers knowing the secret of the members learn their endpoints, the first member sets it.
+// The members are sent one per message to stay under the datagram size.
+func groupJoinHandler(server *Server, peers shared.Peers, message *shared.Message) (*shared.Message, error) {
+	rp, ok := peers[message.PeerID]
+	if !ok {
+		return nil, shared.ErrNotRegistered
+	}
+
+	var join shared.Group
+	err := mapstructure.Decode(message.Content, &join)
+	if err != nil {
+		return nil, shared.ErrMalformed
+	}
+
+	name, err := groupName(join.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	if join.Verifier == "" {
+		return nil, shared.NewError(shared.ErrorCodeInvalidRequest, "joining group %s needs the verifier of its secret", name)
+	}
+
+	members, ok := server.groups[name]
+	if ok && len(members) > 0 && !hmac.Equal([]byte(server.groupVerifiers[name]), []byte(join.Verifier)) {
+		server.info("Group join with a wrong secret", "peer", rp.ID, "group", name)
+		return nil, shared.NewError(shared.ErrorCodeAuthFailed, "wrong secret for group %s", name)
+	}
+
+	if !ok {
+		members = make(map[string]bool)
+		server.groups[name] = members
+	}
+
+	if !members[rp.ID] && len(members) >= maxGroupMembers {
+		return nil, shared.NewError(shared.ErrorCodeLimitExceeded, "group %s is full", name)
+	}
+
+	if len(members) == 0 {
+		server.groupVerifiers[name] = join.Verifier
+	}
+
+	for id := range members {
+		if id == rp.ID {
+			continue
+		}
+
+		op, ok := peers[id]
+		if !ok {
+			delete(members, id)
+			continue
+		}
+
+		server.notifyMember(op, "group-join", name, rp)
+		server.notifyMember(rp, "group-join", name, op)
+	}
+
+	server.presenceChange(rp, func() {
+		members[rp.ID] = true
+	})
+	server.savePeer(rp.ID)
+
+	server.info("Peer joined group", "peer", rp.ID, "group", name)
+
+	// Confirm the join, without members
+	return &shared.Message{
+		Type:    "group-join",
+		Content: &shared.Group{Name: name},
+		Encrypt: true,
+	}, nil
+}
+
+func groupLeaveHandler(server *Server, peers shared.Peers, message *shared.Message) (*shared.Message, error) {
+	rp, ok := peers[message.PeerID]
+	if !ok {
+		return nil, shared.ErrNotRegistered
+	}
+
+	name, err := groupName(message.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	if !server.groups[name][rp.ID] {
+		return nil, shared.NewError(shared.ErrorCodeNotMember, "client is not a member of group %s", name)
+	}
+
+	server.leaveGroup(name, rp)
+
+	return &shared.Message{
+		Type:    "group-leave",
+		Content: &shared.Group{Name: name},
+		Encrypt: true,
+	}, nil
+}
+
+// Remove peer from the group and tell the remaining members, must be called with the mutex held
+func (server *Server) leaveGroup(name string, peer *shared.Peer) {
+	members := server.groups[name]
+	server.presenceChange(peer, func() {
+		delete(members, peer.ID)
+	})
+	server.savePeer(peer.ID)
+
+	server.info("Peer left group", "peer", peer.ID, "group", name)
+
+	if len(members) == 0 {
+		delete(server.groups, name)
+		delete(server.groupVerifiers, name)
+		return
+	}
+
+	for id := range members {
+		if member, ok := server.peers[id]; ok {
+			server.notifyMember(member, "group-leave", name, &shared.Peer{ID: peer.ID, Username: peer.Username})
+		}
+	}
+}
+
+// Remove peer from every group it is a member of, must be called with the mutex held
+func (server *Server) leaveGroups(peer *shared.Peer) {
+	for name, members := range server.groups {
+		if members[peer.ID] {
+			server.leaveGroup(name, peer)
+		}
+	}
+}
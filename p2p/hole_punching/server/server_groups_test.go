@@ -0,0 +1,189 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/mitchellh/mapstructure"
+
+	"p2p/shared"
+)
+
+func joinGroup(server *Server, conn *fakeConn, peerID string, name string, verifier string) (*shared.Message, error) {
+	return handle(server, conn, &shared.Message{
+		Type:    "group-join",
+		PeerID:  peerID,
+		Content: &shared.Group{Name: name, Verifier: verifier},
+	})
+}
+
+func leaveGroup(server *Server, conn *fakeConn, peerID string, name string) (*shared.Message, error) {
+	return handle(server, conn, &shared.Message{Type: "group-leave", PeerID: peerID, Content: name})
+}
+
+// Peers of the group events of this type received by conn
+func groupEvents(conn *fakeConn, messageType string) []*shared.Peer {
+	var peers []*shared.Peer
+	for _, message := range conn.received() {
+		var group shared.Group
+		if message.Type == messageType && mapstructure.Decode(message.Content, &group) == nil {
+			peers = append(peers, group.Members...)
+		}
+	}
+
+	return peers
+}
+
+// Wait for the group event of this type about the peer with this ID
+func waitGroupEvent(t testing.TB, conn *fakeConn, messageType string, peerID string) *shared.Peer {
+	t.Helper()
+
+	message := waitMessage(t, conn, messageType, func(message *shared.Message) bool {
+		var group shared.Group
+		return mapstructure.Decode(message.Content, &group) == nil && len(group.Members) == 1 && group.Members[0].ID == peerID
+	})
+
+	var group shared.Group
+	mapstructure.Decode(message.Content, &group)
+	return group.Members[0]
+}
+
+func TestGroupJoinNeedsTheSecret(t *testing.T) {
+	server := newTestServer(t)
+	listenTestServer(t, server)
+
+	alice := addListeningPeer(t, server, "alice")
+	mallory := addListeningPeer(t, server, "mallory")
+	bob := addListeningPeer(t, server, "bob")
+
+	if _, err := joinGroup(server, alice, "alice", "friends", "verifier"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the secret of the members, nobody learns an endpoint
+	_, err := joinGroup(server, mallory, "mallory", "friends", "guess")
+	if !errors.Is(err, shared.ErrAuthFailed) {
+		t.Fatalf("expected a wrong secret to be rejected, got %v", err)
+	}
+
+	if _, err := joinGroup(server, mallory, "mallory", "friends", ""); !errors.Is(err, shared.ErrInvalidRequest) {
+		t.Fatalf("expected a join without verifier to be rejected, got %v", err)
+	}
+
+	if _, err := joinGroup(server, bob, "bob", "friends", "verifier"); err != nil {
+		t.Fatal(err)
+	}
+
+	if peer := waitGroupEvent(t, bob, "group-join", "alice"); peer.Endpoint.Port != alice.addr.Port {
+		t.Fatalf("expected bob to learn the endpoint of alice, got %+v", peer)
+	}
+	waitGroupEvent(t, alice, "group-join", "bob")
+
+	// The events are sent in order, those of mallory would have come first
+	if peers := groupEvents(alice, "group-join"); len(peers) != 1 {
+		t.Fatalf("expected alice to be introduced to bob only, got %+v", peers)
+	}
+	if peers := groupEvents(mallory, "group-join"); len(peers) != 0 {
+		t.Fatalf("expected mallory to be introduced to nobody, got %+v", peers)
+	}
+
+	// Once the group is empty, the next member sets the secret
+	for id, conn := range map[string]*fakeConn{"alice": alice, "bob": bob} {
+		if _, err := leaveGroup(server, conn, id, "friends"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := joinGroup(server, mallory, "mallory", "friends", "guess"); err != nil {
+		t.Fatalf("expected the emptied group to take a new secret, got %v", err)
+	}
+	if _, err := joinGroup(server, alice, "alice", "friends", "verifier"); !errors.Is(err, shared.ErrAuthFailed) {
+		t.Fatalf("expected the old secret to be rejected, got %v", err)
+	}
+}
+
+func TestGroupJoinAndLeave(t *testing.T) {
+	server := newTestServer(t)
+	listenTestServer(t, server)
+
+	alice := addListeningPeer(t, server, "alice")
+	bob := addListeningPeer(t, server, "bob")
+
+	// The join is confirmed without members
+	res, err := joinGroup(server, alice, "alice", " friends ", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group := res.Content.(*shared.Group); group.Name != "friends" || len(group.Members) != 0 {
+		t.Fatalf("expected the join to be confirmed, got %+v", group)
+	}
+
+	if _, err := joinGroup(server, bob, "bob", "friends", "verifier"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both members are introduced to each other, with the keys they punch each other with
+	if peer := waitGroupEvent(t, alice, "group-join", "bob"); peer.Endpoint.Port != bob.addr.Port || peer.PublicKey != server.peers["bob"].PublicKey {
+		t.Fatalf("expected alice to be introduced to bob, got %+v", peer)
+	}
+	waitGroupEvent(t, bob, "group-join", "alice")
+
+	res, err = leaveGroup(server, bob, "bob", "friends")
+	if err != nil || res.Type != "group-leave" {
+		t.Fatalf("expected the leave to be confirmed, got %+v, %v", res, err)
+	}
+
+	// The leave notice only carries the public fields
+	if peer := waitGroupEvent(t, alice, "group-leave", "bob"); peer.Endpoint != (shared.Endpoint{}) {
+		t.Fatalf("expected the leave notice to leave the endpoint out, got %+v", peer)
+	}
+
+	if _, err := leaveGroup(server, bob, "bob", "friends"); !errors.Is(err, shared.ErrNotMember) {
+		t.Fatalf("expected bob to no longer be a member, got %v", err)
+	}
+
+	for _, name := range []string{"", strings.Repeat("a", maxGroupNameLength+1)} {
+		if _, err := joinGroup(server, bob, "bob", name, "verifier"); !errors.Is(err, shared.ErrInvalidRequest) {
+			t.Errorf("expected the group name %q to be rejected, got %v", name, err)
+		}
+	}
+
+	// A member going away leaves its groups
+	server.mutex.Lock()
+	server.removePeer(server.peers["alice"])
+	server.mutex.Unlock()
+
+	if _, ok := server.groups["friends"]; ok {
+		t.Fatal("expected the empty group to be removed")
+	}
+}
+
+func TestGroupFull(t *testing.T) {
+	server := newTestServer(t)
+
+	conns := make([]*fakeConn, maxGroupMembers)
+	for i := range conns {
+		conns[i] = addTestPeer(t, server, fmt.Sprintf("peer%d", i), fmt.Sprintf("192.0.2.1:%d", 4000+i))
+	}
+	late := addTestPeer(t, server, "late", "192.0.2.2:4000")
+
+	// Every member is told about every other one
+	listenTestServer(t, server)
+
+	for i, conn := range conns {
+		if _, err := joinGroup(server, conn, fmt.Sprintf("peer%d", i), "crowd", "verifier"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := joinGroup(server, late, "late", "crowd", "verifier"); !errors.Is(err, shared.ErrLimitExceeded) {
+		t.Fatalf("expected the full group to be rejected, got %v", err)
+	}
+
+	// Members can join again
+	if _, err := joinGroup(server, conns[0], "peer0", "crowd", "verifier"); err != nil {
+		t.Fatalf("expected a member to join again, got %v", err)
+	}
+}
@@ -2,10 +2,9 @@ package server
 
 import (
 	"encoding/base64"
-	"fmt"
-	"log"
+	"net"
 	"strconv"
-	"strings"
+	"time"
 
 	"github.com/mitchellh/mapstructure"
 
@@ -13,39 +12,202 @@ import (
 	"p2p/shared"
 )
 
-func createMessageCallback(server *Server, peers shared.Peers) func(conns shared.Conns, conn shared.Conn, message *shared.Message) {
-	return func(conns shared.Conns, conn shared.Conn, message *shared.Message) {
+func createMessageCallback(server *Server, peers shared.Peers) func(conn shared.Conn, message *shared.Message) {
+	return func(conn shared.Conn, message *shared.Message) {
 		// Log request
-		log.Printf("Request from client at %s over %s with type %s", conn.GetAddr(), conn.Protocol(), message.Type)
+		server.debug("Request", "addr", conn.GetAddr(), "protocol", conn.Protocol(), "type", message.Type, "peer", message.PeerID)
 
-		// Route request to a handler
-		res, err := route(server, peers, conns, conn, message)
+		// Sources which did not complete the greeting could be spoofed, never answer them
+		if message.Type != "greeting" && !server.isKnown(conn) {
+			server.stats.unknownSource.Add(1)
 
-		// Respond with error if there was one
-		if err != nil {
-			conn.Send(&shared.Message{
-				Type:  message.Type,
-				Error: err.Error(),
-			})
+			if message.PeerID != "" {
+				server.unknownSession(conn, len(message.PeerID))
+			}
 			return
 		}
 
-		// Respond
-		err = conn.Send(res)
-		if err != nil {
-			log.Print(err)
+		started := time.Now()
+
+		// The directory may be remote, requests naming a peer of another server are handled once it was looked up,
+		// off the worker so that the requests of the other sources are not held up
+		if id := server.remoteTarget(message); id != "" {
+			select {
+			case server.lookupSlots <- struct{}{}:
+			default:
+				server.debug("Dropped request, too many directory lookups", "addr", conn.GetAddr(), "type", message.Type)
+				return
+			}
+
+			server.lookups.Add(1)
+			go func() {
+				defer server.lookups.Done()
+
+				server.lookupTarget(id)
+				<-server.lookupSlots
+
+				serveRequest(server, peers, conn, message, started)
+			}()
+			return
+		}
+
+		serveRequest(server, peers, conn, message, started)
+	}
+}
+
+// Answer a request of a source which completed the greeting, the peer it names was looked up already
+func serveRequest(server *Server, peers shared.Peers, conn shared.Conn, message *shared.Message, started time.Time) {
+	server.mutex.Lock()
+
+	// Keep track of the activity of registered peers
+	if peer, ok := peers[message.PeerID]; ok && peer.Endpoint.String() == conn.GetAddr().String() {
+		peer.LastSeen = time.Now()
+	}
+
+	// Answer the retransmissions of a request with the answer of the first copy
+	if reply, ok := server.cachedReply(conn, message); ok {
+		server.mutex.Unlock()
+
+		server.debug("Answered retransmitted request", "addr", conn.GetAddr(), "type", message.Type, "requestID", message.RequestID)
+		conn.Send(reply)
+		return
+	}
+
+	// Route request to a handler
+	res, err := route(server, peers, conn, message)
+
+	// Answers echo the ID of the request
+	if err != nil {
+		server.cacheReply(conn, message, errorReply(message, err))
+	} else if res != nil {
+		res.RequestID = message.RequestID
+		server.cacheReply(conn, message, res)
+	}
+
+	updated := len(server.updates) > 0
+	server.mutex.Unlock()
+
+	if updated {
+		server.syncDirectory()
+	}
+
+	server.observeRequest(message.Type, started, err)
+
+	// Respond with error if there was one, only to sources which completed the greeting.
+	// The servers of the cluster do not answer each other's errors.
+	if err != nil {
+		if server.members[conn.GetAddr().String()] {
+			server.error("Request failed", "addr", conn.GetAddr(), "type", message.Type, "err", err)
+			return
 		}
+
+		if !server.isKnown(conn) {
+			server.debug("Dropped request", "addr", conn.GetAddr(), "type", message.Type, "err", err)
+			return
+		}
+
+		conn.Send(errorReply(message, err))
+		return
+	}
+
+	// Requests forwarded to another server are answered by it
+	if res == nil {
+		return
+	}
+
+	// Respond
+	err = conn.Send(res)
+	if err != nil {
+		server.error("Could not send response", "addr", conn.GetAddr(), "type", res.Type, "err", err)
+	}
+}
+
+// Requests of registered peers, acting on behalf of the peer set in the message
+var peerRequests = map[string]bool{
+	"establish":   true,
+	"consent":     true,
+	"resume":      true,
+	"keepalive":   true,
+	"code-create": true,
+	"code-join":   true,
+	"group-join":  true,
+	"group-leave": true,
+	"list":        true,
+	"lookup":      true,
+	"subscribe":   true,
+	"unsubscribe": true,
+	"bye":         true,
+}
+
+// Ensure a request was sent by the registered peer it names, from the endpoint it registered from and over
+// its encrypted channel, so that another source cannot act on its behalf. Must be called with the mutex held.
+func (server *Server) authenticate(peers shared.Peers, conn shared.Conn, message *shared.Message) error {
+	peer, ok := peers[message.PeerID]
+	if !ok {
+		return shared.ErrNotRegistered
+	}
+
+	if !message.Encrypt || peer.Endpoint.String() != conn.GetAddr().String() {
+		return shared.NewError(shared.ErrorCodeAuthFailed, "%s request not sent by peer %s", message.Type, peer.ID)
 	}
+
+	return nil
 }
 
-func route(server *Server, peers shared.Peers, conns shared.Conns, conn shared.Conn, message *shared.Message) (*shared.Message, error) {
+func route(server *Server, peers shared.Peers, conn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	if peerRequests[message.Type] {
+		if err := server.authenticate(peers, conn, message); err != nil {
+			return nil, err
+		}
+	}
+
 	switch message.Type {
 	case "greeting":
 		return greetingHandler(server, conn, message)
 	case "register":
-		return registerHandler(peers, conn, message)
+		return registerHandler(server, peers, conn, message)
 	case "establish":
-		return establishHandler(peers, conns, message)
+		if err := server.allowIntroduction(conn); err != nil {
+			return nil, err
+		}
+		return establishHandler(server, peers, message)
+	case "consent":
+		return consentHandler(server, peers, message)
+	case "resume":
+		if err := server.allowIntroduction(conn); err != nil {
+			return nil, err
+		}
+		return resumeHandler(server, peers, message)
+	case "keepalive":
+		return keepaliveHandler(peers, conn, message)
+	case "bye":
+		return byeHandler(server, peers, message)
+	case "code-create":
+		return codeCreateHandler(server, peers, message)
+	case "code-join":
+		if err := server.allowIntroduction(conn); err != nil {
+			return nil, err
+		}
+		return codeJoinHandler(server, peers, message)
+	case "group-join":
+		if err := server.allowIntroduction(conn); err != nil {
+			return nil, err
+		}
+		return groupJoinHandler(server, peers, message)
+	case "group-leave":
+		return groupLeaveHandler(server, peers, message)
+	case "list":
+		return listHandler(server, peers, message)
+	case "lookup":
+		return lookupHandler(server, peers, message)
+	case "subscribe":
+		return subscribeHandler(server, peers, message)
+	case "unsubscribe":
+		return unsubscribeHandler(server, peers, message)
+	case "cluster-establish":
+		return clusterEstablishHandler(server, peers, conn, message)
+	case "cluster-forward":
+		return clusterForwardHandler(server, peers, conn, message)
 	default:
 		return notFoundHandler(message)
 	}
@@ -53,15 +215,47 @@ func route(server *Server, peers shared.Peers, conns shared.Conns, conn shared.C
 
 func greetingHandler(server *Server, conn shared.Conn, message *shared.Message) (*shared.Message, error) {
 	// Ensure that public key was sent in greeting request
-	str, ok := message.Content.(string)
-	if !ok {
-		return nil, fmt.Errorf("greeting request must contain client's public key")
+	var greeting shared.Greeting
+	err := mapstructure.Decode(message.Content, &greeting)
+	if err != nil || greeting.PublicKey == "" {
+		return nil, shared.NewError(shared.ErrorCodeMalformed, "greeting request must contain client's public key")
 	}
 
-	// Get public key contained in content
-	bs, err := base64.StdEncoding.DecodeString(str)
-	if err != nil {
-		return nil, err
+	// Get public key contained in content, checked first so that a greeting is always larger than the cookie
+	bs, err := base64.StdEncoding.DecodeString(greeting.PublicKey)
+	if err != nil || len(bs) != 32 {
+		return nil, shared.NewError(shared.ErrorCodeMalformed, "malformed public key")
+	}
+
+	addr := conn.GetAddr().(*net.UDPAddr)
+	now := time.Now()
+
+	// Answer with a cookie, smaller than the greeting, until the client proves it owns its source address
+	if !server.validCookie(addr, greeting.Cookie, now) {
+		if greeting.Cookie != "" {
+			server.stats.invalidCookie.Add(1)
+		}
+
+		return &shared.Message{
+			Type:    "cookie",
+			Content: server.genCookie(addr, now),
+		}, nil
+	}
+
+	// Keep the conn until the client registers
+	if !server.isKnown(conn) {
+		maxConns := server.GetOptions().MaxConnsPerIP
+		if maxConns > 0 && server.transport.CountConns(addr.IP.String()) >= maxConns {
+			server.stats.connLimited.Add(1)
+			return nil, shared.NewError(shared.ErrorCodeLimitExceeded, "too many conns from %s", addr.IP)
+		}
+
+		conn, err = server.transport.CreateConn(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		server.handshakes[addr.String()] = now
 	}
 
 	// Create shared secret from private key and peer public key
@@ -69,6 +263,9 @@ func greetingHandler(server *Server, conn shared.Conn, message *shared.Message)
 	copy(clientPubKey[:], bs[:])
 	conn.SetSecret(crypto.GenSharedSecret(server.privateKey, clientPubKey))
 
+	// A new session, the answers to the requests of the previous one must not answer its requests
+	server.forgetReplies(addr.String())
+
 	// Send greeting response
 	return &shared.Message{
 		Type:    "greeting",
@@ -77,75 +274,144 @@ func greetingHandler(server *Server, conn shared.Conn, message *shared.Message)
 }
 
 // Register the requesting peer in the server
-func registerHandler(peers shared.Peers, conn shared.Conn, message *shared.Message) (*shared.Message, error) {
+func registerHandler(server *Server, peers shared.Peers, conn shared.Conn, message *shared.Message) (*shared.Message, error) {
 	// Map -> structure the content
 	var registration shared.Registration
 	err := mapstructure.Decode(message.Content, &registration)
+	if err != nil {
+		return nil, shared.ErrMalformed
+	}
+
+	if fingerprint := (&shared.Peer{IdentityKey: registration.IdentityKey}).Fingerprint(); fingerprint != "" &&
+		server.isBanned("identity", fingerprint, time.Now()) {
+		server.stats.banned.Add(1)
+		return nil, shared.NewError(shared.ErrorCodeBanned, "identity key is banned from this server")
+	}
+
+	err = server.reserve(conn, message, &registration)
 	if err != nil {
 		return nil, err
 	}
 
 	// Register peer
-	endpoint := strings.Split(conn.GetAddr().String(), ":")
-	if len(endpoint) != 2 {
-		return nil, fmt.Errorf("address is not valid")
+	host, portString, err := net.SplitHostPort(conn.GetAddr().String())
+	if err != nil {
+		return nil, shared.NewError(shared.ErrorCodeInvalidRequest, "address is not valid")
 	}
 
-	port, err := strconv.Atoi(endpoint[1])
+	port, err := strconv.Atoi(portString)
 	if err != nil {
 		return nil, err
 	}
 
-	peers[message.PeerID] = &shared.Peer{
-		ID:       message.PeerID,
-		Username: registration.Username,
+	if maxPeers := server.GetOptions().MaxPeersPerIP; maxPeers > 0 {
+		count := 0
+		for id, peer := range peers {
+			if id != message.PeerID && peer.Endpoint.IP == host {
+				count += 1
+			}
+		}
+
+		if count >= maxPeers {
+			server.stats.peerLimited.Add(1)
+			return nil, shared.NewError(shared.ErrorCodeLimitExceeded, "too many peers registered from %s", host)
+		}
+	}
+
+	history, ok := server.endpoints[message.PeerID]
+	if !ok {
+		history = &endpointHistory{registeredAt: time.Now()}
+		server.endpoints[message.PeerID] = history
+	}
+
+	// The peer registers again from another endpoint after a network change, its old conn is stale
+	if previous, ok := peers[message.PeerID]; ok && previous.Endpoint.String() != conn.GetAddr().String() {
+		server.transport.DeleteConn(previous.Endpoint.String())
+		history.previous = previous.Endpoint.String()
+		history.changes += 1
+	}
+
+	peer := &shared.Peer{
+		ID:          message.PeerID,
+		Username:    registration.Username,
+		Namespace:   registration.Namespace,
+		PublicKey:   registration.PublicKey,
+		IdentityKey: registration.IdentityKey,
 		Endpoint: shared.Endpoint{
-			IP:   endpoint[0],
+			IP:   host,
 			Port: port,
 		},
+		LastSeen: time.Now(),
+		Visible:  registration.Visible,
 	}
 
-	log.Printf("Registered peer: %s at addr %s", message.PeerID, conn.GetAddr().String())
+	server.presenceChange(peer, func() {
+		peers[message.PeerID] = peer
+	})
+	delete(server.handshakes, conn.GetAddr().String())
+	server.publish(peer)
+	server.savePeer(peer.ID)
 
-	// Confirm registry to peer
+	server.metrics.registrations.Inc()
+	server.info("Registered peer", "peer", message.PeerID, "addr", conn.GetAddr())
+
+	// Confirm registry to peer, with the endpoint we see it at so that it notices when it changes
 	return &shared.Message{
 		Type:    "register",
+		Content: &peer.Endpoint,
 		Encrypt: true,
 	}, nil
 }
 
-// Facilitate in the establishing of the p2p connection
-func establishHandler(peers shared.Peers, conns shared.Conns, message *shared.Message) (*shared.Message, error) {
+// Facilitate in the establishing of the p2p connection, once the other peer consents
+func establishHandler(server *Server, peers shared.Peers, message *shared.Message) (*shared.Message, error) {
 	// Make sure requesting peer has registered with server
 	rp, ok := peers[message.PeerID]
 	if !ok {
-		return nil, fmt.Errorf("client is not registered with this server")
+		return nil, shared.ErrNotRegistered
 	}
 
 	// Make sure that a valid payload was sent
 	id, ok := message.Content.(string)
 	if !ok {
-		return nil, fmt.Errorf("request content is malformed")
+		return nil, shared.ErrMalformed
 	}
 
-	// Make sure the other peer has registered with the server
-	op, ok := peers[id]
+	// Make sure the other peer has registered with the server, or another server of the cluster
+	op, owner, ok := server.findPeer(id)
 	if !ok {
-		return nil, fmt.Errorf("peer: %s has not registered with the server", id)
+		return nil, shared.NewError(shared.ErrorCodeUnknownPeer, "peer: %s has not registered with the server", id)
 	}
 
-	// Get conn for other peer
-	conn, ok := conns[op.Endpoint.String()]
-	if !ok {
-		return nil, fmt.Errorf("could not resolve the peer: %s's conn", id)
+	if op.ID == rp.ID {
+		return nil, shared.NewError(shared.ErrorCodeInvalidRequest, "cannot establish a connection with yourself")
+	}
+
+	// The server of the other peer asks for its consent and answers
+	if owner != "" {
+		return nil, server.sendMember(owner, &shared.Message{
+			Type:    "cluster-establish",
+			Content: &shared.ClusterEstablish{From: rp.ID, To: op.ID, RequestID: message.RequestID},
+		})
 	}
 
+	return server.requestConsent(rp, op, message.RequestID)
+}
+
+// Send each peer the endpoint of the other one, requestID is the ID of the establish request of the other peer if it sent one
+func introduce(server *Server, rp *shared.Peer, op *shared.Peer, requestID uint64) (*shared.Message, error) {
 	// Send requesting peer's endpoint to other peer
-	conn.Send(&shared.Message{
-		Type:    "establish",
-		Content: rp,
-		Encrypt: true,
+	err := server.sendTo(op, &shared.Message{
+		Type:      "establish",
+		RequestID: requestID,
+		Content:   rp,
+		Encrypt:   true,
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	server.info("Introduced peers", "peer", rp.ID, "target", op.ID, "session", shared.SessionID(rp.ID, op.ID))
 
 	// Send requesting peer other peer's endpoint
 	return &shared.Message{
@@ -155,6 +421,94 @@ func establishHandler(peers shared.Peers, conns shared.Conns, message *shared.Me
 	}, nil
 }
 
+// Create a pairing code that another peer can join instead of exchanging peer IDs
+func codeCreateHandler(server *Server, peers shared.Peers, message *shared.Message) (*shared.Message, error) {
+	if _, ok := peers[message.PeerID]; !ok {
+		return nil, shared.ErrNotRegistered
+	}
+
+	// A peer has at most one active code
+	for nameplate, pairing := range server.codes {
+		if pairing.peerID == message.PeerID {
+			delete(server.codes, nameplate)
+		}
+	}
+
+	nameplate, err := server.genNameplate()
+	if err != nil {
+		return nil, err
+	}
+
+	server.codes[nameplate] = &pairingCode{
+		peerID:  message.PeerID,
+		expires: time.Now().Add(server.GetOptions().CodeTimeout),
+	}
+
+	// The peer appends the password words to the nameplate
+	return &shared.Message{
+		Type:    "code-create",
+		Content: nameplate,
+		Encrypt: true,
+	}, nil
+}
+
+// Join the pairing code of another peer by its nameplate, which introduces both peers to each other
+func codeJoinHandler(server *Server, peers shared.Peers, message *shared.Message) (*shared.Message, error) {
+	rp, ok := peers[message.PeerID]
+	if !ok {
+		return nil, shared.ErrNotRegistered
+	}
+
+	code, ok := message.Content.(string)
+	if !ok {
+		return nil, shared.ErrMalformed
+	}
+	nameplate := nameplateOf(code)
+
+	pairing, ok := server.codes[nameplate]
+	if !ok || time.Now().After(pairing.expires) {
+		// The error never carries the code, it ends up in the logs of both sides
+		return nil, shared.ErrInvalidCode
+	}
+
+	if pairing.peerID == message.PeerID {
+		return nil, shared.NewError(shared.ErrorCodeInvalidRequest, "cannot join your own pairing code")
+	}
+
+	// Codes can only be used once
+	delete(server.codes, nameplate)
+
+	op, ok := peers[pairing.peerID]
+	if !ok {
+		return nil, shared.NewError(shared.ErrorCodeUnknownPeer, "peer who created the pairing code is no longer registered")
+	}
+
+	return introduce(server, rp, op, 0)
+}
+
+// Keep the registration and the NAT mapping of the requesting peer alive
+func keepaliveHandler(peers shared.Peers, conn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	if _, ok := peers[message.PeerID]; !ok {
+		return nil, shared.ErrNotRegistered
+	}
+
+	return &shared.Message{
+		Type:    "keepalive",
+		Encrypt: true,
+	}, nil
+}
+
+// Unregister the requesting peer, which is leaving. It is not answered.
+func byeHandler(server *Server, peers shared.Peers, message *shared.Message) (*shared.Message, error) {
+	peer := peers[message.PeerID]
+
+	server.removePeer(peer)
+
+	server.info("Peer said bye", "peer", peer.ID)
+
+	return nil, nil
+}
+
 func notFoundHandler(message *shared.Message) (*shared.Message, error) {
-	return nil, fmt.Errorf("request type %s undefined", message.Type)
+	return nil, shared.NewError(shared.ErrorCodeUnknownType, "request type %s undefined", message.Type)
 }
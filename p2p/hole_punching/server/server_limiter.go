@@ -0,0 +1,155 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Buckets idle for this long are full again and can be forgotten
+	bucketIdleTimeout = time.Minute
+	// Buckets kept at most, the least recently used are forgotten first so that spoofed source IPs cannot exhaust the memory
+	maxBuckets = 1 << 16
+)
+
+type bucket struct {
+	ip     string
+	tokens float64
+	last   time.Time
+}
+
+// Token bucket rate limiter keyed by source IP
+type rateLimiter struct {
+	mutex   *sync.Mutex
+	rate    float64
+	burst   int
+	buckets map[string]*list.Element
+	// Buckets from the most to the least recently used
+	recent *list.List
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	limiter := &rateLimiter{
+		mutex:   &sync.Mutex{},
+		buckets: make(map[string]*list.Element),
+		recent:  list.New(),
+	}
+	limiter.configure(rate, burst)
+
+	return limiter
+}
+
+func (limiter *rateLimiter) configure(rate float64, burst int) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	limiter.rate = rate
+	limiter.burst = burst
+}
+
+func (limiter *rateLimiter) allow(ip string, now time.Time) bool {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	if limiter.rate <= 0 {
+		return true
+	}
+
+	element, ok := limiter.buckets[ip]
+	if ok {
+		limiter.recent.MoveToFront(element)
+	} else {
+		if limiter.recent.Len() >= maxBuckets {
+			limiter.forget(limiter.recent.Back())
+		}
+
+		element = limiter.recent.PushFront(&bucket{ip: ip, tokens: float64(limiter.burst), last: now})
+		limiter.buckets[ip] = element
+	}
+	b := element.Value.(*bucket)
+
+	// Refill since the last datagram
+	b.tokens += now.Sub(b.last).Seconds() * limiter.rate
+	if b.tokens > float64(limiter.burst) {
+		b.tokens = float64(limiter.burst)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens -= 1
+	return true
+}
+
+// Must be called with the mutex held
+func (limiter *rateLimiter) forget(element *list.Element) {
+	limiter.recent.Remove(element)
+	delete(limiter.buckets, element.Value.(*bucket).ip)
+}
+
+// The idle buckets are the least recently used ones
+func (limiter *rateLimiter) prune(now time.Time) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	for {
+		element := limiter.recent.Back()
+		if element == nil || now.Sub(element.Value.(*bucket).last) <= bucketIdleTimeout {
+			return
+		}
+
+		limiter.forget(element)
+	}
+}
+
+// Counters of the traffic dropped or rejected by the abuse protections
+type Stats struct {
+	// Datagrams above the rate limit of their source IP
+	RateLimited uint64 `json:"rateLimited"`
+	// Messages from sources that did not complete the greeting
+	UnknownSource uint64 `json:"unknownSource"`
+	// Datagrams that are not valid messages
+	Malformed uint64 `json:"malformed"`
+	// Greetings with an invalid or expired cookie
+	InvalidCookie uint64 `json:"invalidCookie"`
+	// Greetings above the conns per IP cap
+	ConnLimited uint64 `json:"connLimited"`
+	// Registrations above the peers per IP cap
+	PeerLimited uint64 `json:"peerLimited"`
+	// Establish, code-join and group-join requests above the introduction rate limit
+	IntroductionLimited uint64 `json:"introductionLimited"`
+	// Datagrams from banned IPs and registrations of banned identity keys
+	Banned uint64 `json:"banned"`
+}
+
+type stats struct {
+	rateLimited         atomic.Uint64
+	unknownSource       atomic.Uint64
+	malformed           atomic.Uint64
+	invalidCookie       atomic.Uint64
+	connLimited         atomic.Uint64
+	peerLimited         atomic.Uint64
+	introductionLimited atomic.Uint64
+	banned              atomic.Uint64
+}
+
+func (stats *stats) snapshot() Stats {
+	return Stats{
+		RateLimited:         stats.rateLimited.Load(),
+		UnknownSource:       stats.unknownSource.Load(),
+		Malformed:           stats.malformed.Load(),
+		InvalidCookie:       stats.invalidCookie.Load(),
+		ConnLimited:         stats.connLimited.Load(),
+		PeerLimited:         stats.peerLimited.Load(),
+		IntroductionLimited: stats.introductionLimited.Load(),
+		Banned:              stats.banned.Load(),
+	}
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(1, 2)
+	now := time.Now()
+
+	if !limiter.allow("192.0.2.1", now) || !limiter.allow("192.0.2.1", now) {
+		t.Fatal("expected the burst to be allowed")
+	}
+
+	if limiter.allow("192.0.2.1", now) {
+		t.Fatal("expected the datagram above the burst to be dropped")
+	}
+
+	if !limiter.allow("192.0.2.2", now) {
+		t.Fatal("expected another IP to have its own bucket")
+	}
+
+	if !limiter.allow("192.0.2.1", now.Add(time.Second)) {
+		t.Fatal("expected the bucket to refill")
+	}
+}
+
+func TestRateLimiterIsBounded(t *testing.T) {
+	limiter := newRateLimiter(1, 1)
+	now := time.Now()
+
+	// The first IP exhausts its bucket, then spoofed IPs flood the limiter
+	limiter.allow("192.0.2.1", now)
+	for i := range maxBuckets + 100 {
+		limiter.allow("10.0."+strconv.Itoa(i/256)+"."+strconv.Itoa(i%256), now)
+	}
+
+	if n := len(limiter.buckets); n != maxBuckets || limiter.recent.Len() != maxBuckets {
+		t.Fatalf("expected %d buckets, got %d", maxBuckets, n)
+	}
+
+	// The least recently used buckets were forgotten first
+	if _, ok := limiter.buckets["192.0.2.1"]; ok {
+		t.Fatal("expected the least recently used bucket to be forgotten")
+	}
+
+	if _, ok := limiter.buckets["10.0.0.0"]; ok {
+		t.Fatal("expected the oldest spoofed IPs to be forgotten")
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	limiter := newRateLimiter(1, 1)
+	now := time.Now()
+
+	limiter.allow("192.0.2.1", now)
+	limiter.allow("192.0.2.2", now.Add(bucketIdleTimeout))
+
+	limiter.prune(now.Add(bucketIdleTimeout + time.Second))
+
+	if _, ok := limiter.buckets["192.0.2.1"]; ok {
+		t.Fatal("expected the idle bucket to be pruned")
+	}
+
+	if _, ok := limiter.buckets["192.0.2.2"]; !ok {
+		t.Fatal("expected the recent bucket to be kept")
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	"p2p/metrics"
+)
+
+// Types of the requests the server answers, the others are counted as unknown so that clients cannot add series
+var messageTypes = map[string]bool{
+	"greeting":          true,
+	"register":          true,
+	"establish":         true,
+	"consent":           true,
+	"resume":            true,
+	"keepalive":         true,
+	"bye":               true,
+	"code-create":       true,
+	"code-join":         true,
+	"group-join":        true,
+	"group-leave":       true,
+	"list":              true,
+	"lookup":            true,
+	"subscribe":         true,
+	"unsubscribe":       true,
+	"cluster-establish": true,
+	"cluster-forward":   true,
+}
+
+// Buckets of the consent latency, people take seconds to answer
+var consentBuckets = []float64{0.5, 1, 2.5, 5, 10, 15, 30, 60, 120}
+
+type serverMetrics struct {
+	registrations *metrics.Counter
+	// Requests and failed requests by type
+	messages *metrics.Counter
+	errors   *metrics.Counter
+	duration *metrics.Histogram
+	// Establish requests by result: accepted, declined or timeout
+	establishments *metrics.Counter
+	// Time the targets took to accept or decline an establish request
+	consentLatency *metrics.Histogram
+}
+
+// Export the metrics of the server to the registry, must be called before Listen.
+// The series are labelled with the listen address, several servers can share a registry.
+func (server *Server) SetMetrics(registry *metrics.Registry) {
+	labels := metrics.Labels{"server": server.LocalAddr().String()}
+
+	server.metrics = &serverMetrics{
+		registrations:  registry.Counter("rdv_registrations_total", "Successful registrations, including the ones repeated after a server restart or a network change.", labels),
+		messages:       registry.Counter("rdv_messages_total", "Requests received, by type.", labels, "type"),
+		errors:         registry.Counter("rdv_errors_total", "Requests answered with an error, by type.", labels, "type"),
+		duration:       registry.Histogram("rdv_request_duration_seconds", "Time spent handling a request.", labels, nil),
+		establishments: registry.Counter("rdv_establish_total", "Establish requests by result: accepted, declined or timeout.", labels, "result"),
+		consentLatency: registry.Histogram("rdv_consent_duration_seconds", "Time the targets of establish requests took to accept or decline.", labels, consentBuckets),
+	}
+
+	registry.GaugeFunc("rdv_active_peers", "Peers registered with this server.", labels, func() float64 {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+
+		return float64(len(server.peers))
+	})
+
+	registry.GaugeFunc("rdv_send_queue_length", "Datagrams waiting to be written to the socket.", labels, func() float64 {
+		return float64(server.transport.QueueLength())
+	})
+
+	dropped := []struct {
+		reason  string
+		counter *atomic.Uint64
+	}{
+		{"rate_limited", &server.stats.rateLimited},
+		{"unknown_source", &server.stats.unknownSource},
+		{"malformed", &server.stats.malformed},
+		{"invalid_cookie", &server.stats.invalidCookie},
+		{"conn_limited", &server.stats.connLimited},
+		{"peer_limited", &server.stats.peerLimited},
+		{"introduction_limited", &server.stats.introductionLimited},
+		{"banned", &server.stats.banned},
+	}
+
+	for _, drop := range dropped {
+		registry.CounterFunc("rdv_dropped_total", "Traffic dropped or rejected by the abuse protections, by reason.",
+			metrics.Labels{"server": server.LocalAddr().String(), "reason": drop.reason}, func() float64 { return float64(drop.counter.Load()) })
+	}
+}
+
+func (server *Server) observeRequest(messageType string, started time.Time, err error) {
+	if !messageTypes[messageType] {
+		messageType = "unknown"
+	}
+
+	server.metrics.messages.Inc(messageType)
+	if err != nil {
+		server.metrics.errors.Inc(messageType)
+	}
+	server.metrics.duration.Observe(time.Since(started))
+}
+
+// Count the answer to an establish request, with the time the target took to give it
+func (server *Server) observeConsent(request *establishRequest, result string, now time.Time) {
+	server.metrics.establishments.Inc(result)
+	if result != "timeout" {
+		server.metrics.consentLatency.Observe(now.Sub(request.created))
+	}
+}
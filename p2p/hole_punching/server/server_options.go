@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelError
+)
+
+func (level LogLevel) slogLevel() slog.Level {
+	switch level {
+	case LogLevelDebug:
+		return slog.LevelDebug
+	case LogLevelError:
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+func ParseLogLevel(level string) (LogLevel, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return LogLevelDebug, nil
+	case "info", "":
+		return LogLevelInfo, nil
+	case "error":
+		return LogLevelError, nil
+	default:
+		return LogLevelInfo, fmt.Errorf("unknown log level %s", level)
+	}
+}
+
+type Options struct {
+	// Registered peers not seen for this long are removed, 0 keeps them forever
+	PeerTimeout time.Duration
+	// Pairing codes can be joined for this long after their creation
+	CodeTimeout time.Duration
+	// Establish requests can be accepted by their target for this long
+	RequestTimeout time.Duration
+	// Usernames are released when nobody registered with them for this long, 0 keeps them forever
+	ReservationTimeout time.Duration
+	// Datagrams per second accepted from a single IP, 0 disables rate limiting
+	RateLimit float64
+	// Datagrams a single IP can send in a burst above the rate limit
+	RateBurst int
+	// Establish, code-join and group-join requests per second accepted from a single IP, 0 disables the limit
+	IntroductionRate  float64
+	IntroductionBurst int
+	// Conns and registered peers a single IP can have, 0 is unlimited
+	MaxConnsPerIP int
+	MaxPeersPerIP int
+	LogLevel      LogLevel
+}
+
+func DefaultOptions() Options {
+	return Options{
+		PeerTimeout:        0,
+		CodeTimeout:        10 * time.Minute,
+		RequestTimeout:     time.Minute,
+		ReservationTimeout: 30 * 24 * time.Hour,
+		RateLimit:          0,
+		RateBurst:          0,
+		IntroductionRate:   0,
+		IntroductionBurst:  0,
+		MaxConnsPerIP:      0,
+		MaxPeersPerIP:      0,
+		LogLevel:           LogLevelInfo,
+	}
+}
+
+// Logs below the level of the options are dropped before they reach the logger
+func (server *Server) log(level LogLevel, msg string, args ...any) {
+	if level < server.GetOptions().LogLevel {
+		return
+	}
+
+	server.logger.Log(context.Background(), level.slogLevel(), msg, args...)
+}
+
+func (server *Server) debug(msg string, args ...any) {
+	server.log(LogLevelDebug, msg, args...)
+}
+
+func (server *Server) info(msg string, args ...any) {
+	server.log(LogLevelInfo, msg, args...)
+}
+
+func (server *Server) error(msg string, args ...any) {
+	server.log(LogLevelError, msg, args...)
+}
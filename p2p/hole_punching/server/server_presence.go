@@ -0,0 +1,174 @@
+package server
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+
+	"p2p/shared"
+)
+
+// Peers per list response, so that a page fits in a datagram
+const maxListPeers = 8
+
+// Only the identity of a peer is public, never its endpoint
+func publicPeer(peer *shared.Peer) *shared.Peer {
+	return &shared.Peer{
+		ID:          peer.ID,
+		Username:    peer.Username,
+		Namespace:   peer.Namespace,
+		IdentityKey: peer.IdentityKey,
+	}
+}
+
+// Whether the peer with this ID is online, visible and matches filter, must be called with the mutex held
+func (server *Server) matches(peerID string, filter *shared.PeerFilter) bool {
+	peer, ok := server.peers[peerID]
+	if !ok || !peer.Visible {
+		return false
+	}
+
+	if filter.Username != "" && !strings.HasPrefix(strings.ToLower(peer.Username), strings.ToLower(filter.Username)) {
+		return false
+	}
+
+	if filter.Group != "" && !server.groups[filter.Group][peer.ID] {
+		return false
+	}
+
+	return true
+}
+
+// Apply change and push a presence message to every subscriber whose filter the peer entered or left,
+// must be called with the mutex held
+func (server *Server) presenceChange(peer *shared.Peer, change func()) {
+	before := make(map[string]bool, len(server.subscriptions))
+	for id, filter := range server.subscriptions {
+		before[id] = server.matches(peer.ID, filter)
+	}
+
+	change()
+
+	for id, filter := range server.subscriptions {
+		online := server.matches(peer.ID, filter)
+		if id == peer.ID || online == before[id] {
+			continue
+		}
+
+		if subscriber, ok := server.peers[id]; ok {
+			server.sendTo(subscriber, &shared.Message{
+				Type:    "presence",
+				Content: &shared.Presence{Peer: publicPeer(peer), Online: online},
+				Encrypt: true,
+			})
+		}
+	}
+}
+
+// List the online visible peers matching the filter, by page
+func listHandler(server *Server, peers shared.Peers, message *shared.Message) (*shared.Message, error) {
+	if _, ok := peers[message.PeerID]; !ok {
+		return nil, shared.ErrNotRegistered
+	}
+
+	var filter shared.PeerFilter
+	err := mapstructure.Decode(message.Content, &filter)
+	if err != nil {
+		return nil, shared.ErrMalformed
+	}
+
+	var matching []*shared.Peer
+	for id, peer := range peers {
+		if id != message.PeerID && server.matches(id, &filter) {
+			matching = append(matching, publicPeer(peer))
+		}
+	}
+
+	sort.Slice(matching, func(i, j int) bool {
+		if matching[i].Username != matching[j].Username {
+			return matching[i].Username < matching[j].Username
+		}
+		return matching[i].ID < matching[j].ID
+	})
+
+	list := &shared.PeerList{Peers: []*shared.Peer{}}
+	if filter.Offset >= 0 && filter.Offset < len(matching) {
+		end := min(filter.Offset+maxListPeers, len(matching))
+		list.Peers = matching[filter.Offset:end]
+		list.More = end < len(matching)
+	}
+
+	return &shared.Message{
+		Type:    "list",
+		Content: list,
+		Encrypt: true,
+	}, nil
+}
+
+// Look up a visible peer by ID or by username
+func lookupHandler(server *Server, peers shared.Peers, message *shared.Message) (*shared.Message, error) {
+	if _, ok := peers[message.PeerID]; !ok {
+		return nil, shared.ErrNotRegistered
+	}
+
+	var lookup shared.Lookup
+	err := mapstructure.Decode(message.Content, &lookup)
+	if err != nil {
+		return nil, shared.ErrMalformed
+	}
+
+	id, name := lookup.ID, lookup.ID
+	if lookup.Username != "" {
+		id, name = "", lookup.Username
+		if peer, ok := server.lookupUsername(lookup.Namespace, lookup.Username); ok {
+			id = peer.ID
+		}
+	}
+
+	if !server.matches(id, &shared.PeerFilter{}) {
+		return nil, shared.NewError(shared.ErrorCodeUnknownPeer, "peer %s not found", name)
+	}
+
+	return &shared.Message{
+		Type:    "lookup",
+		Content: publicPeer(peers[id]),
+		Encrypt: true,
+	}, nil
+}
+
+// Push the presence changes of the visible peers matching the filter to the requesting peer,
+// a new subscription replaces the previous one
+func subscribeHandler(server *Server, peers shared.Peers, message *shared.Message) (*shared.Message, error) {
+	if _, ok := peers[message.PeerID]; !ok {
+		return nil, shared.ErrNotRegistered
+	}
+
+	var filter shared.PeerFilter
+	err := mapstructure.Decode(message.Content, &filter)
+	if err != nil {
+		return nil, shared.ErrMalformed
+	}
+
+	server.subscriptions[message.PeerID] = &filter
+	server.savePeer(message.PeerID)
+
+	return &shared.Message{
+		Type:    "subscribe",
+		Encrypt: true,
+	}, nil
+}
+
+func unsubscribeHandler(server *Server, peers shared.Peers, message *shared.Message) (*shared.Message, error) {
+	if _, ok := peers[message.PeerID]; !ok {
+		return nil, shared.ErrNotRegistered
+	}
+
+	delete(server.subscriptions, message.PeerID)
+	server.savePeer(message.PeerID)
+
+	return &shared.Message{
+		Type:    "unsubscribe",
+		Encrypt: true,
+	}, nil
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/mitchellh/mapstructure"
+
+	"p2p/shared"
+)
+
+func listPeers(t testing.TB, server *Server, conn *fakeConn, peerID string, filter shared.PeerFilter) *shared.PeerList {
+	t.Helper()
+
+	res, err := handle(server, conn, &shared.Message{Type: "list", PeerID: peerID, Content: &filter})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res.Content.(*shared.PeerList)
+}
+
+func usernames(peers []*shared.Peer) string {
+	names := make([]string, len(peers))
+	for i, peer := range peers {
+		names[i] = peer.Username
+	}
+
+	return fmt.Sprint(names)
+}
+
+// Set whether the registered peer is listed and looked up
+func setVisible(server *Server, id string, visible bool) {
+	server.mutex.Lock()
+	server.peers[id].Visible = visible
+	server.mutex.Unlock()
+}
+
+func TestList(t *testing.T) {
+	server := newTestServer(t)
+	alice := addTestPeer(t, server, "alice", "192.0.2.1:4000")
+
+	for i := range maxListPeers + 2 {
+		id := fmt.Sprintf("peer%02d", i)
+		addTestPeer(t, server, id, fmt.Sprintf("192.0.2.2:%d", 4000+i))
+		setVisible(server, id, true)
+	}
+	addTestPeer(t, server, "hidden", "192.0.2.3:4000")
+	setVisible(server, "alice", true)
+
+	// The requesting peer and the hidden ones are never listed, the others by page
+	page := listPeers(t, server, alice, "alice", shared.PeerFilter{})
+	if len(page.Peers) != maxListPeers || !page.More || page.Peers[0].Username != "peer00" {
+		t.Fatalf("unexpected first page %s, more %v", usernames(page.Peers), page.More)
+	}
+
+	page = listPeers(t, server, alice, "alice", shared.PeerFilter{Offset: maxListPeers})
+	if usernames(page.Peers) != "[peer08 peer09]" || page.More {
+		t.Fatalf("unexpected last page %s, more %v", usernames(page.Peers), page.More)
+	}
+
+	for _, peer := range page.Peers {
+		if peer.Endpoint != (shared.Endpoint{}) || peer.PublicKey != "" {
+			t.Fatalf("expected only the public fields to be listed, got %+v", peer)
+		}
+	}
+
+	if page := listPeers(t, server, alice, "alice", shared.PeerFilter{Offset: 100}); len(page.Peers) != 0 {
+		t.Fatalf("expected an empty page past the end, got %s", usernames(page.Peers))
+	}
+
+	// The username filter is a case insensitive prefix
+	if page := listPeers(t, server, alice, "alice", shared.PeerFilter{Username: "PEER0"}); len(page.Peers) != maxListPeers {
+		t.Fatalf("expected the peers matching the prefix, got %s", usernames(page.Peers))
+	}
+	if page := listPeers(t, server, alice, "alice", shared.PeerFilter{Username: "hid"}); len(page.Peers) != 0 {
+		t.Fatalf("expected the hidden peer not to be listed, got %s", usernames(page.Peers))
+	}
+}
+
+func TestLookup(t *testing.T) {
+	server := newTestServer(t)
+	alice := addTestPeer(t, server, "alice", "192.0.2.1:4000")
+
+	conn, register := registration(t, server, "192.0.2.2:4000", "Bob", newIdentity(t))
+	if _, err := handle(server, conn, register); err != nil {
+		t.Fatal(err)
+	}
+
+	lookup := func(lookup shared.Lookup) (*shared.Peer, error) {
+		res, err := handle(server, alice, &shared.Message{Type: "lookup", PeerID: "alice", Content: &lookup})
+		if err != nil {
+			return nil, err
+		}
+
+		return res.Content.(*shared.Peer), nil
+	}
+
+	for _, by := range []shared.Lookup{{ID: register.PeerID}, {Username: "bob"}} {
+		peer, err := lookup(by)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if peer.ID != register.PeerID || peer.Username != "Bob" || peer.IdentityKey == "" || peer.Endpoint != (shared.Endpoint{}) {
+			t.Fatalf("expected the public fields of bob, got %+v", peer)
+		}
+	}
+
+	// Hidden and unknown peers are not found, whichever way
+	setVisible(server, register.PeerID, false)
+	for _, by := range []shared.Lookup{{ID: register.PeerID}, {Username: "Bob"}, {Username: "carol"}, {ID: "unknown"}} {
+		if _, err := lookup(by); !errors.Is(err, shared.ErrUnknownPeer) {
+			t.Errorf("expected %+v not to be found, got %v", by, err)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	server := newTestServer(t)
+	alice := addListeningPeer(t, server, "alice")
+	listenTestServer(t, server)
+
+	res, err := handle(server, alice, &shared.Message{Type: "subscribe", PeerID: "alice", Content: &shared.PeerFilter{Username: "bo"}})
+	if err != nil || res.Type != "subscribe" {
+		t.Fatalf("expected the subscription to be confirmed, got %+v, %v", res, err)
+	}
+
+	presence := func(online bool) func(*shared.Message) bool {
+		return func(message *shared.Message) bool {
+			var presence shared.Presence
+			return mapstructure.Decode(message.Content, &presence) == nil && presence.Peer != nil && presence.Peer.Username == "bob" && presence.Online == online
+		}
+	}
+
+	// Carol does not match the filter, bob does
+	for _, username := range []string{"carol", "bob"} {
+		conn, register := registration(t, server, fmt.Sprintf("192.0.2.2:%d", 4000+len(username)), username, newIdentity(t))
+		if _, err := handle(server, conn, register); err != nil {
+			t.Fatal(err)
+		}
+
+		if username == "bob" {
+			waitMessage(t, alice, "presence", presence(true))
+
+			// Saying bye takes bob offline
+			_, err := handle(server, conn, &shared.Message{Type: "bye", PeerID: register.PeerID})
+			if err != nil {
+				t.Fatal(err)
+			}
+			waitMessage(t, alice, "presence", presence(false))
+		}
+	}
+
+	// The presence messages are sent in order, carol's would have come first
+	for _, message := range alice.received() {
+		var presence shared.Presence
+		if mapstructure.Decode(message.Content, &presence) == nil && presence.Peer != nil && presence.Peer.Username != "bob" {
+			t.Fatalf("expected only the presence of bob, got %+v", presence.Peer)
+		}
+	}
+
+	// Unsubscribed peers are no longer told
+	if _, err := handle(server, alice, &shared.Message{Type: "unsubscribe", PeerID: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := server.subscriptions["alice"]; ok {
+		t.Fatal("expected the subscription to be removed")
+	}
+}
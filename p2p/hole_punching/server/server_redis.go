@@ -0,0 +1,226 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	redisKeyPrefix = "p2p:peer:"
+	redisTimeout   = time.Second
+)
+
+// Directory stored in Redis, or any server speaking its protocol, shared by the servers of a cluster
+type RedisDirectory struct {
+	addr     string
+	password string
+	db       int
+	conn     net.Conn
+	reader   *bufio.Reader
+	mutex    *sync.Mutex
+}
+
+func (directory *RedisDirectory) connect() error {
+	conn, err := net.DialTimeout("tcp", directory.addr, redisTimeout)
+	if err != nil {
+		return err
+	}
+
+	directory.conn = conn
+	directory.reader = bufio.NewReader(conn)
+
+	if directory.password != "" {
+		if _, err := directory.send("AUTH", directory.password); err != nil {
+			return err
+		}
+	}
+
+	if directory.db != 0 {
+		if _, err := directory.send("SELECT", strconv.Itoa(directory.db)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Run a command, the connection is opened on first use and after any error
+func (directory *RedisDirectory) command(args ...string) (interface{}, error) {
+	directory.mutex.Lock()
+	defer directory.mutex.Unlock()
+
+	if directory.conn == nil {
+		if err := directory.connect(); err != nil {
+			directory.close()
+			return nil, err
+		}
+	}
+
+	reply, err := directory.send(args...)
+
+	// The reply of a failed command may still be in the stream, start over with a new connection
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		directory.close()
+	}
+
+	return reply, err
+}
+
+func (directory *RedisDirectory) send(args ...string) (interface{}, error) {
+	directory.conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	var request strings.Builder
+	fmt.Fprintf(&request, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&request, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	_, err := io.WriteString(directory.conn, request.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return directory.readReply()
+}
+
+type redisError string
+
+func (err redisError) Error() string {
+	return "redis: " + string(err)
+}
+
+// Simple strings and bulk strings are returned as strings, nil bulk strings as nil
+func (directory *RedisDirectory) readReply() (interface{}, error) {
+	line, err := directory.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: malformed reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+
+		bytes := make([]byte, size+2)
+		_, err = io.ReadFull(directory.reader, bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		return string(bytes[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < 0 {
+			return nil, err
+		}
+
+		replies := make([]interface{}, count)
+		for i := range replies {
+			replies[i], err = directory.readReply()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return replies, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
+
+func (directory *RedisDirectory) close() {
+	if directory.conn != nil {
+		directory.conn.Close()
+	}
+
+	directory.conn = nil
+	directory.reader = nil
+}
+
+func (directory *RedisDirectory) Put(entry *DirectoryEntry, ttl time.Duration) error {
+	bytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"SET", redisKeyPrefix + entry.Peer.ID, string(bytes)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+
+	_, err = directory.command(args...)
+	return err
+}
+
+func (directory *RedisDirectory) Get(id string) (*DirectoryEntry, bool, error) {
+	reply, err := directory.command("GET", redisKeyPrefix+id)
+	if err != nil || reply == nil {
+		return nil, false, err
+	}
+
+	text, ok := reply.(string)
+	if !ok {
+		return nil, false, fmt.Errorf("redis: unexpected reply to GET")
+	}
+
+	var entry DirectoryEntry
+	err = json.Unmarshal([]byte(text), &entry)
+	if err != nil || entry.Peer == nil {
+		return nil, false, fmt.Errorf("redis: malformed entry for peer %s", id)
+	}
+
+	return &entry, true, nil
+}
+
+// Deletes the entry of KEYS[1] only if ARGV[1] owns it, in one step so that another server cannot publish the peer in between
+const redisDeleteScript = `local entry = redis.call("GET", KEYS[1])
+if entry and cjson.decode(entry).owner == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`
+
+func (directory *RedisDirectory) Delete(id string, owner string) error {
+	_, err := directory.command("EVAL", redisDeleteScript, "1", redisKeyPrefix+id, owner)
+	return err
+}
+
+func (directory *RedisDirectory) Close() error {
+	directory.mutex.Lock()
+	defer directory.mutex.Unlock()
+
+	directory.close()
+
+	return nil
+}
+
+// Directory stored in the Redis database db at addr, password can be empty
+func NewRedisDirectory(addr string, password string, db int) *RedisDirectory {
+	return &RedisDirectory{
+		addr:     addr,
+		password: password,
+		db:       db,
+		mutex:    &sync.Mutex{},
+	}
+}
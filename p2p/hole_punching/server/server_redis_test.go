@@ -0,0 +1,224 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"p2p/shared"
+)
+
+// Server speaking the subset of the Redis protocol the directory uses, the delete script is run in Go
+type fakeRedis struct {
+	listener net.Listener
+	password string
+	values   map[string]string
+	commands []string
+	mutex    sync.Mutex
+}
+
+func newFakeRedis(t testing.TB, password string) *fakeRedis {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redis := &fakeRedis{listener: listener, password: password, values: make(map[string]string)}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go redis.serve(conn)
+		}
+	}()
+
+	return redis
+}
+
+func (redis *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	authenticated := redis.password == ""
+
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+
+		if args[0] != "AUTH" && !authenticated {
+			io.WriteString(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+
+		if args[0] == "AUTH" {
+			authenticated = args[1] == redis.password
+		}
+
+		io.WriteString(conn, redis.run(args))
+	}
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("malformed command %q", line)
+	}
+
+	args := make([]string, count)
+	for i := range args {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+
+		bytes := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, bytes); err != nil {
+			return nil, err
+		}
+		args[i] = string(bytes[:size])
+	}
+
+	return args, nil
+}
+
+// Reply of a command, the TTLs are ignored
+func (redis *fakeRedis) run(args []string) string {
+	redis.mutex.Lock()
+	defer redis.mutex.Unlock()
+
+	redis.commands = append(redis.commands, args[0])
+
+	switch args[0] {
+	case "AUTH", "SELECT":
+		if args[0] == "AUTH" && args[1] != redis.password {
+			return "-WRONGPASS invalid password\r\n"
+		}
+		return "+OK\r\n"
+	case "SET":
+		redis.values[args[1]] = args[2]
+		return "+OK\r\n"
+	case "GET":
+		value, ok := redis.values[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	case "EVAL":
+		if args[1] != redisDeleteScript {
+			return "-ERR unknown script\r\n"
+		}
+
+		var entry DirectoryEntry
+		value, ok := redis.values[args[3]]
+		if !ok || json.Unmarshal([]byte(value), &entry) != nil || entry.Owner != args[4] {
+			return ":0\r\n"
+		}
+
+		delete(redis.values, args[3])
+		return ":1\r\n"
+	default:
+		return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+	}
+}
+
+func (redis *fakeRedis) commandsRun() []string {
+	redis.mutex.Lock()
+	defer redis.mutex.Unlock()
+
+	return append([]string(nil), redis.commands...)
+}
+
+func TestRedisDirectory(t *testing.T) {
+	redis := newFakeRedis(t, "secret")
+
+	directory := NewRedisDirectory(redis.listener.Addr().String(), "secret", 2)
+	defer directory.Close()
+
+	if _, ok, err := directory.Get("alice"); ok || err != nil {
+		t.Fatalf("expected no entry, got %v, %v", ok, err)
+	}
+
+	entry := &DirectoryEntry{Peer: &shared.Peer{ID: "alice", Username: "alice"}, Owner: "192.0.2.1:4000"}
+	if err := directory.Put(entry, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok, err := directory.Get("alice")
+	if err != nil || !ok || got.Owner != entry.Owner || got.Peer.Username != "alice" {
+		t.Fatalf("expected the entry back, got %+v, %v, %v", got, ok, err)
+	}
+
+	// Only the server which owns the entry deletes it
+	if err := directory.Delete("alice", "192.0.2.2:4000"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := directory.Get("alice"); !ok {
+		t.Fatal("expected the entry of another owner to be kept")
+	}
+
+	if err := directory.Delete("alice", entry.Owner); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := directory.Get("alice"); ok {
+		t.Fatal("expected the entry to be deleted")
+	}
+
+	// The connection authenticated and selected its database once
+	commands := redis.commandsRun()
+	if commands[0] != "AUTH" || commands[1] != "SELECT" || strings.Count(strings.Join(commands, " "), "AUTH") != 1 {
+		t.Fatalf("unexpected commands %v", commands)
+	}
+
+	// Delete never reads the entry before deleting it, another server could publish it in between
+	for _, command := range commands {
+		if command == "DEL" {
+			t.Fatalf("expected the entry to be deleted by the script, got %v", commands)
+		}
+	}
+}
+
+func TestRedisDirectoryErrors(t *testing.T) {
+	redis := newFakeRedis(t, "secret")
+
+	directory := NewRedisDirectory(redis.listener.Addr().String(), "wrong", 0)
+	defer directory.Close()
+
+	if _, _, err := directory.Get("alice"); err == nil {
+		t.Fatal("expected a wrong password to be rejected")
+	}
+
+	// The server is gone, the directory reconnects and fails
+	redis.listener.Close()
+	directory = NewRedisDirectory(redis.listener.Addr().String(), "", 0)
+	defer directory.Close()
+
+	if err := directory.Put(&DirectoryEntry{Peer: &shared.Peer{ID: "alice"}}, 0); err == nil {
+		t.Fatal("expected an error once the server is gone")
+	}
+}
@@ -0,0 +1,322 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"p2p/crypto"
+	"p2p/shared"
+)
+
+var (
+	registryPeers        = []byte("peers")
+	registryReservations = []byte("reservations")
+	registryServerKey    = []byte("serverKey")
+)
+
+// Embedded store of the registered peers and of the usernames, restored when the server restarts.
+// Servers sharing a registry each use the bucket of their listen address.
+type Registry struct {
+	db *bolt.DB
+}
+
+// Saved registration, with the subscription and the groups of the peer
+type registryPeer struct {
+	Peer         *shared.Peer       `json:"peer"`
+	Visible      bool               `json:"visible"`
+	Subscription *shared.PeerFilter `json:"subscription,omitempty"`
+	Groups       []string           `json:"groups,omitempty"`
+	// Verifiers of the secrets of the groups, by group name
+	GroupVerifiers map[string]string `json:"groupVerifiers,omitempty"`
+}
+
+type registryReservation struct {
+	IdentityKey string    `json:"identityKey"`
+	PeerID      string    `json:"peerID"`
+	LastSeen    time.Time `json:"lastSeen"`
+}
+
+func OpenRegistry(path string) (*Registry, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Registry{db: db}, nil
+}
+
+func (registry *Registry) Close() error {
+	return registry.db.Close()
+}
+
+// Restore the peers and usernames saved by a previous run, then save the changes, must be called before Listen.
+// Sessions can only be restored when the server has the same key pair as before, otherwise the peers
+// are told that their session is unknown and register again.
+func (server *Server) SetRegistry(registry *Registry) error {
+	bucket := []byte(server.transport.LocalAddr().String())
+
+	peers := make(map[string]*registryPeer)
+	reservations := make(map[string]*registryReservation)
+	// Peers registered when the server stopped, their usernames are still in use
+	online := make(map[string]bool)
+
+	err := registry.db.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists(bucket)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range [][]byte{registryPeers, registryReservations} {
+			if _, err := root.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		sameKey := string(root.Get(registryServerKey)) == string(server.publicKey[:])
+
+		err = root.Bucket(registryPeers).ForEach(func(key []byte, value []byte) error {
+			var record registryPeer
+			if err := json.Unmarshal(value, &record); err != nil || record.Peer == nil {
+				server.error("Could not restore peer", "peer", key)
+				return nil
+			}
+
+			peers[string(key)] = &record
+			online[string(key)] = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = root.Bucket(registryReservations).ForEach(func(key []byte, value []byte) error {
+			var record registryReservation
+			if err := json.Unmarshal(value, &record); err != nil {
+				server.error("Could not restore reservation", "reservation", key)
+				return nil
+			}
+
+			reservations[string(key)] = &record
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// Sessions of another key pair are lost, only the usernames are restored
+		if !sameKey {
+			if err := root.DeleteBucket(registryPeers); err != nil {
+				return err
+			}
+			if _, err := root.CreateBucket(registryPeers); err != nil {
+				return err
+			}
+
+			peers = nil
+		}
+
+		return root.Put(registryServerKey, server.publicKey[:])
+	})
+	if err != nil {
+		return err
+	}
+
+	server.mutex.Lock()
+	server.restorePeers(peers, reservations, online)
+	server.registry = registry
+	server.bucket = bucket
+	server.mutex.Unlock()
+
+	server.info("Restored registry", "peers", len(peers), "usernames", len(reservations))
+
+	return nil
+}
+
+// Must be called with the mutex held
+func (server *Server) restorePeers(peers map[string]*registryPeer, reservations map[string]*registryReservation, online map[string]bool) {
+	now := time.Now()
+
+	for key, record := range reservations {
+		identityKey, err := base64.StdEncoding.DecodeString(record.IdentityKey)
+		if err != nil || len(identityKey) != ed25519.PublicKeySize {
+			continue
+		}
+
+		bound := &reservation{
+			identityKey: identityKey,
+			peerID:      record.PeerID,
+			lastSeen:    record.LastSeen,
+		}
+
+		if online[record.PeerID] {
+			bound.lastSeen = now
+		}
+
+		server.reservations[key] = bound
+	}
+
+	for id, record := range peers {
+		peer := record.Peer
+		peer.Visible = record.Visible
+		peer.LastSeen = now
+
+		pubKey, err := peer.GetPublicKey()
+		if err != nil || shared.GenPeerID(pubKey) != id {
+			continue
+		}
+
+		addr, err := net.ResolveUDPAddr("udp", peer.Endpoint.String())
+		if err != nil {
+			continue
+		}
+
+		conn, err := server.transport.CreateConn(addr)
+		if err != nil {
+			continue
+		}
+
+		// The secret of the session only depends on both keys
+		conn.SetSecret(crypto.GenSharedSecret(server.privateKey, pubKey))
+
+		server.peers[id] = peer
+		if record.Subscription != nil {
+			server.subscriptions[id] = record.Subscription
+		}
+
+		for _, name := range record.Groups {
+			if _, ok := server.groups[name]; !ok {
+				server.groups[name] = make(map[string]bool)
+			}
+			server.groups[name][id] = true
+
+			if verifier := record.GroupVerifiers[name]; verifier != "" {
+				server.groupVerifiers[name] = verifier
+			}
+		}
+
+		server.publish(peer)
+	}
+}
+
+// Save the peer with this ID on the next flush, must be called with the mutex held
+func (server *Server) savePeer(id string) {
+	if server.registry != nil {
+		server.dirtyPeers[id] = true
+	}
+}
+
+// Save the reservation with this key on the next flush, must be called with the mutex held
+func (server *Server) saveReservation(key string) {
+	if server.registry != nil {
+		server.dirtyReservations[key] = true
+	}
+}
+
+// Write the changed peers and reservations in a single transaction, once the mutex is released
+func (server *Server) flushRegistry() {
+	server.mutex.Lock()
+
+	if server.registry == nil || len(server.dirtyPeers)+len(server.dirtyReservations) == 0 {
+		server.mutex.Unlock()
+		return
+	}
+
+	peers := make(map[string][]byte, len(server.dirtyPeers))
+	for id := range server.dirtyPeers {
+		peers[id] = server.peerRecord(id)
+	}
+
+	reservations := make(map[string][]byte, len(server.dirtyReservations))
+	for key := range server.dirtyReservations {
+		reservations[key] = server.reservationRecord(key)
+	}
+
+	clear(server.dirtyPeers)
+	clear(server.dirtyReservations)
+
+	server.mutex.Unlock()
+
+	err := server.registry.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(server.bucket)
+
+		for name, records := range map[string]map[string][]byte{string(registryPeers): peers, string(registryReservations): reservations} {
+			bucket := root.Bucket([]byte(name))
+
+			for key, value := range records {
+				var err error
+				if value == nil {
+					err = bucket.Delete([]byte(key))
+				} else {
+					err = bucket.Put([]byte(key), value)
+				}
+
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		server.error("Could not save the registry", "err", err)
+	}
+}
+
+// Saved registration of the peer, nil once the peer is gone. Must be called with the mutex held.
+func (server *Server) peerRecord(id string) []byte {
+	peer, ok := server.peers[id]
+	if !ok {
+		return nil
+	}
+
+	record := &registryPeer{
+		Peer:         directoryEntry(peer, "").Peer,
+		Visible:      peer.Visible,
+		Subscription: server.subscriptions[id],
+	}
+
+	for name, members := range server.groups {
+		if members[id] {
+			record.Groups = append(record.Groups, name)
+
+			if record.GroupVerifiers == nil {
+				record.GroupVerifiers = make(map[string]string)
+			}
+			record.GroupVerifiers[name] = server.groupVerifiers[name]
+		}
+	}
+
+	bytes, err := json.Marshal(record)
+	if err != nil {
+		server.error("Could not encode peer", "peer", id, "err", err)
+		return nil
+	}
+
+	return bytes
+}
+
+// Must be called with the mutex held
+func (server *Server) reservationRecord(key string) []byte {
+	bound, ok := server.reservations[key]
+	if !ok {
+		return nil
+	}
+
+	bytes, err := json.Marshal(&registryReservation{
+		IdentityKey: base64.StdEncoding.EncodeToString(bound.identityKey),
+		PeerID:      bound.peerID,
+		LastSeen:    bound.lastSeen,
+	})
+	if err != nil {
+		server.error("Could not encode reservation", "reservation", key, "err", err)
+		return nil
+	}
+
+	return bytes
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"p2p/crypto"
+	"p2p/shared"
+)
+
+// Server listening on addr again with this key pair, restored from the registry
+func restartServer(t testing.TB, addr string, registry *Registry, privateKey [32]byte, publicKey [32]byte) *Server {
+	t.Helper()
+
+	server, err := NewServer(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetLogger(slog.New(slog.DiscardHandler))
+	t.Cleanup(server.Stop)
+
+	server.SetKeyPair(privateKey, publicKey)
+	if err := server.SetRegistry(registry); err != nil {
+		t.Fatal(err)
+	}
+
+	return server
+}
+
+func TestRegistryRestore(t *testing.T) {
+	registry, err := OpenRegistry(filepath.Join(t.TempDir(), "registry.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer registry.Close()
+
+	first := newTestServer(t)
+	if err := first.SetRegistry(registry); err != nil {
+		t.Fatal(err)
+	}
+	addr := first.transport.LocalAddr().String()
+
+	identity := newIdentity(t)
+	alice, register := registration(t, first, "192.0.2.1:4000", "alice", identity)
+	if _, err := handle(first, alice, register); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := joinGroup(first, alice, register.PeerID, "friends", "verifier"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stopping flushes the registry
+	first.Stop()
+
+	// With the same key pair, the session of alice goes on
+	same := restartServer(t, addr, registry, first.privateKey, first.publicKey)
+
+	if peer, ok := same.peers[register.PeerID]; !ok || peer.Username != "alice" || !peer.Visible {
+		t.Fatalf("expected alice to be restored, got %+v", peer)
+	}
+	if same.groupVerifiers["friends"] != "verifier" || !same.groups["friends"][register.PeerID] {
+		t.Fatalf("expected the group and its verifier to be restored, got %v, %v", same.groups, same.groupVerifiers)
+	}
+
+	conn, ok := same.transport.GetConn(alice.addr.String())
+	if !ok {
+		t.Fatal("expected the conn of alice to be restored")
+	}
+	if secret, _ := conn.GetSecret(); secret != alice.secret {
+		t.Fatal("expected the conn of alice to keep the secret of its session")
+	}
+
+	if _, err := handle(same, alice, &shared.Message{Type: "keepalive", PeerID: register.PeerID}); err != nil {
+		t.Fatalf("expected alice to keep using its session, got %v", err)
+	}
+	same.Stop()
+
+	// With another key pair, the session is discarded but the username stays bound
+	privateKey, publicKey, err := crypto.GenKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := restartServer(t, addr, registry, privateKey, publicKey)
+
+	if len(other.peers) != 0 || len(other.groups) != 0 {
+		t.Fatalf("expected the sessions to be discarded, got %d peers", len(other.peers))
+	}
+	if _, ok := other.transport.GetConn(alice.addr.String()); ok {
+		t.Fatal("expected the conn of alice to be discarded")
+	}
+
+	mallory, stolen := registration(t, other, "192.0.2.2:4000", "alice", newIdentity(t))
+	if _, err := handle(other, mallory, stolen); !errors.Is(err, shared.ErrUsernameTaken) {
+		t.Fatalf("expected the username to stay bound to its identity key, got %v", err)
+	}
+
+	alice, register = registration(t, other, "192.0.2.1:4000", "alice", identity)
+	if _, err := handle(other, alice, register); err != nil {
+		t.Fatalf("expected alice to register again with its identity key, got %v", err)
+	}
+}
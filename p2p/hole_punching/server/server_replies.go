@@ -0,0 +1,77 @@
+package server
+
+import (
+	"time"
+
+	"p2p/shared"
+)
+
+// How long the answer to a request is kept, so that its retransmissions are answered without handling it again
+const replyTimeout = 30 * time.Second
+
+type cachedReply struct {
+	message *shared.Message
+	expires time.Time
+}
+
+func errorReply(message *shared.Message, err error) *shared.Message {
+	return &shared.Message{
+		Type:      message.Type,
+		RequestID: message.RequestID,
+		Error:     err.Error(),
+		Code:      shared.CodeOf(err),
+	}
+}
+
+// Answer of an earlier copy of the request, must be called with the mutex held
+func (server *Server) cachedReply(conn shared.Conn, message *shared.Message) (*shared.Message, bool) {
+	if message.RequestID == 0 {
+		return nil, false
+	}
+
+	reply, ok := server.replies[conn.GetAddr().String()][message.RequestID]
+	if !ok || time.Now().After(reply.expires) {
+		return nil, false
+	}
+
+	return reply.message, true
+}
+
+// Keep the answer of a request, the greetings are never cached since they may come from spoofed sources.
+// Requests answered later, e.g. by another server of the cluster, are handled again. Must be called with the mutex held.
+func (server *Server) cacheReply(conn shared.Conn, message *shared.Message, res *shared.Message) {
+	if message.RequestID == 0 || message.Type == "greeting" || res == nil {
+		return
+	}
+
+	addr := conn.GetAddr().String()
+	if _, ok := server.replies[addr]; !ok {
+		server.replies[addr] = make(map[uint64]*cachedReply)
+	}
+
+	server.replies[addr][message.RequestID] = &cachedReply{
+		message: res,
+		expires: time.Now().Add(replyTimeout),
+	}
+}
+
+// Forget the answers sent to an address, a client greeting from it again counts its request IDs from the start.
+// Must be called with the mutex held.
+func (server *Server) forgetReplies(addr string) {
+	delete(server.replies, addr)
+}
+
+// Must be called with the mutex held
+func (server *Server) pruneReplies(now time.Time) {
+	for addr, replies := range server.replies {
+		for requestID, reply := range replies {
+			if now.After(reply.expires) {
+				delete(replies, requestID)
+			}
+		}
+
+		if len(replies) == 0 {
+			delete(server.replies, addr)
+		}
+	}
+}
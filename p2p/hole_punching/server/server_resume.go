@@ -0,0 +1,49 @@
+package server
+
+import (
+	"github.com/mitchellh/mapstructure"
+
+	"p2p/shared"
+)
+
+// Relay the resume request of a peer whose endpoint changed to the peer it was connected with.
+// The other peer checks the token and challenges the new endpoint before using it, the server cannot check either.
+func resumeHandler(server *Server, peers shared.Peers, message *shared.Message) (*shared.Message, error) {
+	rp, ok := peers[message.PeerID]
+	if !ok {
+		return nil, shared.ErrNotRegistered
+	}
+
+	var resume shared.Resume
+	err := mapstructure.Decode(message.Content, &resume)
+	if err != nil {
+		return nil, shared.ErrMalformed
+	}
+
+	if resume.Token == "" || resume.Nonce == "" {
+		return nil, shared.NewError(shared.ErrorCodeMalformed, "resume request must contain a nonce and a token")
+	}
+
+	op, _, ok := server.findPeer(resume.PeerID)
+	if !ok {
+		return nil, shared.NewError(shared.ErrorCodeUnknownPeer, "peer: %s has not registered with the server", resume.PeerID)
+	}
+
+	if op.ID == rp.ID {
+		return nil, shared.NewError(shared.ErrorCodeInvalidRequest, "cannot resume a session with yourself")
+	}
+
+	server.info("Resume request", "peer", rp.ID, "target", op.ID, "session", shared.SessionID(rp.ID, op.ID), "addr", rp.Endpoint)
+
+	// Only the endpoint of the requester is sent, the other peer answers by punching it
+	return nil, server.sendTo(op, &shared.Message{
+		Type: "resume",
+		Content: &shared.Resume{
+			PeerID: rp.ID,
+			Nonce:  resume.Nonce,
+			Token:  resume.Token,
+			Peer:   rp,
+		},
+		Encrypt: true,
+	})
+}
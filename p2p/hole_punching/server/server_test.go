@@ -0,0 +1,512 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"p2p/crypto"
+	"p2p/shared"
+)
+
+// Conn recording the messages sent to it
+type fakeConn struct {
+	addr   *net.UDPAddr
+	secret [32]byte
+	sent   []*shared.Message
+	mutex  sync.Mutex
+}
+
+func newFakeConn(addr string) *fakeConn {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		panic(err)
+	}
+
+	return &fakeConn{addr: udpAddr}
+}
+
+func (conn *fakeConn) Send(message *shared.Message) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	conn.sent = append(conn.sent, message)
+	return nil
+}
+
+// Messages sent to the conn so far
+func (conn *fakeConn) received() []*shared.Message {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	return append([]*shared.Message(nil), conn.sent...)
+}
+
+func (conn *fakeConn) Protocol() string {
+	return "UDP"
+}
+
+func (conn *fakeConn) GetAddr() net.Addr {
+	return conn.addr
+}
+
+func (conn *fakeConn) GetSecret() ([32]byte, error) {
+	return conn.secret, nil
+}
+
+func (conn *fakeConn) SetSecret(secret [32]byte) {
+	conn.secret = secret
+}
+
+// Server which is never started, its handlers are called directly
+func newTestServer(t testing.TB) *Server {
+	t.Helper()
+
+	server, err := NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetLogger(slog.New(slog.DiscardHandler))
+	t.Cleanup(server.Stop)
+
+	return server
+}
+
+func greeting(t testing.TB, cookie string) *shared.Message {
+	t.Helper()
+
+	_, publicKey, err := crypto.GenKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &shared.Message{
+		Type: "greeting",
+		Content: &shared.Greeting{
+			PublicKey: base64.StdEncoding.EncodeToString(publicKey[:]),
+			Cookie:    cookie,
+		},
+	}
+}
+
+func TestCookies(t *testing.T) {
+	server := newTestServer(t)
+
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}
+	other := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4001}
+	now := time.Now()
+
+	cookie := server.genCookie(addr, now)
+
+	if !server.validCookie(addr, cookie, now) {
+		t.Fatal("expected the cookie to be valid for its address")
+	}
+
+	if server.validCookie(other, cookie, now) {
+		t.Fatal("expected the cookie to be invalid for another address")
+	}
+
+	if server.validCookie(addr, cookie, now.Add(cookieTimeout+time.Second)) {
+		t.Fatal("expected the cookie to expire")
+	}
+
+	if server.validCookie(addr, "not a cookie", now) {
+		t.Fatal("expected a malformed cookie to be invalid")
+	}
+}
+
+func TestGreetingNeedsCookie(t *testing.T) {
+	server := newTestServer(t)
+	conn := newFakeConn("192.0.2.1:4000")
+
+	res, err := route(server, server.peers, conn, greeting(t, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Type != "cookie" {
+		t.Fatalf("expected a cookie, got %s", res.Type)
+	}
+
+	if server.isKnown(conn) {
+		t.Fatal("expected no conn before the cookie comes back")
+	}
+
+	res, err = route(server, server.peers, conn, greeting(t, res.Content.(string)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Type != "greeting" {
+		t.Fatalf("expected a greeting, got %s", res.Type)
+	}
+
+	if !server.isKnown(conn) {
+		t.Fatal("expected a conn once greeted")
+	}
+}
+
+func TestMalformedGreeting(t *testing.T) {
+	server := newTestServer(t)
+	conn := newFakeConn("192.0.2.1:4000")
+
+	_, err := route(server, server.peers, conn, &shared.Message{Type: "greeting", Content: &shared.Greeting{PublicKey: "short"}})
+	if !errors.Is(err, shared.ErrMalformed) {
+		t.Fatalf("expected a malformed error, got %v", err)
+	}
+}
+
+func TestUnknownRequestType(t *testing.T) {
+	server := newTestServer(t)
+	conn := newFakeConn("192.0.2.1:4000")
+
+	_, err := route(server, server.peers, conn, &shared.Message{Type: "unknown"})
+	if !errors.Is(err, shared.ErrUnknownType) {
+		t.Fatalf("expected an unknown type error, got %v", err)
+	}
+}
+
+func TestUnregisteredRequests(t *testing.T) {
+	server := newTestServer(t)
+	conn := newFakeConn("192.0.2.1:4000")
+
+	for _, messageType := range []string{"establish", "keepalive", "list", "code-create"} {
+		_, err := route(server, server.peers, conn, &shared.Message{Type: messageType, PeerID: "unknown"})
+		if !errors.Is(err, shared.ErrNotRegistered) {
+			t.Fatalf("expected %s to need a registration, got %v", messageType, err)
+		}
+	}
+}
+
+// Register a peer as if it greeted and registered from addr, its conn shares a secret with the server
+func addTestPeer(t testing.TB, server *Server, id string, addr string) *fakeConn {
+	t.Helper()
+
+	conn := newFakeConn(addr)
+	copy(conn.secret[:], id)
+
+	transportConn, err := server.transport.CreateConn(conn.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transportConn.SetSecret(conn.secret)
+
+	server.peers[id] = &shared.Peer{
+		ID:       id,
+		Username: id,
+		Endpoint: shared.Endpoint{IP: conn.addr.IP.String(), Port: conn.addr.Port},
+		LastSeen: time.Now(),
+	}
+
+	return conn
+}
+
+// Conn of a peer greeted with a new session key, and its register message signed with the identity key
+func registration(t testing.TB, server *Server, addr string, username string, identity ed25519.PrivateKey) (*fakeConn, *shared.Message) {
+	t.Helper()
+
+	privateKey, publicKey, err := crypto.GenKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := newFakeConn(addr)
+	conn.secret = crypto.GenSharedSecret(privateKey, server.publicKey)
+
+	content := &shared.Registration{
+		Username:    username,
+		PublicKey:   base64.StdEncoding.EncodeToString(publicKey[:]),
+		Visible:     true,
+		IdentityKey: base64.StdEncoding.EncodeToString(identity.Public().(ed25519.PublicKey)),
+	}
+	content.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(identity, content.SignedData(server.publicKey)))
+
+	return conn, &shared.Message{Type: "register", PeerID: shared.GenPeerID(publicKey), Content: content, Encrypt: true}
+}
+
+func newIdentity(t testing.TB) ed25519.PrivateKey {
+	t.Helper()
+
+	_, identity, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return identity
+}
+
+// Listen until the end of the test, so that the messages sent to the peers leave the socket
+func listenTestServer(t testing.TB, server *Server) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	go server.Listen(ctx)
+}
+
+// Register a peer listening on a loopback socket, the messages the server sends it are recorded by its conn
+func addListeningPeer(t testing.TB, server *Server, id string) *fakeConn {
+	t.Helper()
+
+	socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { socket.Close() })
+
+	server.mutex.Lock()
+	conn := addTestPeer(t, server, id, socket.LocalAddr().String())
+	server.mutex.Unlock()
+
+	go func() {
+		buffer := make([]byte, 2048)
+		for {
+			n, _, err := socket.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+
+			if message, err := shared.MessageIn(conn, buffer[:n]); err == nil {
+				conn.Send(message)
+			}
+		}
+	}()
+
+	return conn
+}
+
+// Route the message with the mutex held, as the message callback does
+func handle(server *Server, conn shared.Conn, message *shared.Message) (*shared.Message, error) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	message.Encrypt = true
+	return route(server, server.peers, conn, message)
+}
+
+// Wait until the conn received a message of this type matching the check
+func waitMessage(t testing.TB, conn *fakeConn, messageType string, check func(*shared.Message) bool) *shared.Message {
+	t.Helper()
+
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, message := range conn.received() {
+			if message.Type == messageType && check(message) {
+				return message
+			}
+		}
+	}
+
+	t.Fatalf("timed out waiting for a %s message", messageType)
+	return nil
+}
+
+func TestPairingCodeNameplate(t *testing.T) {
+	server := newTestServer(t)
+	alice := addTestPeer(t, server, "alice", "192.0.2.1:4000")
+	bob := addTestPeer(t, server, "bob", "192.0.2.2:4000")
+
+	res, err := route(server, server.peers, alice, &shared.Message{Type: "code-create", PeerID: "alice", Encrypt: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the nameplate is allocated by the server
+	nameplate := res.Content.(string)
+	if n, err := strconv.Atoi(nameplate); err != nil || n < 1 || n >= maxNameplate {
+		t.Fatalf("expected a numeric nameplate, got %q", nameplate)
+	}
+
+	res, err = route(server, server.peers, bob, &shared.Message{Type: "code-join", PeerID: "bob", Content: nameplate, Encrypt: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Type != "establish" || res.Content.(*shared.Peer).ID != "alice" {
+		t.Fatalf("expected bob to be introduced to alice, got %+v", res)
+	}
+
+	// Codes are used once
+	_, err = route(server, server.peers, bob, &shared.Message{Type: "code-join", PeerID: "bob", Content: nameplate, Encrypt: true})
+	if !errors.Is(err, shared.ErrInvalidCode) {
+		t.Fatalf("expected an invalid code error, got %v", err)
+	}
+
+	// Errors are logged by both sides, they never carry the code
+	if strings.Contains(err.Error(), nameplate) {
+		t.Fatalf("expected the error to leave the nameplate out, got %v", err)
+	}
+}
+
+func TestPairingCodeJoinedWithWholeCode(t *testing.T) {
+	server := newTestServer(t)
+	alice := addTestPeer(t, server, "alice", "192.0.2.1:4000")
+	bob := addTestPeer(t, server, "bob", "192.0.2.2:4000")
+
+	res, err := route(server, server.peers, alice, &shared.Message{Type: "code-create", PeerID: "alice", Encrypt: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Older clients send the whole code, the server only looks at its nameplate
+	_, err = route(server, server.peers, bob, &shared.Message{Type: "code-join", PeerID: "bob", Content: " " + res.Content.(string) + "-crossword-maple", Encrypt: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConsentOnlyFromTheTarget(t *testing.T) {
+	server := newTestServer(t)
+	alice := addTestPeer(t, server, "alice", "192.0.2.1:4000")
+	bob := addTestPeer(t, server, "bob", "192.0.2.2:4000")
+	mallory := addTestPeer(t, server, "mallory", "192.0.2.3:4000")
+
+	res, err := route(server, server.peers, alice, &shared.Message{Type: "establish", PeerID: "alice", Content: "bob", Encrypt: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Type != "establish-pending" {
+		t.Fatalf("expected the request to wait for the consent of bob, got %s", res.Type)
+	}
+
+	consent := func(conn shared.Conn, encrypt bool) error {
+		_, err := route(server, server.peers, conn, &shared.Message{
+			Type:    "consent",
+			PeerID:  "bob",
+			Content: &shared.Consent{PeerID: "alice", Accept: true},
+			Encrypt: encrypt,
+		})
+		return err
+	}
+
+	// Another registered peer, or bob's endpoint without the encrypted channel, cannot consent for bob
+	if err := consent(mallory, true); !errors.Is(err, shared.ErrAuthFailed) {
+		t.Fatalf("expected a consent from another endpoint to be rejected, got %v", err)
+	}
+	if err := consent(bob, false); !errors.Is(err, shared.ErrAuthFailed) {
+		t.Fatalf("expected an unencrypted consent to be rejected, got %v", err)
+	}
+
+	if err := consent(bob, true); err != nil {
+		t.Fatalf("expected bob to consent, got %v", err)
+	}
+}
+
+func TestPeerRequestsNeedTheirEndpoint(t *testing.T) {
+	server := newTestServer(t)
+	addTestPeer(t, server, "alice", "192.0.2.1:4000")
+	addTestPeer(t, server, "bob", "192.0.2.2:4000")
+	mallory := addTestPeer(t, server, "mallory", "192.0.2.3:4000")
+
+	for messageType := range peerRequests {
+		_, err := route(server, server.peers, mallory, &shared.Message{Type: messageType, PeerID: "alice", Content: "bob", Encrypt: true})
+		if !errors.Is(err, shared.ErrAuthFailed) {
+			t.Errorf("expected %s on behalf of another peer to be rejected, got %v", messageType, err)
+		}
+	}
+
+	if _, ok := server.peers["alice"]; !ok {
+		t.Fatal("expected alice to stay registered")
+	}
+}
+
+func TestRepliesForgottenOnNewSession(t *testing.T) {
+	server := newTestServer(t)
+	alice := addTestPeer(t, server, "alice", "192.0.2.1:4000")
+
+	callback := createMessageCallback(server, server.peers)
+	list := &shared.Message{Type: "list", PeerID: "alice", RequestID: 1, Encrypt: true}
+
+	callback(alice, list)
+	if _, ok := server.cachedReply(alice, list); !ok {
+		t.Fatal("expected the answer to be cached")
+	}
+
+	// A client restarting from the same address counts its request IDs from 1 again
+	callback(alice, &shared.Message{Type: "bye", PeerID: "alice", RequestID: 2, Encrypt: true})
+	if _, ok := server.cachedReply(alice, list); ok {
+		t.Fatal("expected the answers to be forgotten once the peer said bye")
+	}
+
+	alice = addTestPeer(t, server, "alice", "192.0.2.1:4000")
+	callback(alice, list)
+
+	res, err := route(server, server.peers, alice, greeting(t, server.genCookie(alice.addr, time.Now())))
+	if err != nil || res.Type != "greeting" {
+		t.Fatalf("expected a greeting, got %+v, %v", res, err)
+	}
+
+	if _, ok := server.cachedReply(alice, list); ok {
+		t.Fatal("expected the answers to be forgotten once greeted again")
+	}
+}
+
+func TestRegisterFromIPv6(t *testing.T) {
+	server := newTestServer(t)
+
+	options := server.GetOptions()
+	options.MaxPeersPerIP = 1
+	server.SetOptions(options)
+
+	conn, message := registration(t, server, "[2001:db8::1]:4000", "alice", newIdentity(t))
+	res, err := handle(server, conn, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endpoint := res.Content.(*shared.Endpoint)
+	if endpoint.IP != "2001:db8::1" || endpoint.Port != 4000 || endpoint.String() != conn.GetAddr().String() {
+		t.Fatalf("expected the IPv6 endpoint of the peer, got %+v", endpoint)
+	}
+
+	// Peers of the same IPv6 address are counted together
+	conn, message = registration(t, server, "[2001:db8::1]:4001", "bob", newIdentity(t))
+	if _, err := handle(server, conn, message); !errors.Is(err, shared.ErrLimitExceeded) {
+		t.Fatalf("expected the second peer of the address to be limited, got %v", err)
+	}
+}
+
+func TestRegisterAgainFromNewEndpoint(t *testing.T) {
+	server := newTestServer(t)
+
+	conn, message := registration(t, server, "192.0.2.1:4000", "alice", newIdentity(t))
+	if _, err := server.transport.CreateConn(conn.addr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handle(server, conn, message); err != nil {
+		t.Fatal(err)
+	}
+
+	// The NAT mapping of alice changed, it registers again with the same session key
+	moved := newFakeConn("192.0.2.1:5000")
+	moved.secret = conn.secret
+	res, err := handle(server, moved, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if endpoint := res.Content.(*shared.Endpoint); endpoint.String() != "192.0.2.1:5000" {
+		t.Fatalf("expected alice to be told its new endpoint, got %+v", endpoint)
+	}
+	if _, ok := server.transport.GetConn(conn.addr.String()); ok {
+		t.Fatal("expected the conn of the old endpoint to be deleted")
+	}
+
+	if history := server.endpoints[message.PeerID]; history.previous != "192.0.2.1:4000" || history.changes != 1 {
+		t.Fatalf("expected the endpoint change to be recorded, got %+v", history)
+	}
+
+	// Requests from the old endpoint no longer act on behalf of alice
+	if _, err := handle(server, conn, &shared.Message{Type: "keepalive", PeerID: message.PeerID}); !errors.Is(err, shared.ErrAuthFailed) {
+		t.Fatalf("expected the old endpoint to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+	"time"
+	"unicode"
+
+	"p2p/crypto"
+	"p2p/shared"
+)
+
+const (
+	maxUsernameLength  = 32
+	maxNamespaceLength = 32
+)
+
+// Username bound to the identity key of its first registration
+type reservation struct {
+	identityKey ed25519.PublicKey
+	// Last peer registered with the username
+	peerID   string
+	lastSeen time.Time
+}
+
+// Usernames are unique per namespace regardless of case
+func reservationKey(namespace string, username string) string {
+	return namespace + "\x00" + strings.ToLower(username)
+}
+
+func validName(name string, maxLength int) bool {
+	if len(name) > maxLength || strings.TrimSpace(name) != name {
+		return false
+	}
+
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Check that the registering peer owns its session key and its identity key,
+// then bind the username to the identity key on first use. Must be called with the mutex held.
+func (server *Server) reserve(conn shared.Conn, message *shared.Message, registration *shared.Registration) error {
+	if registration.Username == "" || !validName(registration.Username, maxUsernameLength) {
+		return shared.NewError(shared.ErrorCodeInvalidRequest, "username must be between 1 and %d characters", maxUsernameLength)
+	}
+
+	if !validName(registration.Namespace, maxNamespaceLength) {
+		return shared.NewError(shared.ErrorCodeInvalidRequest, "namespace must be at most %d characters", maxNamespaceLength)
+	}
+
+	// The session key must be the one of the encrypted channel and match the peer ID
+	bytes, err := base64.StdEncoding.DecodeString(registration.PublicKey)
+	if err != nil || len(bytes) != 32 {
+		return shared.NewError(shared.ErrorCodeMalformed, "malformed public key")
+	}
+	var publicKey [32]byte
+	copy(publicKey[:], bytes)
+
+	secret, err := conn.GetSecret()
+	if err != nil || !message.Encrypt {
+		return shared.NewError(shared.ErrorCodeAuthFailed, "registration must be sent over the encrypted channel")
+	}
+
+	expected := crypto.GenSharedSecret(server.privateKey, publicKey)
+	if subtle.ConstantTimeCompare(secret[:], expected[:]) != 1 || shared.GenPeerID(publicKey) != message.PeerID {
+		return shared.NewError(shared.ErrorCodeAuthFailed, "public key does not match the greeting or the peer ID")
+	}
+
+	identityKey, err := base64.StdEncoding.DecodeString(registration.IdentityKey)
+	if err != nil || len(identityKey) != ed25519.PublicKeySize {
+		return shared.NewError(shared.ErrorCodeMalformed, "malformed identity key")
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(registration.Signature)
+	if err != nil || !ed25519.Verify(identityKey, registration.SignedData(server.publicKey), signature) {
+		return shared.NewError(shared.ErrorCodeAuthFailed, "invalid registration signature")
+	}
+
+	key := reservationKey(registration.Namespace, registration.Username)
+
+	bound, ok := server.reservations[key]
+	if ok && !bound.identityKey.Equal(ed25519.PublicKey(identityKey)) {
+		return shared.NewError(shared.ErrorCodeUsernameTaken, "username %s is already taken", registration.Username)
+	}
+
+	if !ok {
+		bound = &reservation{identityKey: identityKey}
+		server.reservations[key] = bound
+
+		server.info("Reserved username", "peer", message.PeerID, "username", registration.Username, "namespace", registration.Namespace)
+	}
+
+	bound.peerID = message.PeerID
+	bound.lastSeen = time.Now()
+	server.saveReservation(key)
+
+	return nil
+}
+
+// Release the usernames whose holder has not registered for longer than the reservation timeout,
+// must be called with the mutex held
+func (server *Server) pruneReservations(now time.Time, timeout time.Duration) {
+	for key, bound := range server.reservations {
+		if _, ok := server.peers[bound.peerID]; ok {
+			bound.lastSeen = now
+			continue
+		}
+
+		if timeout > 0 && now.Sub(bound.lastSeen) > timeout {
+			delete(server.reservations, key)
+			server.saveReservation(key)
+		}
+	}
+}
+
+// Online peer currently holding the username, must be called with the mutex held
+func (server *Server) lookupUsername(namespace string, username string) (*shared.Peer, bool) {
+	bound, ok := server.reservations[reservationKey(namespace, username)]
+	if !ok {
+		return nil, false
+	}
+
+	peer, ok := server.peers[bound.peerID]
+	if !ok || peer.Namespace != namespace || !strings.EqualFold(peer.Username, username) {
+		return nil, false
+	}
+
+	return peer, true
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"p2p/shared"
+)
+
+// Sign the registration again once changed
+func sign(server *Server, message *shared.Message, identity ed25519.PrivateKey) {
+	content := message.Content.(*shared.Registration)
+	content.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(identity, content.SignedData(server.publicKey)))
+}
+
+func register(server *Server, conn *fakeConn, message *shared.Message) error {
+	_, err := handle(server, conn, message)
+	return err
+}
+
+func TestUsernameReservation(t *testing.T) {
+	server := newTestServer(t)
+	alice, mallory := newIdentity(t), newIdentity(t)
+
+	conn, message := registration(t, server, "192.0.2.1:4000", "Alice", alice)
+	if err := register(server, conn, message); err != nil {
+		t.Fatal(err)
+	}
+
+	// Usernames are unique regardless of case, another identity cannot take it
+	conn, message = registration(t, server, "192.0.2.2:4000", "ALICE", mallory)
+	if err := register(server, conn, message); !errors.Is(err, shared.ErrUsernameTaken) {
+		t.Fatalf("expected the username to be taken, got %v", err)
+	}
+
+	// Unless in another namespace
+	message.Content.(*shared.Registration).Namespace = "elsewhere"
+	sign(server, message, mallory)
+	if err := register(server, conn, message); err != nil {
+		t.Fatalf("expected the username to be free in another namespace, got %v", err)
+	}
+
+	// The identity holding it registers again with a new session key
+	conn, message = registration(t, server, "192.0.2.3:4000", "alice", alice)
+	if err := register(server, conn, message); err != nil {
+		t.Fatalf("expected the holder to register again, got %v", err)
+	}
+
+	server.mutex.Lock()
+	peer, ok := server.lookupUsername("", "Alice")
+	server.mutex.Unlock()
+	if !ok || peer.ID != message.PeerID {
+		t.Fatalf("expected the username to point to the last session, got %+v", peer)
+	}
+}
+
+func TestUsernameReleased(t *testing.T) {
+	server := newTestServer(t)
+
+	conn, message := registration(t, server, "192.0.2.1:4000", "alice", newIdentity(t))
+	if err := register(server, conn, message); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reservations of offline holders outlive them until the timeout
+	server.mutex.Lock()
+	server.removePeer(server.peers[message.PeerID])
+	server.pruneReservations(time.Now(), time.Hour)
+	_, reserved := server.reservations[reservationKey("", "alice")]
+	server.pruneReservations(time.Now().Add(2*time.Hour), time.Hour)
+	_, kept := server.reservations[reservationKey("", "alice")]
+	server.mutex.Unlock()
+
+	if !reserved || kept {
+		t.Fatalf("expected the reservation to be released after the timeout, reserved %v, kept %v", reserved, kept)
+	}
+
+	conn, message = registration(t, server, "192.0.2.2:4000", "alice", newIdentity(t))
+	if err := register(server, conn, message); err != nil {
+		t.Fatalf("expected the released username to be taken by another identity, got %v", err)
+	}
+}
+
+func TestRegistrationRejected(t *testing.T) {
+	server := newTestServer(t)
+	identity, other := newIdentity(t), newIdentity(t)
+
+	for _, test := range []struct {
+		name   string
+		change func(*fakeConn, *shared.Message)
+		err    error
+	}{
+		{
+			name:   "signature mismatch",
+			change: func(conn *fakeConn, message *shared.Message) { message.Content.(*shared.Registration).Username = "bob" },
+			err:    shared.ErrAuthFailed,
+		},
+		{
+			name: "wrong identity key",
+			change: func(conn *fakeConn, message *shared.Message) {
+				message.Content.(*shared.Registration).IdentityKey = base64.StdEncoding.EncodeToString(other.Public().(ed25519.PublicKey))
+			},
+			err: shared.ErrAuthFailed,
+		},
+		{
+			name: "signed for another server",
+			change: func(conn *fakeConn, message *shared.Message) {
+				other := &Server{publicKey: server.publicKey}
+				other.publicKey[0] ^= 1
+				sign(other, message, identity)
+			},
+			err: shared.ErrAuthFailed,
+		},
+		{
+			name: "session key of another peer",
+			change: func(conn *fakeConn, message *shared.Message) {
+				other, _ := registration(t, server, "192.0.2.2:4000", "alice", identity)
+				conn.secret = other.secret
+			},
+			err: shared.ErrAuthFailed,
+		},
+		{
+			name: "malformed identity key",
+			change: func(conn *fakeConn, message *shared.Message) {
+				message.Content.(*shared.Registration).IdentityKey = "key"
+			},
+			err: shared.ErrMalformed,
+		},
+		{name: "empty username", change: rename(server, identity, ""), err: shared.ErrInvalidRequest},
+		{name: "padded username", change: rename(server, identity, " alice"), err: shared.ErrInvalidRequest},
+		{name: "control character", change: rename(server, identity, "al\x00ice"), err: shared.ErrInvalidRequest},
+		{name: "long username", change: rename(server, identity, strings.Repeat("a", maxUsernameLength+1)), err: shared.ErrInvalidRequest},
+	} {
+		conn, message := registration(t, server, "192.0.2.1:4000", "alice", identity)
+		test.change(conn, message)
+
+		if err := register(server, conn, message); !errors.Is(err, test.err) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+
+	if len(server.reservations) != 0 {
+		t.Fatalf("expected no username to be reserved, got %d", len(server.reservations))
+	}
+}
+
+func rename(server *Server, identity ed25519.PrivateKey, username string) func(*fakeConn, *shared.Message) {
+	return func(conn *fakeConn, message *shared.Message) {
+		message.Content.(*shared.Registration).Username = username
+		sign(server, message, identity)
+	}
+}
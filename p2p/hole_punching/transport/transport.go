@@ -0,0 +1,375 @@
+package transport
+
+import (
+	"errors"
+	"hash/maphash"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+
+	"p2p/shared"
+)
+
+// Maximum time Stop waits for in-flight handlers before closing the socket
+const drainTimeout = 5 * time.Second
+
+// UDP socket with its sender and receiver loops and the table of conns,
+// shared by the rendez-vous server and the clients
+type Transport struct {
+	conn            *net.UDPConn
+	conns           shared.Conns
+	mutex           *sync.Mutex
+	sendChan        chan *shared.UDPPayload
+	messageCallback func(shared.Conn, *shared.Message)
+	payloadCallback func(shared.Conn, []byte, error)
+	errorCallback   func(error)
+	filter          func(*net.UDPAddr) bool
+	connFilter      func(*net.UDPAddr) bool
+	// Number of conns by IP
+	ips map[string]int
+	// Queues of the workers, a goroutine handles each datagram when there are none
+	queues []chan datagram
+	seed   maphash.Seed
+	// Socket reading and writing batches of datagrams, nil when batchSize is 1
+	batch     batchConn
+	batchSize int
+	// Messages of the batches written by the sender
+	outgoing []ipv4.Message
+	exit     chan struct{}
+	// Closed once the in-flight handlers drained, the conns no longer queue payloads then
+	senderExit chan struct{}
+	stopOnce   *sync.Once
+	// Closed once the receiver returned, no handler starts after that
+	receiverExit chan struct{}
+	// Whether Listen started the loops, guarded by the lifecycle mutex so that Listen and Stop never race
+	listening bool
+	lifecycle *sync.Mutex
+	// Sender, receiver and workers
+	wg       *sync.WaitGroup
+	handlers *sync.WaitGroup
+}
+
+func (transport *Transport) sender() {
+	defer transport.wg.Done()
+
+	payloads := make([]*shared.UDPPayload, 0, transport.batchSize)
+
+	for {
+		select {
+		case <-transport.senderExit:
+			transport.flush(payloads)
+			return
+		case payload := <-transport.sendChan:
+			transport.write(transport.collect(append(payloads[:0], payload)))
+		}
+	}
+}
+
+// Write the payloads still queued when the transport stops
+func (transport *Transport) flush(payloads []*shared.UDPPayload) {
+	for {
+		payloads = transport.collect(payloads[:0])
+		if len(payloads) == 0 {
+			return
+		}
+
+		transport.write(payloads)
+	}
+}
+
+// The buffer goes back to the pool once the callbacks return, they must copy the bytes they keep
+func (transport *Transport) serve(datagram datagram) {
+	defer transport.handlers.Done()
+	defer buffers.Put(datagram.buffer)
+
+	b := (*datagram.buffer)[:datagram.n]
+
+	message, err := shared.MessageIn(datagram.conn, b)
+	if err != nil {
+		transport.payloadCallback(datagram.conn, b, err)
+		return
+	}
+
+	transport.messageCallback(datagram.conn, message)
+}
+
+func (transport *Transport) receiver() {
+	defer transport.wg.Done()
+	defer close(transport.receiverExit)
+	defer transport.closeQueues()
+
+	batch := newReadBatch(transport.batchSize)
+
+	for {
+		select {
+		case <-transport.exit:
+			return
+		default:
+		}
+
+		transport.conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := transport.read(batch)
+		if err != nil {
+			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+				continue
+			}
+
+			transport.errorCallback(err)
+			return
+		}
+
+		for i := range n {
+			addr, ok := batch.messages[i].Addr.(*net.UDPAddr)
+			if !ok || addr == nil || !transport.filter(addr) {
+				continue
+			}
+
+			transport.mutex.Lock()
+			conn, ok := transport.conns[addr.String()]
+			if !ok {
+				conn = shared.NewUDPConn(transport.sendChan, transport.senderExit, addr)
+				if transport.connFilter(addr) {
+					transport.addConn(addr.String(), conn)
+				}
+			}
+			transport.mutex.Unlock()
+
+			// Process message, its buffer now belongs to the handler
+			transport.dispatch(datagram{buffer: batch.buffers[i], n: batch.messages[i].N, conn: conn})
+			batch.refill(i)
+		}
+	}
+}
+
+func (transport *Transport) CreateConn(addr net.Addr) (shared.Conn, error) {
+	if addr == nil {
+		return nil, errors.New("conns addr must not be nil")
+	}
+
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return nil, errors.New("could not assert net.Addr to *net.UDPAddr")
+	}
+
+	conn := shared.NewUDPConn(transport.sendChan, transport.senderExit, udpAddr)
+
+	transport.mutex.Lock()
+	transport.addConn(addr.String(), conn)
+	transport.mutex.Unlock()
+
+	return conn, nil
+}
+
+// Must be called with the mutex held
+func (transport *Transport) addConn(addr string, conn shared.Conn) {
+	if _, ok := transport.conns[addr]; !ok {
+		transport.ips[conn.GetAddr().(*net.UDPAddr).IP.String()] += 1
+	}
+
+	transport.conns[addr] = conn
+}
+
+func (transport *Transport) GetConn(addr string) (shared.Conn, bool) {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	conn, ok := transport.conns[addr]
+	return conn, ok
+}
+
+func (transport *Transport) DeleteConn(addr string) {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	conn, ok := transport.conns[addr]
+	if !ok {
+		return
+	}
+
+	ip := conn.GetAddr().(*net.UDPAddr).IP.String()
+	transport.ips[ip] -= 1
+	if transport.ips[ip] == 0 {
+		delete(transport.ips, ip)
+	}
+
+	delete(transport.conns, addr)
+}
+
+// Addresses of the conns in the table
+func (transport *Transport) Addrs() []string {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	addrs := make([]string, 0, len(transport.conns))
+	for addr := range transport.conns {
+		addrs = append(addrs, addr)
+	}
+
+	return addrs
+}
+
+// Number of conns with this IP in the table
+func (transport *Transport) CountConns(ip string) int {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	return transport.ips[ip]
+}
+
+func (transport *Transport) OnMessage(callback func(conn shared.Conn, message *shared.Message)) {
+	transport.messageCallback = callback
+}
+
+// Called with the raw payload when a datagram is not a valid message
+func (transport *Transport) OnUnknownPayload(callback func(conn shared.Conn, bytes []byte, err error)) {
+	transport.payloadCallback = callback
+}
+
+// Called with the socket errors, which are logged by default
+func (transport *Transport) OnError(callback func(err error)) {
+	transport.errorCallback = callback
+}
+
+// Datagrams are dropped, before any processing, when the filter returns false
+func (transport *Transport) SetFilter(filter func(addr *net.UDPAddr) bool) {
+	transport.filter = filter
+}
+
+// Datagrams from an address without a conn get a new conn, which is only kept in the table
+// when the filter returns true. Otherwise the callbacks get a detached conn, that CreateConn can keep later.
+func (transport *Transport) SetConnFilter(filter func(addr *net.UDPAddr) bool) {
+	transport.connFilter = filter
+}
+
+// Send raw bytes on the UDP socket, bypassing the message encoding. The bytes are dropped once the transport stopped.
+func (transport *Transport) SendBytes(bytes []byte, addr *net.UDPAddr) {
+	payload := make([]byte, len(bytes))
+	copy(payload, bytes)
+
+	select {
+	case transport.sendChan <- &shared.UDPPayload{Bytes: payload, Addr: addr}:
+	case <-transport.senderExit:
+	}
+}
+
+// Payloads waiting for the sender
+func (transport *Transport) QueueLength() int {
+	return len(transport.sendChan)
+}
+
+func (transport *Transport) LocalAddr() net.Addr {
+	return transport.conn.LocalAddr()
+}
+
+func (transport *Transport) SetReadBuffer(bytes int) error {
+	return transport.conn.SetReadBuffer(bytes)
+}
+
+func (transport *Transport) SetWriteBuffer(bytes int) error {
+	return transport.conn.SetWriteBuffer(bytes)
+}
+
+// Stop reading, drain the in-flight handlers, flush the queued payloads and close the socket.
+// The later calls wait until the transport stopped and do nothing.
+func (transport *Transport) Stop() {
+	transport.stopOnce.Do(transport.stop)
+}
+
+// The handlers still running after the drain timeout can no longer send once the sender exited
+func (transport *Transport) stop() {
+	transport.lifecycle.Lock()
+	close(transport.exit)
+	listening := transport.listening
+	transport.lifecycle.Unlock()
+
+	// Wake the receiver up instead of waiting for its read deadline, the handlers are only counted once it returned
+	if listening {
+		transport.conn.SetReadDeadline(time.Now())
+		<-transport.receiverExit
+	}
+
+	drained := make(chan bool)
+	go func() {
+		transport.handlers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(drainTimeout):
+		transport.errorCallback(errors.New("timed out draining in-flight handlers"))
+	}
+
+	close(transport.senderExit)
+	transport.wg.Wait()
+	transport.conn.Close()
+}
+
+// Read and handle the datagrams until the transport stops, returns once it stopped.
+// A read error other than a timeout also stops it.
+func (transport *Transport) Listen() {
+	// Added before starting the goroutines so that Stop always waits for them, unless it already stopped
+	transport.lifecycle.Lock()
+	select {
+	case <-transport.exit:
+		transport.lifecycle.Unlock()
+		return
+	default:
+	}
+	transport.listening = true
+	transport.wg.Add(2 + len(transport.queues))
+	transport.lifecycle.Unlock()
+
+	go transport.sender()
+
+	for _, queue := range transport.queues {
+		go transport.worker(queue)
+	}
+
+	transport.receiver()
+	transport.Stop()
+}
+
+func NewTransport(addrStr string) (*Transport, error) {
+	// Create UDP addr
+	addr, err := net.ResolveUDPAddr("udp", addrStr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create UDP conn
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &Transport{
+		conn:            conn,
+		conns:           make(shared.Conns),
+		mutex:           &sync.Mutex{},
+		sendChan:        make(chan *shared.UDPPayload, 100),
+		messageCallback: func(conn shared.Conn, message *shared.Message) {},
+		errorCallback:   func(err error) { log.Print(err) },
+		filter:          func(addr *net.UDPAddr) bool { return true },
+		connFilter:      func(addr *net.UDPAddr) bool { return true },
+		ips:             make(map[string]int),
+		seed:            maphash.MakeSeed(),
+		batchSize:       1,
+		exit:            make(chan struct{}),
+		senderExit:      make(chan struct{}),
+		stopOnce:        &sync.Once{},
+		receiverExit:    make(chan struct{}),
+		lifecycle:       &sync.Mutex{},
+		wg:              &sync.WaitGroup{},
+		handlers:        &sync.WaitGroup{},
+	}
+
+	transport.payloadCallback = func(conn shared.Conn, bytes []byte, err error) {
+		transport.errorCallback(err)
+	}
+
+	return transport, nil
+}
@@ -0,0 +1,134 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"p2p/shared"
+)
+
+// Socket reading and writing several datagrams per syscall, with recvmmsg and sendmmsg on Linux.
+// Both ipv4.PacketConn and ipv6.PacketConn implement it, on other platforms they handle one datagram per call.
+type batchConn interface {
+	ReadBatch(messages []ipv4.Message, flags int) (int, error)
+	WriteBatch(messages []ipv4.Message, flags int) (int, error)
+}
+
+// Wildcard addresses are dual-stack sockets, which need the IPv6 socket options
+func newBatchConn(conn *net.UDPConn) batchConn {
+	if conn.LocalAddr().(*net.UDPAddr).IP.To4() != nil {
+		return ipv4.NewPacketConn(conn)
+	}
+
+	return ipv6.NewPacketConn(conn)
+}
+
+// Buffers of the datagrams read at once, each one is handed over to the handlers and replaced
+type readBatch struct {
+	messages []ipv4.Message
+	buffers  []*[]byte
+}
+
+func newReadBatch(size int) *readBatch {
+	batch := &readBatch{
+		messages: make([]ipv4.Message, size),
+		buffers:  make([]*[]byte, size),
+	}
+
+	for i := range batch.messages {
+		batch.refill(i)
+	}
+
+	return batch
+}
+
+func (batch *readBatch) refill(i int) {
+	batch.buffers[i] = buffers.Get().(*[]byte)
+	batch.messages[i].Buffers = [][]byte{*batch.buffers[i]}
+}
+
+// Read at least one datagram, with a single syscall
+func (transport *Transport) read(batch *readBatch) (int, error) {
+	if transport.batch == nil {
+		n, addr, err := transport.conn.ReadFromUDP(*batch.buffers[0])
+		batch.messages[0].N, batch.messages[0].Addr = n, addr
+
+		if err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+
+	return transport.batch.ReadBatch(batch.messages, 0)
+}
+
+// Take the payloads already queued, up to the batch size
+func (transport *Transport) collect(payloads []*shared.UDPPayload) []*shared.UDPPayload {
+	for len(payloads) < cap(payloads) {
+		select {
+		case payload := <-transport.sendChan:
+			payloads = append(payloads, payload)
+		default:
+			return payloads
+		}
+	}
+
+	return payloads
+}
+
+// Write the payloads, a payload which cannot be sent is reported and skipped
+func (transport *Transport) write(payloads []*shared.UDPPayload) {
+	if transport.batch == nil {
+		for _, payload := range payloads {
+			transport.writeOne(payload)
+		}
+		return
+	}
+
+	messages := transport.outgoing[:len(payloads)]
+	for i, payload := range payloads {
+		messages[i].Buffers[0] = payload.Bytes
+		messages[i].Addr = payload.Addr
+	}
+
+	for sent := 0; sent < len(payloads); {
+		// n is negative on errors
+		n, err := transport.batch.WriteBatch(messages[sent:], 0)
+		sent += max(n, 0)
+
+		// The batch stopped at the first datagram which could not be sent, it is sent again on its own
+		// so that a transient error does not drop it and a persistent one is reported with its address
+		if (err != nil || n == 0) && sent < len(payloads) {
+			transport.writeOne(payloads[sent])
+			sent += 1
+		}
+	}
+}
+
+func (transport *Transport) writeOne(payload *shared.UDPPayload) {
+	_, err := transport.conn.WriteToUDP(payload.Bytes, payload.Addr)
+	if err != nil {
+		transport.errorCallback(fmt.Errorf("could not send datagram to %s: %w", payload.Addr, err))
+	}
+}
+
+// Read and write up to size datagrams per syscall, must be called before Listen.
+// A size of 1 or less reads and writes one datagram at a time.
+func (transport *Transport) SetBatchSize(size int) {
+	transport.batch = nil
+	transport.batchSize = 1
+
+	if size <= 1 {
+		return
+	}
+
+	transport.batch = newBatchConn(transport.conn)
+	transport.batchSize = size
+	transport.outgoing = make([]ipv4.Message, size)
+	for i := range transport.outgoing {
+		transport.outgoing[i].Buffers = make([][]byte, 1)
+	}
+}
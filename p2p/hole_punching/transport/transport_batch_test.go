@@ -0,0 +1,133 @@
+package transport
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"p2p/shared"
+)
+
+var batchSizes = []struct {
+	name string
+	size int
+}{
+	{"single", 1},
+	{"batch", 32},
+}
+
+func TestWriteReportsFailedDatagram(t *testing.T) {
+	receiver := newTestTransport(t)
+	sender := newTestTransport(t)
+	sender.SetBatchSize(8)
+
+	var errs []error
+	sender.OnError(func(err error) {
+		errs = append(errs, err)
+	})
+
+	addr := receiver.LocalAddr().(*net.UDPAddr)
+	// An IPv6 destination cannot be reached from an IPv4 socket
+	unreachable := &net.UDPAddr{IP: net.IPv6loopback, Port: addr.Port}
+
+	sender.write([]*shared.UDPPayload{
+		{Bytes: []byte("first"), Addr: addr},
+		{Bytes: []byte("unreachable"), Addr: unreachable},
+		{Bytes: []byte("last"), Addr: addr},
+	})
+
+	// The datagrams around the failed one are still sent
+	buffer := make([]byte, bufferSize)
+	for _, expected := range []string{"first", "last"} {
+		receiver.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, _, err := receiver.conn.ReadFromUDP(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(buffer[:n]) != expected {
+			t.Fatalf("expected %q, got %q", expected, buffer[:n])
+		}
+	}
+
+	if len(errs) != 1 {
+		t.Fatalf("expected the failed datagram to be reported once, got %v", errs)
+	}
+}
+
+// Datagrams written per second to a loopback socket which nobody reads, the kernel drops them once its buffer is full
+func BenchmarkWrite(b *testing.B) {
+	for _, batchSize := range batchSizes {
+		b.Run(batchSize.name, func(b *testing.B) {
+			sink := newTestTransport(b)
+			sender := newTestTransport(b)
+			sender.SetBatchSize(batchSize.size)
+
+			payloads := make([]*shared.UDPPayload, batchSize.size)
+			for i := range payloads {
+				payloads[i] = &shared.UDPPayload{Bytes: make([]byte, 128), Addr: sink.LocalAddr().(*net.UDPAddr)}
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for written := 0; written < b.N; written += len(payloads) {
+				sender.write(payloads)
+			}
+
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "datagrams/s")
+		})
+	}
+}
+
+// Datagrams read per second from a loopback socket flooded by another goroutine
+func BenchmarkRead(b *testing.B) {
+	for _, batchSize := range batchSizes {
+		b.Run(batchSize.name, func(b *testing.B) {
+			receiver := newTestTransport(b)
+			receiver.SetBatchSize(batchSize.size)
+			receiver.SetReadBuffer(4 << 20)
+
+			flooder, err := net.DialUDP("udp", nil, receiver.LocalAddr().(*net.UDPAddr))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer flooder.Close()
+
+			done := make(chan struct{})
+			var flooding sync.WaitGroup
+			flooding.Go(func() {
+				payload := make([]byte, 128)
+				for {
+					select {
+					case <-done:
+						return
+					default:
+						flooder.Write(payload)
+					}
+				}
+			})
+
+			batch := newReadBatch(batchSize.size)
+			receiver.conn.SetReadDeadline(time.Now().Add(time.Minute))
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for read := 0; read < b.N; {
+				n, err := receiver.read(batch)
+				if err != nil {
+					b.Fatal(err)
+				}
+				read += n
+			}
+
+			b.StopTimer()
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "datagrams/s")
+
+			close(done)
+			flooding.Wait()
+		})
+	}
+}
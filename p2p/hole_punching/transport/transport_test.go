@@ -0,0 +1,220 @@
+package transport
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"p2p/shared"
+)
+
+// Transport listening on a loopback port, stopped at the end of the test
+func newTestTransport(t testing.TB) *Transport {
+	t.Helper()
+
+	transport, err := NewTransport("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(transport.Stop)
+
+	return transport
+}
+
+func receive[T any](t testing.TB, received chan T) T {
+	t.Helper()
+
+	select {
+	case value := <-received:
+		return value
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a datagram")
+	}
+
+	var zero T
+	return zero
+}
+
+func TestConnTable(t *testing.T) {
+	transport := newTestTransport(t)
+
+	first := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	second := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 2000}
+
+	for _, addr := range []*net.UDPAddr{first, second, first} {
+		if _, err := transport.CreateConn(addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := transport.CountConns("10.0.0.1"); n != 2 {
+		t.Fatalf("expected 2 conns for the IP, got %d", n)
+	}
+
+	if addrs := transport.Addrs(); len(addrs) != 2 {
+		t.Fatalf("expected 2 addresses, got %v", addrs)
+	}
+
+	conn, ok := transport.GetConn(first.String())
+	if !ok || conn.GetAddr().String() != first.String() {
+		t.Fatalf("expected the conn of %s, got %v", first, conn)
+	}
+
+	transport.DeleteConn(first.String())
+	transport.DeleteConn(first.String())
+
+	if _, ok := transport.GetConn(first.String()); ok {
+		t.Fatal("expected the conn to be deleted")
+	}
+
+	if n := transport.CountConns("10.0.0.1"); n != 1 {
+		t.Fatalf("expected 1 conn for the IP, got %d", n)
+	}
+}
+
+func TestCreateConnRejectsOtherAddrs(t *testing.T) {
+	transport := newTestTransport(t)
+
+	if _, err := transport.CreateConn(nil); err == nil {
+		t.Fatal("expected an error for a nil addr")
+	}
+
+	if _, err := transport.CreateConn(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}); err == nil {
+		t.Fatal("expected an error for a TCP addr")
+	}
+}
+
+func TestSendAndReceive(t *testing.T) {
+	server := newTestTransport(t)
+	client := newTestTransport(t)
+
+	// The server answers every message on the conn it came from
+	server.OnMessage(func(conn shared.Conn, message *shared.Message) {
+		conn.Send(&shared.Message{Type: message.Type + "-answer", PeerID: message.PeerID})
+	})
+
+	answers := make(chan *shared.Message, 1)
+	client.OnMessage(func(conn shared.Conn, message *shared.Message) {
+		answers <- message
+	})
+
+	go server.Listen()
+	go client.Listen()
+
+	conn, err := client.CreateConn(server.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = conn.Send(&shared.Message{Type: "ping", PeerID: "peer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	answer := receive(t, answers)
+	if answer.Type != "ping-answer" || answer.PeerID != "peer" {
+		t.Fatalf("unexpected answer %+v", answer)
+	}
+
+	// The server kept a conn for the client
+	if _, ok := server.GetConn(client.LocalAddr().String()); !ok {
+		t.Fatal("expected the server to keep a conn for the client")
+	}
+}
+
+func TestEncryptedMessages(t *testing.T) {
+	server := newTestTransport(t)
+	client := newTestTransport(t)
+
+	var secret [32]byte
+	copy(secret[:], "a shared secret of thirty two b.")
+
+	received := make(chan *shared.Message, 1)
+	server.OnMessage(func(conn shared.Conn, message *shared.Message) {
+		received <- message
+	})
+
+	// The server knows the secret of the client before it sends
+	serverConn, err := server.CreateConn(client.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn.SetSecret(secret)
+
+	go server.Listen()
+	go client.Listen()
+
+	conn, err := client.CreateConn(server.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetSecret(secret)
+
+	err = conn.Send(&shared.Message{Type: "secret", Content: "hello", Encrypt: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := receive(t, received)
+	if !message.Encrypt || message.Content != "hello" {
+		t.Fatalf("expected a decrypted message, got %+v", message)
+	}
+}
+
+func TestFilters(t *testing.T) {
+	server := newTestTransport(t)
+	client := newTestTransport(t)
+
+	blocked := newTestTransport(t)
+	blockedAddr := blocked.LocalAddr().String()
+
+	server.SetFilter(func(addr *net.UDPAddr) bool {
+		return addr.String() != blockedAddr
+	})
+	// Conns are only kept once created explicitly
+	server.SetConnFilter(func(addr *net.UDPAddr) bool {
+		return false
+	})
+
+	received := make(chan string, 2)
+	server.OnMessage(func(conn shared.Conn, message *shared.Message) {
+		received <- message.Type
+	})
+
+	go server.Listen()
+	go client.Listen()
+	go blocked.Listen()
+
+	blocked.SendBytes([]byte(`{"type":"blocked"}`), server.LocalAddr().(*net.UDPAddr))
+
+	// The filtered datagram is dropped, the next one comes through
+	time.Sleep(50 * time.Millisecond)
+	client.SendBytes([]byte(`{"type":"allowed"}`), server.LocalAddr().(*net.UDPAddr))
+
+	if messageType := receive(t, received); messageType != "allowed" {
+		t.Fatalf("expected the allowed message, got %s", messageType)
+	}
+
+	if _, ok := server.GetConn(client.LocalAddr().String()); ok {
+		t.Fatal("expected the conn filter to keep the conn out of the table")
+	}
+}
+
+func TestUnknownPayload(t *testing.T) {
+	server := newTestTransport(t)
+	client := newTestTransport(t)
+
+	payloads := make(chan string, 1)
+	server.OnUnknownPayload(func(conn shared.Conn, bytes []byte, err error) {
+		payloads <- string(bytes)
+	})
+
+	go server.Listen()
+	go client.Listen()
+
+	client.SendBytes([]byte("not a message"), server.LocalAddr().(*net.UDPAddr))
+
+	if payload := receive(t, payloads); payload != "not a message" {
+		t.Fatalf("unexpected payload %q", payload)
+	}
+}
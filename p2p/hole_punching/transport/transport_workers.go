@@ -0,0 +1,80 @@
+package transport
+
+import (
+	"hash/maphash"
+	"net"
+	"sync"
+
+	"p2p/shared"
+)
+
+const (
+	// Largest datagram read from the socket
+	bufferSize = 2048
+	// Datagrams waiting for each worker, the receiver blocks when the queue is full
+	workerQueueSize = 64
+)
+
+// Receive buffers are reused once the datagram has been handled
+var buffers = &sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, bufferSize)
+		return &buffer
+	},
+}
+
+// Datagram read from the socket, waiting to be handled
+type datagram struct {
+	buffer *[]byte
+	n      int
+	conn   shared.Conn
+}
+
+// Handle the datagrams of a queue in order, until the receiver closes it
+func (transport *Transport) worker(queue chan datagram) {
+	defer transport.wg.Done()
+
+	for datagram := range queue {
+		transport.serve(datagram)
+	}
+}
+
+// Datagrams of the same address always go to the same worker, so that they are handled in order
+func (transport *Transport) dispatch(datagram datagram) {
+	transport.handlers.Add(1)
+
+	if transport.queues == nil {
+		go transport.serve(datagram)
+		return
+	}
+
+	// IPv4 addresses may be stored in 4 or 16 bytes
+	addr := datagram.conn.GetAddr().(*net.UDPAddr).AddrPort()
+	ip := addr.Addr().Unmap().As16()
+
+	index := (maphash.Bytes(transport.seed, ip[:]) + uint64(addr.Port())) % uint64(len(transport.queues))
+	transport.queues[index] <- datagram
+}
+
+func (transport *Transport) closeQueues() {
+	for _, queue := range transport.queues {
+		close(queue)
+	}
+}
+
+// Handle the datagrams with a fixed number of workers instead of a goroutine per datagram, must be called before Listen.
+// Every handler of a worker waits for the previous one, so callbacks must not block.
+// When responses are sent faster than the socket can write them, the handlers block on the send queue,
+// then the worker queues fill up and the receiver stops reading, leaving the datagrams in the socket buffer.
+// Less than one worker goes back to a goroutine per datagram.
+func (transport *Transport) SetWorkers(workers int) {
+	if workers < 1 {
+		transport.queues = nil
+		return
+	}
+
+	transport.queues = make([]chan datagram, workers)
+	for i := range transport.queues {
+		transport.queues[i] = make(chan datagram, workerQueueSize)
+	}
+}
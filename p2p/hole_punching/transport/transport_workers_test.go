@@ -0,0 +1,133 @@
+package transport
+
+import (
+	"net"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"p2p/shared"
+)
+
+// Sockets flooding the benchmarked transport, their datagrams are spread over the workers by address
+const flooders = 8
+
+func TestWorkers(t *testing.T) {
+	for _, workers := range []int{-1, 0, 1, 4} {
+		receiver := newTestTransport(t)
+		receiver.SetWorkers(workers)
+
+		received := make(chan string, 20)
+		receiver.OnMessage(func(conn shared.Conn, message *shared.Message) {
+			received <- message.Type
+		})
+
+		sender := newTestTransport(t)
+		go receiver.Listen()
+		go sender.Listen()
+
+		conn, err := sender.CreateConn(receiver.LocalAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range cap(received) {
+			if err := conn.Send(&shared.Message{Type: strconv.Itoa(i), PeerID: "peer"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// The worker of an address handles its datagrams in order, goroutines in any order
+		seen := make(map[string]bool)
+		for i := range cap(received) {
+			messageType := receive(t, received)
+			if workers > 0 && messageType != strconv.Itoa(i) {
+				t.Fatalf("%d workers: expected message %d, got %s", workers, i, messageType)
+			}
+			seen[messageType] = true
+		}
+
+		if len(seen) != cap(received) {
+			t.Fatalf("%d workers: expected every message once, got %v", workers, seen)
+		}
+	}
+}
+
+// Encrypted messages handled per second, decrypted and decoded by a goroutine per datagram,
+// by one worker or by a worker per CPU
+func BenchmarkWorkers(b *testing.B) {
+	for _, workers := range []int{0, 1, runtime.GOMAXPROCS(0)} {
+		name := strconv.Itoa(workers)
+		if workers == 0 {
+			name = "goroutines"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			receiver := newTestTransport(b)
+			receiver.SetWorkers(workers)
+			receiver.SetReadBuffer(4 << 20)
+
+			var secret [32]byte
+			copy(secret[:], "a shared secret of thirty two b.")
+
+			var handled atomic.Int64
+			done := make(chan struct{})
+			receiver.OnMessage(func(conn shared.Conn, message *shared.Message) {
+				if handled.Add(1) == int64(b.N) {
+					close(done)
+				}
+			})
+
+			var flooding sync.WaitGroup
+			stop := make(chan struct{})
+			for range flooders {
+				flooder, err := net.DialUDP("udp", nil, receiver.LocalAddr().(*net.UDPAddr))
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer flooder.Close()
+
+				// The receiver knows the secret of every flooder
+				conn, err := receiver.CreateConn(flooder.LocalAddr())
+				if err != nil {
+					b.Fatal(err)
+				}
+				conn.SetSecret(secret)
+
+				bytes, err := shared.MessageOut(conn, &shared.Message{
+					Type:    "keepalive",
+					PeerID:  "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+					Encrypt: true,
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				flooding.Go(func() {
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+							flooder.Write(bytes)
+						}
+					}
+				})
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			go receiver.Listen()
+			<-done
+
+			b.StopTimer()
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "messages/s")
+
+			close(stop)
+			flooding.Wait()
+		})
+	}
+}
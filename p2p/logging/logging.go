@@ -0,0 +1,114 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Value logged instead of the sensitive attributes
+const redacted = "[REDACTED]"
+
+// Attributes whose values are never logged, whatever the handler: session secrets, private keys,
+// resumption tokens, greeting cookies and pairing codes with their nameplates, which authenticate the peers that join them
+var SensitiveKeys = map[string]bool{
+	"secret":     true,
+	"privateKey": true,
+	"token":      true,
+	"cookie":     true,
+	"code":       true,
+	"nameplate":  true,
+	"nonce":      true,
+}
+
+// Handler replacing the values of the sensitive attributes before the wrapped handler sees them
+type redactHandler struct {
+	handler slog.Handler
+}
+
+// Wrap a handler so that it never logs the values of the sensitive attributes
+func Redact(handler slog.Handler) slog.Handler {
+	if _, ok := handler.(*redactHandler); ok {
+		return handler
+	}
+
+	return &redactHandler{handler: handler}
+}
+
+func (handler *redactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return handler.handler.Enabled(ctx, level)
+}
+
+func (handler *redactHandler) Handle(ctx context.Context, record slog.Record) error {
+	clean := slog.NewRecord(record.Time, record.Level, record.Message, record.PC)
+
+	record.Attrs(func(attr slog.Attr) bool {
+		clean.AddAttrs(redact(attr))
+		return true
+	})
+
+	return handler.handler.Handle(ctx, clean)
+}
+
+func (handler *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clean := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		clean[i] = redact(attr)
+	}
+
+	return &redactHandler{handler: handler.handler.WithAttrs(clean)}
+}
+
+func (handler *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{handler: handler.handler.WithGroup(name)}
+}
+
+func redact(attr slog.Attr) slog.Attr {
+	if SensitiveKeys[attr.Key] {
+		return slog.String(attr.Key, redacted)
+	}
+
+	value := attr.Value.Resolve()
+	if value.Kind() != slog.KindGroup {
+		return slog.Attr{Key: attr.Key, Value: value}
+	}
+
+	group := value.Group()
+	clean := make([]any, len(group))
+	for i, member := range group {
+		clean[i] = redact(member)
+	}
+
+	return slog.Group(attr.Key, clean...)
+}
+
+// Logger writing text or JSON records at or above the level, with the sensitive attributes redacted
+func New(w io.Writer, level slog.Leveler, format string) (*slog.Logger, error) {
+	options := &slog.HandlerOptions{Level: level}
+
+	switch strings.ToLower(format) {
+	case "text", "":
+		return slog.New(Redact(slog.NewTextHandler(w, options))), nil
+	case "json":
+		return slog.New(Redact(slog.NewJSONHandler(w, options))), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %s", format)
+	}
+}
+
+func ParseLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info", "":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return slog.LevelInfo, fmt.Errorf("unknown log level %s", level)
+	}
+}
@@ -0,0 +1,260 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Labels set on every series of a metric, e.g. the listen address of a server
+type Labels map[string]string
+
+// Upper bounds in seconds of the default histogram buckets, from 5ms to 30s
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Series of a metric family, written in the Prometheus text format
+type collector interface {
+	write(w io.Writer, name string)
+}
+
+type family struct {
+	help       string
+	kind       string
+	collectors []collector
+}
+
+// Metrics of the servers and clients of a process, served in the Prometheus text format.
+// Metrics of the same name registered several times, with different constant labels, form one family.
+type Registry struct {
+	families map[string]*family
+	names    []string
+	mutex    *sync.Mutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		families: make(map[string]*family),
+		mutex:    &sync.Mutex{},
+	}
+}
+
+func (registry *Registry) register(name string, help string, kind string, collector collector) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	metric, ok := registry.families[name]
+	if !ok {
+		metric = &family{help: help, kind: kind}
+		registry.families[name] = metric
+		registry.names = append(registry.names, name)
+	}
+
+	metric.collectors = append(metric.collectors, collector)
+}
+
+// Write every metric in the Prometheus text format
+func (registry *Registry) Write(w io.Writer) {
+	registry.mutex.Lock()
+	names := append([]string(nil), registry.names...)
+	families := make([]family, len(names))
+	for i, name := range names {
+		families[i] = *registry.families[name]
+	}
+	registry.mutex.Unlock()
+
+	for i, name := range names {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, families[i].help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, families[i].kind)
+
+		for _, collector := range families[i].collectors {
+			collector.write(w, name)
+		}
+	}
+}
+
+func (registry *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	registry.Write(w)
+}
+
+// Counter with a series per value of its labels
+type Counter struct {
+	constLabels Labels
+	labels      []string
+	values      map[string]*series
+	mutex       *sync.Mutex
+}
+
+type series struct {
+	labels []string
+	value  float64
+}
+
+// Counter whose series are selected by the values of labels when it is incremented
+func (registry *Registry) Counter(name string, help string, constLabels Labels, labels ...string) *Counter {
+	counter := &Counter{
+		constLabels: constLabels,
+		labels:      labels,
+		values:      make(map[string]*series),
+		mutex:       &sync.Mutex{},
+	}
+
+	registry.register(name, help, "counter", counter)
+
+	return counter
+}
+
+// Values must be given in the order of the labels of the counter
+func (counter *Counter) Inc(values ...string) {
+	counter.Add(1, values...)
+}
+
+func (counter *Counter) Add(delta float64, values ...string) {
+	key := strings.Join(values, "\x00")
+
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+
+	entry, ok := counter.values[key]
+	if !ok {
+		entry = &series{labels: values}
+		counter.values[key] = entry
+	}
+
+	entry.value += delta
+}
+
+func (counter *Counter) write(w io.Writer, name string) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+
+	keys := make([]string, 0, len(counter.values))
+	for key := range counter.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		entry := counter.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(counter.constLabels, counter.labels, entry.labels), formatValue(entry.value))
+	}
+}
+
+// Metric read when the registry is written
+type funcMetric struct {
+	constLabels Labels
+	value       func() float64
+}
+
+func (metric *funcMetric) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(metric.constLabels, nil, nil), formatValue(metric.value()))
+}
+
+// Gauge read from value when the registry is written
+func (registry *Registry) GaugeFunc(name string, help string, constLabels Labels, value func() float64) {
+	registry.register(name, help, "gauge", &funcMetric{constLabels: constLabels, value: value})
+}
+
+// Counter kept elsewhere, read from value when the registry is written
+func (registry *Registry) CounterFunc(name string, help string, constLabels Labels, value func() float64) {
+	registry.register(name, help, "counter", &funcMetric{constLabels: constLabels, value: value})
+}
+
+// Distribution of durations, in seconds
+type Histogram struct {
+	constLabels Labels
+	buckets     []float64
+	counts      []uint64
+	count       uint64
+	sum         float64
+	mutex       *sync.Mutex
+}
+
+// Histogram with the upper bounds of its buckets in seconds, DefaultBuckets if nil
+func (registry *Registry) Histogram(name string, help string, constLabels Labels, buckets []float64) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+
+	histogram := &Histogram{
+		constLabels: constLabels,
+		buckets:     buckets,
+		counts:      make([]uint64, len(buckets)),
+		mutex:       &sync.Mutex{},
+	}
+
+	registry.register(name, help, "histogram", histogram)
+
+	return histogram
+}
+
+func (histogram *Histogram) Observe(duration time.Duration) {
+	seconds := duration.Seconds()
+
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	for i, bound := range histogram.buckets {
+		if seconds <= bound {
+			histogram.counts[i] += 1
+		}
+	}
+
+	histogram.count += 1
+	histogram.sum += seconds
+}
+
+func (histogram *Histogram) write(w io.Writer, name string) {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	for i, bound := range histogram.buckets {
+		labels := formatLabels(histogram.constLabels, []string{"le"}, []string{formatValue(bound)})
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, labels, histogram.counts[i])
+	}
+
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(histogram.constLabels, []string{"le"}, []string{"+Inf"}), histogram.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, formatLabels(histogram.constLabels, nil, nil), formatValue(histogram.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, formatLabels(histogram.constLabels, nil, nil), histogram.count)
+}
+
+// Constant labels first, sorted by name, then the labels of the series
+func formatLabels(constLabels Labels, names []string, values []string) string {
+	if len(constLabels) == 0 && len(names) == 0 {
+		return ""
+	}
+
+	constNames := make([]string, 0, len(constLabels))
+	for name := range constLabels {
+		constNames = append(constNames, name)
+	}
+	sort.Strings(constNames)
+
+	pairs := make([]string, 0, len(constNames)+len(names))
+	for _, name := range constNames {
+		pairs = append(pairs, name+"="+strconv.Quote(constLabels[name]))
+	}
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs = append(pairs, name+"="+strconv.Quote(value))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
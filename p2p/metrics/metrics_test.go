@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWrite(t *testing.T) {
+	registry := NewRegistry()
+
+	// Two servers of the same process form one family
+	for _, addr := range []string{"0.0.0.0:9001", "0.0.0.0:9002"} {
+		requests := registry.Counter("rdv_requests_total", "Requests handled", Labels{"addr": addr}, "type", "result")
+		requests.Inc("register", "ok")
+		requests.Add(2, "establish", "error")
+	}
+
+	registry.GaugeFunc("rdv_peers", "Registered peers", nil, func() float64 { return 3 })
+
+	latency := registry.Histogram("rdv_punch_seconds", "Time to punch", Labels{"addr": "0.0.0.0:9001"}, []float64{0.1, 1})
+	latency.Observe(50 * time.Millisecond)
+	latency.Observe(500 * time.Millisecond)
+	latency.Observe(5 * time.Second)
+
+	expected := `# HELP rdv_requests_total Requests handled
+# TYPE rdv_requests_total counter
+rdv_requests_total{addr="0.0.0.0:9001",type="establish",result="error"} 2
+rdv_requests_total{addr="0.0.0.0:9001",type="register",result="ok"} 1
+rdv_requests_total{addr="0.0.0.0:9002",type="establish",result="error"} 2
+rdv_requests_total{addr="0.0.0.0:9002",type="register",result="ok"} 1
+# HELP rdv_peers Registered peers
+# TYPE rdv_peers gauge
+rdv_peers 3
+# HELP rdv_punch_seconds Time to punch
+# TYPE rdv_punch_seconds histogram
+rdv_punch_seconds_bucket{addr="0.0.0.0:9001",le="0.1"} 1
+rdv_punch_seconds_bucket{addr="0.0.0.0:9001",le="1"} 2
+rdv_punch_seconds_bucket{addr="0.0.0.0:9001",le="+Inf"} 3
+rdv_punch_seconds_sum{addr="0.0.0.0:9001"} 5.55
+rdv_punch_seconds_count{addr="0.0.0.0:9001"} 3
+`
+
+	var output strings.Builder
+	registry.Write(&output)
+
+	if output.String() != expected {
+		t.Fatalf("unexpected exposition:\n%s\nexpected:\n%s", output.String(), expected)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	registry := NewRegistry()
+	registry.CounterFunc("rdv_banned_total", "Datagrams of banned sources", nil, func() float64 { return 1e6 })
+
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Fatalf("expected the Prometheus text format, got %s", contentType)
+	}
+
+	if body := recorder.Body.String(); !strings.Contains(body, "# TYPE rdv_banned_total counter\nrdv_banned_total 1e+06\n") {
+		t.Fatalf("unexpected body %s", body)
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	for _, test := range []struct {
+		constLabels Labels
+		names       []string
+		values      []string
+		expected    string
+	}{
+		{expected: ""},
+		{constLabels: Labels{"b": "2", "a": "1"}, expected: `{a="1",b="2"}`},
+		{names: []string{"type"}, values: []string{`say "hi"`}, expected: `{type="say \"hi\""}`},
+		{names: []string{"type", "result"}, values: []string{"register"}, expected: `{type="register",result=""}`},
+	} {
+		if labels := formatLabels(test.constLabels, test.names, test.values); labels != test.expected {
+			t.Errorf("expected %s, got %s", test.expected, labels)
+		}
+	}
+}
@@ -1,3 +1,3 @@
 #!/bin/sh
 
-go run rdv/main.go
\ No newline at end of file
+go run ./rdv "$@"
\ No newline at end of file
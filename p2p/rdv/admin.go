@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"p2p/hole_punching/server"
+)
+
+// Admin API of the servers of the daemon, every request must carry the token as a bearer token
+type admin struct {
+	servers []*server.Server
+	token   []byte
+}
+
+// Peer with the listen address of the server it registered with
+type adminPeer struct {
+	Server string `json:"server"`
+	server.PeerInfo
+}
+
+type adminConn struct {
+	Server string `json:"server"`
+	server.ConnInfo
+}
+
+type adminBan struct {
+	server.Ban
+	// Ban duration, forever if empty
+	Duration string `json:"duration,omitempty"`
+}
+
+func newAdmin(servers []*server.Server, tokenPath string) (*admin, error) {
+	text, err := os.ReadFile(tokenPath)
+	if err != nil {
+		return nil, err
+	}
+
+	token := strings.TrimSpace(string(text))
+	if len(token) < 16 {
+		return nil, fmt.Errorf("%s must contain a token of at least 16 characters", tokenPath)
+	}
+
+	return &admin{servers: servers, token: []byte(token)}, nil
+}
+
+func (admin *admin) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /peers", admin.peers)
+	mux.HandleFunc("GET /peers/{id}", admin.peer)
+	mux.HandleFunc("POST /peers/{id}/kick", admin.kick)
+	mux.HandleFunc("POST /peers/{id}/ban", admin.banPeer)
+	mux.HandleFunc("GET /conns", admin.conns)
+	mux.HandleFunc("GET /bans", admin.bans)
+	mux.HandleFunc("POST /bans", admin.ban)
+	mux.HandleFunc("DELETE /bans/{kind}/{value}", admin.unban)
+	mux.HandleFunc("GET /stats", admin.stats)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), admin.token) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid admin token"))
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (admin *admin) peers(w http.ResponseWriter, r *http.Request) {
+	peers := []adminPeer{}
+	for _, udpServer := range admin.servers {
+		for _, info := range udpServer.Peers() {
+			peers = append(peers, adminPeer{Server: udpServer.LocalAddr().String(), PeerInfo: info})
+		}
+	}
+
+	writeJSON(w, http.StatusOK, peers)
+}
+
+func (admin *admin) peer(w http.ResponseWriter, r *http.Request) {
+	udpServer, info, ok := admin.findPeer(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("peer %s is not registered", r.PathValue("id")))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, adminPeer{Server: udpServer.LocalAddr().String(), PeerInfo: info})
+}
+
+func (admin *admin) kick(w http.ResponseWriter, r *http.Request) {
+	udpServer, _, ok := admin.findPeer(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("peer %s is not registered", r.PathValue("id")))
+		return
+	}
+
+	if err := udpServer.Kick(r.PathValue("id")); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Kick the peer and ban its IP and identity key on every server, for the duration query parameter or forever
+func (admin *admin) banPeer(w http.ResponseWriter, r *http.Request) {
+	duration, err := parseDuration(r.URL.Query().Get("duration"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	udpServer, info, ok := admin.findPeer(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("peer %s is not registered", r.PathValue("id")))
+		return
+	}
+
+	if err := udpServer.BanPeer(info.ID, duration); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	ip, _, _ := net.SplitHostPort(info.NAT.Endpoint)
+	for _, other := range admin.servers {
+		if other == udpServer {
+			continue
+		}
+
+		other.Ban(server.Ban{Kind: "ip", Value: ip}, duration)
+		if info.Fingerprint != "" {
+			other.Ban(server.Ban{Kind: "identity", Value: info.Fingerprint}, duration)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (admin *admin) conns(w http.ResponseWriter, r *http.Request) {
+	conns := []adminConn{}
+	for _, udpServer := range admin.servers {
+		for _, info := range udpServer.Conns() {
+			conns = append(conns, adminConn{Server: udpServer.LocalAddr().String(), ConnInfo: info})
+		}
+	}
+
+	writeJSON(w, http.StatusOK, conns)
+}
+
+// Bans are the same on every server, they are set on all of them
+func (admin *admin) bans(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, admin.servers[0].Bans())
+}
+
+func (admin *admin) ban(w http.ResponseWriter, r *http.Request) {
+	var ban adminBan
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&ban); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	duration, err := parseDuration(ban.Duration)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	for _, udpServer := range admin.servers {
+		if err := udpServer.Ban(ban.Ban, duration); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (admin *admin) unban(w http.ResponseWriter, r *http.Request) {
+	ban := server.Ban{Kind: r.PathValue("kind"), Value: r.PathValue("value")}
+
+	found := false
+	for _, udpServer := range admin.servers {
+		if udpServer.Unban(ban) {
+			found = true
+		}
+	}
+
+	if !found {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s %s is not banned", ban.Kind, ban.Value))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (admin *admin) stats(w http.ResponseWriter, r *http.Request) {
+	statuses := make([]server.Status, len(admin.servers))
+	for i, udpServer := range admin.servers {
+		statuses[i] = udpServer.Status()
+	}
+
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func (admin *admin) findPeer(id string) (*server.Server, server.PeerInfo, bool) {
+	for _, udpServer := range admin.servers {
+		if info, ok := udpServer.Peer(id); ok {
+			return udpServer, info, true
+		}
+	}
+
+	return nil, server.PeerInfo{}, false
+}
+
+func parseDuration(text string) (time.Duration, error) {
+	if text == "" {
+		return 0, nil
+	}
+
+	duration, err := time.ParseDuration(text)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("invalid duration %q", text)
+	}
+
+	return duration, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"p2p/hole_punching/client"
+	"p2p/hole_punching/server"
+)
+
+const testToken = "0123456789abcdef0123456789abcdef"
+
+// Admin API of two listening servers, stopped at the end of the test
+func newTestAdmin(t testing.TB) (*httptest.Server, []*server.Server) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	servers := make([]*server.Server, 2)
+	for i := range servers {
+		udpServer, err := server.NewServer("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		udpServer.SetLogger(slog.New(slog.DiscardHandler))
+		t.Cleanup(udpServer.Stop)
+
+		go udpServer.Listen(ctx)
+		servers[i] = udpServer
+	}
+
+	path := filepath.Join(t.TempDir(), "admin.token")
+	if err := os.WriteFile(path, []byte(testToken+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	api, err := newAdmin(servers, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpServer := httptest.NewServer(api.handler())
+	t.Cleanup(httpServer.Close)
+
+	return httpServer, servers
+}
+
+// Client registered with the server
+func registerTestClient(t testing.TB, username string, udpServer *server.Server) {
+	t.Helper()
+
+	options := client.DefaultOptions()
+	options.BindAddr = "127.0.0.1"
+	options.ServerAddr = udpServer.LocalAddr().String()
+	options.Logger = slog.New(slog.DiscardHandler)
+
+	peer, err := client.NewClient(username, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(peer.Stop)
+
+	if err := peer.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := peer.Register(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Send an admin request with the token, decode the JSON answer into out unless it is nil
+func call(t testing.TB, httpServer *httptest.Server, method string, path string, body string, out any) int {
+	t.Helper()
+
+	req, err := http.NewRequest(method, httpServer.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testToken)
+
+	res, err := httpServer.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if out != nil {
+		if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+
+	return res.StatusCode
+}
+
+func TestAdminNeedsTheToken(t *testing.T) {
+	httpServer, _ := newTestAdmin(t)
+
+	for _, authorization := range []string{"", "Bearer ", "Bearer wrong", "Basic " + testToken, testToken, "Bearer " + testToken + "0"} {
+		req, err := http.NewRequest("GET", httpServer.URL+"/peers", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+
+		res, err := httpServer.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusUnauthorized || !strings.Contains(string(body), "invalid admin token") {
+			t.Errorf("expected %q to be unauthorized, got %d %s", authorization, res.StatusCode, body)
+		}
+	}
+
+	// Tokens must not be guessable
+	path := filepath.Join(t.TempDir(), "short.token")
+	os.WriteFile(path, []byte("short\n"), 0600)
+	if _, err := newAdmin(nil, path); err == nil {
+		t.Fatal("expected a short token to be rejected")
+	}
+}
+
+func TestAdminPeers(t *testing.T) {
+	httpServer, servers := newTestAdmin(t)
+	registerTestClient(t, "alice", servers[0])
+	registerTestClient(t, "bob", servers[1])
+
+	var peers []adminPeer
+	if status := call(t, httpServer, "GET", "/peers", "", &peers); status != http.StatusOK || len(peers) != 2 {
+		t.Fatalf("expected the peers of both servers, got %d %+v", status, peers)
+	}
+
+	var alice adminPeer
+	for _, peer := range peers {
+		if peer.Username == "alice" {
+			alice = peer
+		}
+	}
+	if alice.Server != servers[0].LocalAddr().String() || alice.Fingerprint == "" || alice.NAT.Endpoint == "" {
+		t.Fatalf("expected alice with the server she registered with, got %+v", alice)
+	}
+
+	var peer adminPeer
+	if status := call(t, httpServer, "GET", "/peers/"+alice.ID, "", &peer); status != http.StatusOK || peer.ID != alice.ID {
+		t.Fatalf("expected alice, got %d %+v", status, peer)
+	}
+	if status := call(t, httpServer, "GET", "/peers/unknown", "", nil); status != http.StatusNotFound {
+		t.Fatalf("expected an unknown peer not to be found, got %d", status)
+	}
+
+	var conns []adminConn
+	if status := call(t, httpServer, "GET", "/conns", "", &conns); status != http.StatusOK || len(conns) < 2 {
+		t.Fatalf("expected the conns of both peers, got %d %+v", status, conns)
+	}
+
+	var statuses []server.Status
+	if status := call(t, httpServer, "GET", "/stats", "", &statuses); status != http.StatusOK || len(statuses) != 2 || statuses[0].Peers != 1 {
+		t.Fatalf("expected the status of both servers, got %d %+v", status, statuses)
+	}
+
+	// Banning alice bans her IP and identity key on every server
+	if status := call(t, httpServer, "POST", "/peers/"+alice.ID+"/ban?duration=1h", "", nil); status != http.StatusNoContent {
+		t.Fatalf("expected alice to be banned, got %d", status)
+	}
+	for _, udpServer := range servers {
+		if bans := udpServer.Bans(); len(bans) != 2 || bans[0].Value != alice.Fingerprint || bans[1].Value != "127.0.0.1" {
+			t.Fatalf("expected the IP and identity key of alice to be banned, got %+v", bans)
+		}
+	}
+
+	if status := call(t, httpServer, "POST", "/peers/"+alice.ID+"/kick", "", nil); status != http.StatusNotFound {
+		t.Fatalf("expected the banned peer to be gone, got %d", status)
+	}
+	if status := call(t, httpServer, "POST", "/peers/"+peers[0].ID+"/ban?duration=-1h", "", nil); status != http.StatusBadRequest {
+		t.Fatalf("expected a negative duration to be rejected, got %d", status)
+	}
+}
+
+func TestAdminKick(t *testing.T) {
+	httpServer, servers := newTestAdmin(t)
+	registerTestClient(t, "alice", servers[0])
+
+	id := servers[0].Peers()[0].ID
+	if status := call(t, httpServer, "POST", "/peers/"+id+"/kick", "", nil); status != http.StatusNoContent {
+		t.Fatalf("expected alice to be kicked, got %d", status)
+	}
+
+	// Kicked peers are not banned, they can register again
+	if bans := servers[0].Bans(); len(bans) != 0 {
+		t.Fatalf("expected no ban, got %+v", bans)
+	}
+}
+
+func TestAdminBans(t *testing.T) {
+	httpServer, servers := newTestAdmin(t)
+
+	if status := call(t, httpServer, "POST", "/bans", `{"kind":"ip","value":"2001:db8::1","duration":"1h"}`, nil); status != http.StatusNoContent {
+		t.Fatalf("expected the IP to be banned, got %d", status)
+	}
+
+	var bans []server.Ban
+	if status := call(t, httpServer, "GET", "/bans", "", &bans); status != http.StatusOK || len(bans) != 1 || bans[0].Expires.IsZero() {
+		t.Fatalf("expected the ban to expire, got %d %+v", status, bans)
+	}
+	if len(servers[1].Bans()) != 1 {
+		t.Fatal("expected the ban to be set on every server")
+	}
+
+	for _, body := range []string{`{"kind":"ip","value":"not an IP"}`, `{"kind":"port","value":"9001"}`, `{"kind":"ip","value":"192.0.2.1","duration":"soon"}`, `{`} {
+		if status := call(t, httpServer, "POST", "/bans", body, nil); status != http.StatusBadRequest {
+			t.Errorf("expected %s to be rejected, got %d", body, status)
+		}
+	}
+
+	if status := call(t, httpServer, "DELETE", "/bans/ip/2001:db8::1", "", nil); status != http.StatusNoContent {
+		t.Fatalf("expected the IP to be unbanned, got %d", status)
+	}
+	if status := call(t, httpServer, "DELETE", "/bans/ip/2001:db8::1", "", nil); status != http.StatusNotFound {
+		t.Fatalf("expected the IP to no longer be banned, got %d", status)
+	}
+}
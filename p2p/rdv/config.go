@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"p2p/crypto"
+	"p2p/hole_punching/server"
+)
+
+type Config struct {
+	// UDP addresses to listen on, each one is an independent rendez-vous
+	// since peers of different address families cannot punch each other
+	Listen []string `yaml:"listen"`
+	// File holding the base64 private key of the server, created if missing
+	KeyPath            string        `yaml:"key"`
+	PeerTimeout        time.Duration `yaml:"peerTimeout"`
+	CodeTimeout        time.Duration `yaml:"codeTimeout"`
+	RequestTimeout     time.Duration `yaml:"requestTimeout"`
+	ReservationTimeout time.Duration `yaml:"reservationTimeout"`
+	RateLimit          float64       `yaml:"rateLimit"`
+	RateBurst          int           `yaml:"rateBurst"`
+	IntroductionRate   float64       `yaml:"introductionRate"`
+	IntroductionBurst  int           `yaml:"introductionBurst"`
+	MaxConnsPerIP      int           `yaml:"maxConnsPerIP"`
+	MaxPeersPerIP      int           `yaml:"maxPeersPerIP"`
+	LogLevel           string        `yaml:"logLevel"`
+	// Format of the log records: text or json
+	LogFormat string `yaml:"logFormat"`
+	// UDP address the other servers of the cluster reach this one at, empty if the server is alone
+	ClusterAdvertise string `yaml:"clusterAdvertise"`
+	// UDP addresses of the other servers of the cluster
+	ClusterMembers []string `yaml:"clusterMembers"`
+	// File holding the base64 secret shared by the servers of the cluster
+	ClusterKeyPath string `yaml:"clusterKey"`
+	// Directory of the peers of the cluster: memory, or redis://[:password@]host:port[/db]
+	Directory string `yaml:"directory"`
+	// File the registered peers and the usernames are saved to, restored on restart, empty keeps them in memory
+	RegistryPath string `yaml:"registry"`
+	// HTTP address the Prometheus metrics are served at on /metrics, empty disables them
+	Metrics string `yaml:"metrics"`
+	// HTTP address of the admin API, empty disables it
+	Admin string `yaml:"admin"`
+	// File holding the bearer token of the admin API
+	AdminTokenPath string `yaml:"adminToken"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen:             []string{"0.0.0.0:9001"},
+		KeyPath:            "",
+		PeerTimeout:        2 * time.Minute,
+		CodeTimeout:        10 * time.Minute,
+		RequestTimeout:     time.Minute,
+		ReservationTimeout: 30 * 24 * time.Hour,
+		RateLimit:          50,
+		RateBurst:          100,
+		IntroductionRate:   1,
+		IntroductionBurst:  10,
+		MaxConnsPerIP:      64,
+		MaxPeersPerIP:      32,
+		LogLevel:           "info",
+		LogFormat:          "text",
+		Directory:          "memory",
+	}
+}
+
+type flags struct {
+	configPath         *string
+	listen             *string
+	keyPath            *string
+	peerTimeout        *time.Duration
+	codeTimeout        *time.Duration
+	requestTimeout     *time.Duration
+	reservationTimeout *time.Duration
+	rateLimit          *float64
+	rateBurst          *int
+	introductionRate   *float64
+	introductionBurst  *int
+	maxConnsPerIP      *int
+	maxPeersPerIP      *int
+	logLevel           *string
+	logFormat          *string
+	clusterAdvertise   *string
+	clusterMembers     *string
+	clusterKeyPath     *string
+	directory          *string
+	registryPath       *string
+	metrics            *string
+	admin              *string
+	adminTokenPath     *string
+}
+
+func parseFlags() *flags {
+	defaults := defaultConfig()
+
+	flags := &flags{
+		configPath:         flag.String("config", "", "Path of the YAML configuration file"),
+		listen:             flag.String("listen", strings.Join(defaults.Listen, ","), "Comma separated UDP addresses to listen on"),
+		keyPath:            flag.String("key", defaults.KeyPath, "Path of the server identity key, created if missing (ephemeral key if empty)"),
+		peerTimeout:        flag.Duration("peer-timeout", defaults.PeerTimeout, "Remove registered peers not seen for this long (0 keeps them forever)"),
+		codeTimeout:        flag.Duration("code-timeout", defaults.CodeTimeout, "Pairing codes can be joined for this long after their creation"),
+		requestTimeout:     flag.Duration("request-timeout", defaults.RequestTimeout, "Connection requests can be accepted for this long"),
+		reservationTimeout: flag.Duration("reservation-timeout", defaults.ReservationTimeout, "Release usernames nobody registered with for this long (0 keeps them forever)"),
+		rateLimit:          flag.Float64("rate-limit", defaults.RateLimit, "Datagrams per second accepted from a single IP (0 disables rate limiting)"),
+		rateBurst:          flag.Int("rate-burst", defaults.RateBurst, "Datagrams a single IP can send in a burst above the rate limit"),
+		introductionRate:   flag.Float64("introduction-rate", defaults.IntroductionRate, "Establish, code-join and group-join requests per second accepted from a single IP (0 disables the limit)"),
+		introductionBurst:  flag.Int("introduction-burst", defaults.IntroductionBurst, "Introduction requests a single IP can send in a burst above the introduction rate"),
+		maxConnsPerIP:      flag.Int("max-conns-per-ip", defaults.MaxConnsPerIP, "Conns a single IP can open, including unregistered ones (0 is unlimited)"),
+		maxPeersPerIP:      flag.Int("max-peers-per-ip", defaults.MaxPeersPerIP, "Peers a single IP can register (0 is unlimited)"),
+		logLevel:           flag.String("log-level", defaults.LogLevel, "Log level: debug, info or error"),
+		logFormat:          flag.String("log-format", defaults.LogFormat, "Format of the log records: text or json"),
+		clusterAdvertise:   flag.String("cluster-advertise", defaults.ClusterAdvertise, "UDP address the other servers of the cluster reach this one at (empty if the server is alone)"),
+		clusterMembers:     flag.String("cluster-members", strings.Join(defaults.ClusterMembers, ","), "Comma separated UDP addresses of the other servers of the cluster"),
+		clusterKeyPath:     flag.String("cluster-key", defaults.ClusterKeyPath, "Path of the base64 secret shared by the servers of the cluster"),
+		directory:          flag.String("directory", defaults.Directory, "Directory of the peers of the cluster: memory, or redis://[:password@]host:port[/db]"),
+		registryPath:       flag.String("registry", defaults.RegistryPath, "Path of the file the registered peers and usernames are saved to, restored on restart (kept in memory if empty)"),
+		metrics:            flag.String("metrics", defaults.Metrics, "HTTP address to serve the Prometheus metrics at on /metrics (disabled if empty)"),
+		admin:              flag.String("admin", defaults.Admin, "HTTP address of the admin API (disabled if empty)"),
+		adminTokenPath:     flag.String("admin-token", defaults.AdminTokenPath, "Path of the file holding the bearer token of the admin API"),
+	}
+
+	flag.Parse()
+
+	return flags
+}
+
+// Load the configuration file, if any, then apply the flags set on the command line
+func loadConfig(flags *flags) (*Config, error) {
+	config := defaultConfig()
+
+	if *flags.configPath != "" {
+		bytes, err := os.ReadFile(*flags.configPath)
+		if err != nil {
+			return nil, err
+		}
+
+		err = yaml.Unmarshal(bytes, config)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s: %w", *flags.configPath, err)
+		}
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			config.Listen = strings.Split(*flags.listen, ",")
+		case "key":
+			config.KeyPath = *flags.keyPath
+		case "peer-timeout":
+			config.PeerTimeout = *flags.peerTimeout
+		case "code-timeout":
+			config.CodeTimeout = *flags.codeTimeout
+		case "request-timeout":
+			config.RequestTimeout = *flags.requestTimeout
+		case "reservation-timeout":
+			config.ReservationTimeout = *flags.reservationTimeout
+		case "rate-limit":
+			config.RateLimit = *flags.rateLimit
+		case "rate-burst":
+			config.RateBurst = *flags.rateBurst
+		case "introduction-rate":
+			config.IntroductionRate = *flags.introductionRate
+		case "introduction-burst":
+			config.IntroductionBurst = *flags.introductionBurst
+		case "max-conns-per-ip":
+			config.MaxConnsPerIP = *flags.maxConnsPerIP
+		case "max-peers-per-ip":
+			config.MaxPeersPerIP = *flags.maxPeersPerIP
+		case "log-level":
+			config.LogLevel = *flags.logLevel
+		case "log-format":
+			config.LogFormat = *flags.logFormat
+		case "cluster-advertise":
+			config.ClusterAdvertise = *flags.clusterAdvertise
+		case "cluster-members":
+			config.ClusterMembers = strings.Split(*flags.clusterMembers, ",")
+		case "cluster-key":
+			config.ClusterKeyPath = *flags.clusterKeyPath
+		case "directory":
+			config.Directory = *flags.directory
+		case "registry":
+			config.RegistryPath = *flags.registryPath
+		case "metrics":
+			config.Metrics = *flags.metrics
+		case "admin":
+			config.Admin = *flags.admin
+		case "admin-token":
+			config.AdminTokenPath = *flags.adminTokenPath
+		}
+	})
+
+	if len(config.Listen) == 0 {
+		return nil, errors.New("at least one listen address is required")
+	}
+
+	if config.Admin != "" && config.AdminTokenPath == "" {
+		return nil, errors.New("the admin API needs a token")
+	}
+
+	if config.ClusterAdvertise != "" {
+		if len(config.Listen) != 1 {
+			return nil, errors.New("a server of a cluster listens on a single address")
+		}
+
+		if config.ClusterKeyPath == "" {
+			return nil, errors.New("the servers of a cluster need a shared key")
+		}
+
+		if len(config.ClusterMembers) > 0 && config.Directory == "memory" {
+			return nil, errors.New("the servers of a cluster need a shared directory")
+		}
+	}
+
+	return config, nil
+}
+
+// Server options which can be reloaded without restarting
+func (config *Config) options() (server.Options, error) {
+	logLevel, err := server.ParseLogLevel(config.LogLevel)
+	if err != nil {
+		return server.Options{}, err
+	}
+
+	return server.Options{
+		PeerTimeout:        config.PeerTimeout,
+		CodeTimeout:        config.CodeTimeout,
+		RequestTimeout:     config.RequestTimeout,
+		ReservationTimeout: config.ReservationTimeout,
+		RateLimit:          config.RateLimit,
+		RateBurst:          config.RateBurst,
+		IntroductionRate:   config.IntroductionRate,
+		IntroductionBurst:  config.IntroductionBurst,
+		MaxConnsPerIP:      config.MaxConnsPerIP,
+		MaxPeersPerIP:      config.MaxPeersPerIP,
+		LogLevel:           logLevel,
+	}, nil
+}
+
+// Cluster the server joins, nil if the server is alone
+func (config *Config) cluster() (*server.Cluster, error) {
+	if config.ClusterAdvertise == "" {
+		return nil, nil
+	}
+
+	text, err := os.ReadFile(config.ClusterKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(text)))
+	if err != nil || len(bytes) != 32 {
+		return nil, fmt.Errorf("%s does not contain a base64 encoded 32 bytes key", config.ClusterKeyPath)
+	}
+
+	directory, err := newDirectory(config.Directory)
+	if err != nil {
+		return nil, err
+	}
+
+	cluster := &server.Cluster{
+		Advertise: config.ClusterAdvertise,
+		Members:   config.ClusterMembers,
+		Directory: directory,
+	}
+	copy(cluster.Key[:], bytes)
+
+	return cluster, nil
+}
+
+func newDirectory(spec string) (server.Directory, error) {
+	if spec == "memory" {
+		return server.NewMemoryDirectory(), nil
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil || u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("directory must be memory or redis://[:password@]host:port[/db], not %s", spec)
+	}
+
+	password, _ := u.User.Password()
+
+	db := 0
+	if path := strings.TrimPrefix(u.Path, "/"); path != "" {
+		db, err = strconv.Atoi(path)
+		if err != nil {
+			return nil, fmt.Errorf("redis database must be a number, not %s", path)
+		}
+	}
+
+	return server.NewRedisDirectory(u.Host, password, db), nil
+}
+
+// Load the identity key of the server, or generate and save it on first start
+func loadKeyPair(path string) ([32]byte, [32]byte, error) {
+	var privateKey [32]byte
+
+	text, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		var publicKey [32]byte
+		privateKey, publicKey, err = crypto.GenKeyPair()
+		if err != nil {
+			return privateKey, publicKey, err
+		}
+
+		encoded := base64.StdEncoding.EncodeToString(privateKey[:])
+		err = os.WriteFile(path, []byte(encoded+"\n"), 0600)
+
+		return privateKey, publicKey, err
+	}
+	if err != nil {
+		return privateKey, privateKey, err
+	}
+
+	bytes, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(text)))
+	if err != nil || len(bytes) != 32 {
+		return privateKey, privateKey, fmt.Errorf("%s does not contain a base64 encoded 32 bytes key", path)
+	}
+
+	copy(privateKey[:], bytes)
+
+	return privateKey, crypto.GenPublicKey(privateKey), nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"p2p/hole_punching/server"
+)
+
+// Parse the command line args on a fresh flag set, with the config file holding yaml if it is not empty
+func parseArgs(t testing.TB, yaml string, args ...string) *flags {
+	t.Helper()
+
+	commandLine, osArgs := flag.CommandLine, os.Args
+	t.Cleanup(func() {
+		flag.CommandLine, os.Args = commandLine, osArgs
+	})
+
+	if yaml != "" {
+		path := filepath.Join(t.TempDir(), "rdv.yaml")
+		if err := os.WriteFile(path, []byte(yaml), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		args = append([]string{"-config", path}, args...)
+	}
+
+	flag.CommandLine = flag.NewFlagSet("rdv", flag.ContinueOnError)
+	os.Args = append([]string{"rdv"}, args...)
+
+	return parseFlags()
+}
+
+func TestLoadConfig(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		yaml  string
+		args  []string
+		check func(*Config) bool
+	}{
+		{
+			name:  "defaults",
+			check: func(config *Config) bool { return reflect.DeepEqual(config, defaultConfig()) },
+		},
+		{
+			name: "file",
+			yaml: "peerTimeout: 5m\nrateLimit: 10\nlisten: [127.0.0.1:1000, '[::1]:1000']\n",
+			check: func(config *Config) bool {
+				return config.PeerTimeout == 5*time.Minute && config.RateLimit == 10 && len(config.Listen) == 2 &&
+					config.CodeTimeout == defaultConfig().CodeTimeout
+			},
+		},
+		{
+			name: "flags over file",
+			yaml: "peerTimeout: 5m\nrateLimit: 10\n",
+			args: []string{"-rate-limit", "20", "-listen", "127.0.0.1:1000,[::1]:1000"},
+			check: func(config *Config) bool {
+				return config.RateLimit == 20 && config.PeerTimeout == 5*time.Minute && len(config.Listen) == 2
+			},
+		},
+		{
+			name:  "flag set to its default",
+			yaml:  "logLevel: debug\n",
+			args:  []string{"-log-level", "info"},
+			check: func(config *Config) bool { return config.LogLevel == "info" },
+		},
+		{
+			name:  "example file",
+			args:  []string{"-config", "rdv.example.yaml"},
+			check: func(config *Config) bool { return config.KeyPath == "rdv.key" && len(config.Listen) > 0 },
+		},
+	} {
+		config, err := loadConfig(parseArgs(t, test.yaml, test.args...))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if !test.check(config) {
+			t.Errorf("%s: unexpected config %+v", test.name, config)
+		}
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		yaml string
+		args []string
+	}{
+		{name: "malformed file", yaml: "peerTimeout: [\n"},
+		{name: "missing file", args: []string{"-config", "missing.yaml"}},
+		{name: "no listen address", yaml: "listen: []\n"},
+		{name: "admin without token", args: []string{"-admin", "127.0.0.1:8080"}},
+		{name: "cluster on several addresses", args: []string{"-cluster-advertise", "192.0.2.1:9001", "-cluster-key", "key", "-listen", "0.0.0.0:9001,0.0.0.0:9002"}},
+		{name: "cluster without key", args: []string{"-cluster-advertise", "192.0.2.1:9001"}},
+		{name: "cluster in memory", yaml: "clusterAdvertise: 192.0.2.1:9001\nclusterKey: key\nclusterMembers: [192.0.2.2:9001]\n"},
+	} {
+		if _, err := loadConfig(parseArgs(t, test.yaml, test.args...)); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rdv.yaml")
+	if err := os.WriteFile(path, []byte("peerTimeout: 5m\nlogLevel: info\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	flags := parseArgs(t, "", "-config", path, "-rate-limit", "20")
+
+	current, err := loadConfig(flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	udpServer, err := server.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpServer.Stop()
+
+	// SIGHUP reloads the file, the flags still take precedence
+	if err := os.WriteFile(path, []byte("peerTimeout: 7m\nlogLevel: debug\nrateLimit: 10\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	reload(flags, current, []*server.Server{udpServer})
+
+	options := udpServer.GetOptions()
+	if options.PeerTimeout != 7*time.Minute || options.LogLevel != server.LogLevelDebug || options.RateLimit != 20 {
+		t.Fatalf("expected the reloaded options, got %+v", options)
+	}
+
+	// An invalid file keeps the current options
+	if err := os.WriteFile(path, []byte("logLevel: loud\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	reload(flags, current, []*server.Server{udpServer})
+
+	if udpServer.GetOptions() != options {
+		t.Fatalf("expected the options to be kept, got %+v", udpServer.GetOptions())
+	}
+}
@@ -1,19 +1,213 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"fmt"
 	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"p2p/hole_punching/server"
+	"p2p/logging"
+	"p2p/metrics"
 )
 
 func main() {
 	fmt.Println("UDP Hole Punching Rendez-Vous Server")
 
-	udpServer, err := server.NewServer("0.0.0.0:9001")
+	flags := parseFlags()
+
+	config, err := loadConfig(flags)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	options, err := config.options()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The servers filter the records with the reloadable log level
+	logger, err := logging.New(os.Stderr, slog.LevelDebug, config.LogFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+
+	var privateKey, publicKey [32]byte
+	if config.KeyPath != "" {
+		privateKey, publicKey, err = loadKeyPair(config.KeyPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("Server public key: %s", base64.StdEncoding.EncodeToString(publicKey[:]))
+	}
+
+	cluster, err := config.cluster()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	udpServer.Listen()
+	var registry *server.Registry
+	if config.RegistryPath != "" {
+		registry, err = server.OpenRegistry(config.RegistryPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Servers share the metrics, their series are labelled with their listen address
+	exported := metrics.NewRegistry()
+
+	servers := make([]*server.Server, 0, len(config.Listen))
+	for _, addr := range config.Listen {
+		udpServer, err := server.NewServer(addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if config.KeyPath != "" {
+			udpServer.SetKeyPair(privateKey, publicKey)
+		}
+
+		udpServer.SetOptions(options)
+		udpServer.SetLogger(logger)
+		udpServer.SetMetrics(exported)
+		servers = append(servers, udpServer)
+
+		if cluster != nil {
+			err = udpServer.SetCluster(*cluster)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			log.Printf("Joined cluster as %s with %d other servers", cluster.Advertise, len(cluster.Members))
+		}
+
+		// Restored peers are published in the directory of the cluster
+		if registry != nil {
+			err = udpServer.SetRegistry(registry)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		log.Printf("Listening on %s", udpServer.LocalAddr())
+	}
+
+	// Every server stops once the context is canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	listening := &sync.WaitGroup{}
+	for _, udpServer := range servers {
+		listening.Go(func() {
+			udpServer.Listen(ctx)
+		})
+	}
+
+	var metricsServer *http.Server
+	if config.Metrics != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", exported)
+		metricsServer = &http.Server{Addr: config.Metrics, Handler: mux}
+
+		go func() {
+			err := metricsServer.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+
+		log.Printf("Serving metrics on http://%s/metrics", config.Metrics)
+	}
+
+	var adminServer *http.Server
+	if config.Admin != "" {
+		api, err := newAdmin(servers, config.AdminTokenPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		adminServer = &http.Server{Addr: config.Admin, Handler: api.handler()}
+
+		go func() {
+			err := adminServer.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+
+		log.Printf("Serving the admin API on http://%s", config.Admin)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			reload(flags, config, servers)
+			continue
+		}
+
+		log.Printf("Received %s, shutting down", sig)
+		break
+	}
+
+	if metricsServer != nil {
+		metricsServer.Close()
+	}
+
+	if adminServer != nil {
+		adminServer.Close()
+	}
+
+	// Drain every server in parallel
+	cancel()
+	listening.Wait()
+
+	if cluster != nil {
+		cluster.Directory.Close()
+	}
+
+	if registry != nil {
+		registry.Close()
+	}
+}
+
+// Reload the configuration file, listen addresses and key need a restart
+func reload(flags *flags, current *Config, servers []*server.Server) {
+	config, err := loadConfig(flags)
+	if err != nil {
+		log.Printf("Could not reload configuration: %s", err)
+		return
+	}
+
+	options, err := config.options()
+	if err != nil {
+		log.Printf("Could not reload configuration: %s", err)
+		return
+	}
+
+	if fmt.Sprint(config.Listen) != fmt.Sprint(current.Listen) || config.KeyPath != current.KeyPath ||
+		config.RegistryPath != current.RegistryPath || config.Metrics != current.Metrics || config.LogFormat != current.LogFormat ||
+		config.Admin != current.Admin || config.AdminTokenPath != current.AdminTokenPath {
+		log.Print("Listen addresses, key, registry, metrics, log format and admin changes are only applied on restart")
+	}
+
+	if config.ClusterAdvertise != current.ClusterAdvertise || fmt.Sprint(config.ClusterMembers) != fmt.Sprint(current.ClusterMembers) ||
+		config.ClusterKeyPath != current.ClusterKeyPath || config.Directory != current.Directory {
+		log.Print("Cluster changes are only applied on restart")
+	}
+
+	for _, udpServer := range servers {
+		udpServer.SetOptions(options)
+		log.Printf("Dropped traffic on %s: %+v", udpServer.LocalAddr(), udpServer.GetStats())
+	}
+
+	log.Print("Configuration reloaded")
 }
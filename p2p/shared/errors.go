@@ -0,0 +1,115 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Code of an error answered by the rendez-vous server, stable across versions unlike the error text
+type ErrorCode string
+
+const (
+	// The request needs a registration first
+	ErrorCodeNotRegistered ErrorCode = "not_registered"
+	// The other peer is not registered with the server or the cluster
+	ErrorCodeUnknownPeer ErrorCode = "unknown_peer"
+	// The content of the request could not be decoded
+	ErrorCodeMalformed ErrorCode = "malformed"
+	// The request could be decoded but is not valid, e.g. a connection with ourselves or a too long username
+	ErrorCodeInvalidRequest ErrorCode = "invalid_request"
+	// Too many requests from our IP, try again later
+	ErrorCodeRateLimited ErrorCode = "rate_limited"
+	// Too many conns or peers from our IP, or the group is full
+	ErrorCodeLimitExceeded ErrorCode = "limit_exceeded"
+	// The keys or the signature of the request do not match
+	ErrorCodeAuthFailed ErrorCode = "auth_failed"
+	// The username is bound to another identity key
+	ErrorCodeUsernameTaken ErrorCode = "username_taken"
+	// Our IP or identity key is banned from the server
+	ErrorCodeBanned ErrorCode = "banned"
+	// The pairing code does not exist or expired
+	ErrorCodeInvalidCode ErrorCode = "invalid_code"
+	// No establish request of this peer waits for our consent
+	ErrorCodeNoPendingRequest ErrorCode = "no_pending_request"
+	// We are not a member of the group
+	ErrorCodeNotMember ErrorCode = "not_member"
+	// The other peer declined our establish request
+	ErrorCodeDeclined ErrorCode = "declined"
+	// The other peer did not answer our establish request in time
+	ErrorCodeTimeout ErrorCode = "timeout"
+	// The server does not handle this type of request
+	ErrorCodeUnknownType ErrorCode = "unknown_type"
+	// Any other error, also the errors of servers which do not send codes
+	ErrorCodeInternal ErrorCode = "internal"
+)
+
+// Error answered by the rendez-vous server, compare it to the sentinel errors with errors.Is
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (err *Error) Error() string {
+	return err.Message
+}
+
+// Errors with the same code match, whatever their message
+func (err *Error) Is(target error) bool {
+	other, ok := target.(*Error)
+	return ok && other.Code == err.Code
+}
+
+func NewError(code ErrorCode, format string, args ...any) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+var (
+	ErrNotRegistered    = &Error{Code: ErrorCodeNotRegistered, Message: "client is not registered with this server"}
+	ErrUnknownPeer      = &Error{Code: ErrorCodeUnknownPeer, Message: "peer is not registered"}
+	ErrMalformed        = &Error{Code: ErrorCodeMalformed, Message: "request content is malformed"}
+	ErrInvalidRequest   = &Error{Code: ErrorCodeInvalidRequest, Message: "invalid request"}
+	ErrRateLimited      = &Error{Code: ErrorCodeRateLimited, Message: "too many requests, try again later"}
+	ErrLimitExceeded    = &Error{Code: ErrorCodeLimitExceeded, Message: "limit exceeded"}
+	ErrAuthFailed       = &Error{Code: ErrorCodeAuthFailed, Message: "authentication failed"}
+	ErrUsernameTaken    = &Error{Code: ErrorCodeUsernameTaken, Message: "username is already taken"}
+	ErrBanned           = &Error{Code: ErrorCodeBanned, Message: "banned from this server"}
+	ErrInvalidCode      = &Error{Code: ErrorCodeInvalidCode, Message: "pairing code is invalid or expired"}
+	ErrNoPendingRequest = &Error{Code: ErrorCodeNoPendingRequest, Message: "no pending request"}
+	ErrNotMember        = &Error{Code: ErrorCodeNotMember, Message: "client is not a member of the group"}
+	ErrDeclined         = &Error{Code: ErrorCodeDeclined, Message: "peer declined the connection"}
+	ErrTimeout          = &Error{Code: ErrorCodeTimeout, Message: "peer did not answer the connection request"}
+	ErrUnknownType      = &Error{Code: ErrorCodeUnknownType, Message: "request type undefined"}
+	ErrInternal         = &Error{Code: ErrorCodeInternal, Message: "internal error"}
+)
+
+// Code of an error, internal unless it is an Error
+func CodeOf(err error) ErrorCode {
+	var protocolErr *Error
+	if errors.As(err, &protocolErr) {
+		return protocolErr.Code
+	}
+
+	return ErrorCodeInternal
+}
+
+// Error answered in the message, nil if there is none
+func (message *Message) Err() error {
+	if message.Error == "" {
+		return nil
+	}
+
+	code := message.Code
+	if code == "" {
+		code = ErrorCodeInternal
+	}
+
+	return &Error{Code: code, Message: message.Error}
+}
+
+// Answer a message with this error
+func (message *Message) SetErr(err error) *Message {
+	message.Error = err.Error()
+	message.Code = CodeOf(err)
+
+	return message
+}
@@ -0,0 +1,69 @@
+package shared
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestErrorsMatchByCode(t *testing.T) {
+	err := NewError(ErrorCodeUsernameTaken, "username %s is already taken", "alice")
+
+	if !errors.Is(err, ErrUsernameTaken) {
+		t.Fatal("expected errors of the same code to match, whatever their message")
+	}
+	if errors.Is(err, ErrAuthFailed) {
+		t.Fatal("expected errors of another code not to match")
+	}
+
+	// Wrapped errors keep their code
+	wrapped := fmt.Errorf("could not register: %w", err)
+	if !errors.Is(wrapped, ErrUsernameTaken) || CodeOf(wrapped) != ErrorCodeUsernameTaken {
+		t.Fatalf("expected the wrapped error to keep its code, got %s", CodeOf(wrapped))
+	}
+
+	if errors.Is(errors.New("username_taken"), ErrUsernameTaken) || CodeOf(errors.New("username_taken")) != ErrorCodeInternal {
+		t.Fatal("expected other errors to be internal")
+	}
+}
+
+func TestMessageErrRoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		code ErrorCode
+	}{
+		{NewError(ErrorCodeUnknownPeer, "peer %s is not registered", "bob"), ErrorCodeUnknownPeer},
+		{ErrRateLimited, ErrorCodeRateLimited},
+		{fmt.Errorf("establish: %w", ErrDeclined), ErrorCodeDeclined},
+		{errors.New("disk full"), ErrorCodeInternal},
+	} {
+		// Answers cross the wire as JSON
+		bytes, err := json.Marshal((&Message{Type: "establish"}).SetErr(test.err))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var message Message
+		if err := json.Unmarshal(bytes, &message); err != nil {
+			t.Fatal(err)
+		}
+
+		received := message.Err()
+		if received == nil || received.Error() != test.err.Error() || CodeOf(received) != test.code {
+			t.Errorf("expected %q with code %s, got %v with code %s", test.err, test.code, received, CodeOf(received))
+		}
+		if !errors.Is(received, &Error{Code: test.code}) {
+			t.Errorf("expected %q to match its code %s", test.err, test.code)
+		}
+	}
+
+	if err := (&Message{Type: "establish"}).Err(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// Servers which do not send codes answer internal errors
+	if err := (&Message{Type: "establish", Error: "peer: bob has not registered with the server"}).Err(); !errors.Is(err, ErrInternal) {
+		t.Fatalf("expected an error without code to be internal, got %v", err)
+	}
+}
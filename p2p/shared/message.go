@@ -1,11 +1,18 @@
 package shared
 
-import "net"
+import (
+	"encoding/binary"
+	"net"
+)
 
 type Message struct {
-	Type    string      `json:"type"`
-	PeerID  string      `json:"peerID,omitempty"`
-	Error   string      `json:"error,omitempty"`
+	Type   string `json:"type"`
+	PeerID string `json:"peerID,omitempty"`
+	// Set by the clients on their requests to the rendez-vous server, which echoes it in its answers
+	RequestID uint64 `json:"requestID,omitempty"`
+	Error     string `json:"error,omitempty"`
+	// Code of the error, compared by the clients instead of the text
+	Code    ErrorCode   `json:"code,omitempty"`
 	Content interface{} `json:"data,omitempty"`
 	Encrypt bool        `json:"-"`
 	addr    *net.UDPAddr
@@ -20,8 +27,147 @@ func (message *Message) SetAddr(addr *net.UDPAddr) *Message {
 	return message
 }
 
+// Message type greeting, sent again with the cookie the server answered
+type Greeting struct {
+	PublicKey string `json:"publicKey"`
+	Cookie    string `json:"cookie,omitempty"`
+}
+
 // Message type registration
 type Registration struct {
 	Username  string `json:"username"`
+	Namespace string `json:"namespace,omitempty"`
 	PublicKey string `json:"publicKey"`
+	// Listed and looked up by the other peers, hidden by default
+	Visible bool `json:"visible,omitempty"`
+	// Base64 ed25519 key the username is bound to on its first registration
+	IdentityKey string `json:"identityKey"`
+	// Signature of SignedData with the identity key
+	Signature string `json:"signature"`
+}
+
+// Bytes signed with the identity key, bound to the session key and to the rendez-vous server
+func (registration *Registration) SignedData(serverKey [32]byte) []byte {
+	var data []byte
+	for _, part := range []string{"p2p registration", registration.Namespace, registration.Username, registration.PublicKey, string(serverKey[:])} {
+		data = binary.BigEndian.AppendUint64(data, uint64(len(part)))
+		data = append(data, part...)
+	}
+
+	return data
+}
+
+// Message type lookup, by ID or by username in a namespace
+type Lookup struct {
+	ID        string `json:"id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// Message type consent, answer of the target of an establish request
+type Consent struct {
+	PeerID string `json:"peerID"`
+	Accept bool   `json:"accept"`
+}
+
+// Message type resume, sent by a peer whose endpoint changed to resume its session with PeerID.
+// The server relays it to that peer with the new endpoint of the sender in Peer.
+type Resume struct {
+	PeerID string `json:"peerID"`
+	// Random for every request, so that a token cannot be used twice
+	Nonce string `json:"nonce"`
+	// MAC of the requester ID and the nonce with the secret of the session, proves to the other peer that the requester holds it
+	Token string `json:"token"`
+	Peer  *Peer  `json:"peer,omitempty"`
+}
+
+// Message type cluster-establish, sent by the server of the requester to the server of the target
+type ClusterEstablish struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	RequestID uint64 `json:"requestID,omitempty"`
+}
+
+// Message type cluster-forward, message for a peer registered with the receiving server
+type ClusterForward struct {
+	PeerID    string      `json:"peerID"`
+	Type      string      `json:"type"`
+	RequestID uint64      `json:"requestID,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Code      ErrorCode   `json:"code,omitempty"`
+	Content   interface{} `json:"content,omitempty"`
+}
+
+// Message type list and subscribe, empty fields match every peer
+type PeerFilter struct {
+	// Prefix of the username, case insensitive
+	Username string `json:"username,omitempty"`
+	// Only the members of this group
+	Group string `json:"group,omitempty"`
+	// Number of peers skipped, to get the next page of a list
+	Offset int `json:"offset,omitempty"`
+}
+
+// Message type list
+type PeerList struct {
+	Peers []*Peer `json:"peers"`
+	More  bool    `json:"more,omitempty"`
+}
+
+// Message type presence, Online is false once the peer went offline or no longer matches the filter
+type Presence struct {
+	Peer   *Peer `json:"peer"`
+	Online bool  `json:"online"`
+}
+
+// Message type forward-open
+type ForwardOpen struct {
+	StreamID uint32 `json:"streamID"`
+	Addr     string `json:"addr"`
+}
+
+// Message type forward-data
+type ForwardData struct {
+	StreamID uint32 `json:"streamID"`
+	Seq      uint32 `json:"seq"`
+	Data     string `json:"data,omitempty"`
+	Close    bool   `json:"close,omitempty"`
+}
+
+// Message type forward-ack
+type ForwardAck struct {
+	StreamID uint32 `json:"streamID"`
+	Seq      uint32 `json:"seq"`
+}
+
+// Message type group-join and group-leave
+type Group struct {
+	Name    string  `json:"name"`
+	Members []*Peer `json:"members,omitempty"`
+	// MAC of the name keyed with the secret of the group, a join needs the one of the members
+	Verifier string `json:"verifier,omitempty"`
+}
+
+// Message type group, sent between the members of a group. Data is the inner
+// message encrypted with the secret of From and To, so that any member can relay it.
+type GroupEnvelope struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Data string `json:"data"`
+}
+
+// Message type group-sender-key
+type GroupSenderKey struct {
+	Group      string `json:"group"`
+	Key        string `json:"key"`
+	SigningKey string `json:"signingKey"`
+}
+
+// Message type group-message, Data is encrypted with the sender key of Sender and signed with its signing key
+type GroupMessage struct {
+	Group     string `json:"group"`
+	Sender    string `json:"sender"`
+	Seq       uint64 `json:"seq"`
+	Data      string `json:"data"`
+	Signature string `json:"signature"`
 }
@@ -1,9 +1,14 @@
 package shared
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"net"
 	"strconv"
+	"time"
+
+	"p2p/crypto"
 )
 
 type Endpoint struct {
@@ -12,16 +17,21 @@ type Endpoint struct {
 }
 
 func (endpoint Endpoint) String() string {
-	return endpoint.IP + ":" + strconv.Itoa(endpoint.Port)
+	return net.JoinHostPort(endpoint.IP, strconv.Itoa(endpoint.Port))
 }
 
 type Peer struct {
-	ID         string       `json:"id,omitempty"`
-	Username   string       `json:"username,omitempty"`
-	Endpoint   Endpoint     `json:"endpoint,omitempty"`
-	PublicKey  string       `json:"publicKey,omitempty"`
-	PrivateKey [32]byte     `json:"-"`
-	Addr       *net.UDPAddr `json:"-"`
+	ID        string   `json:"id,omitempty"`
+	Username  string   `json:"username,omitempty"`
+	Namespace string   `json:"namespace,omitempty"`
+	Endpoint  Endpoint `json:"endpoint,omitempty"`
+	PublicKey string   `json:"publicKey,omitempty"`
+	// Base64 ed25519 key the username is bound to
+	IdentityKey string       `json:"identityKey,omitempty"`
+	PrivateKey  [32]byte     `json:"-"`
+	Addr        *net.UDPAddr `json:"-"`
+	LastSeen    time.Time    `json:"-"`
+	Visible     bool         `json:"-"`
 }
 
 func (peer *Peer) GetPublicKey() ([32]byte, error) {
@@ -40,4 +50,30 @@ func (peer *Peer) SetPublicKey(key [32]byte) {
 	peer.PublicKey = base64.StdEncoding.EncodeToString(key[:])
 }
 
+// Short hash of the identity key to show to users, empty if the peer has no identity key
+func (peer *Peer) Fingerprint() string {
+	key, err := base64.StdEncoding.DecodeString(peer.IdentityKey)
+	if err != nil || len(key) == 0 {
+		return ""
+	}
+
+	hash := sha256.Sum256(key)
+	return hex.EncodeToString(hash[:16])
+}
+
+// Peer ID: SHA-2 + HMAC hash of the public key
+func GenPeerID(pubKey [32]byte) string {
+	return hex.EncodeToString(crypto.Hash("Hashing client public key for client id", pubKey[:]))
+}
+
+// ID of the session between two peers, the same for both peers and the servers introducing them
+// so that their logs can be correlated
+func SessionID(a string, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+
+	return hex.EncodeToString(crypto.Hash("Hashing peer ids for session id", []byte(a+"/"+b))[:8])
+}
+
 type Peers map[string]*Peer
@@ -4,8 +4,12 @@ import (
 	"encoding/base64"
 	"errors"
 	"net"
+	"sync"
 )
 
+// Returned by Send once the transport of the conn stopped
+var ErrConnClosed = errors.New("conn closed")
+
 type UDPPayload struct {
 	Bytes []byte
 	Addr  *net.UDPAddr
@@ -13,8 +17,12 @@ type UDPPayload struct {
 
 type UDPConn struct {
 	sendChan chan *UDPPayload
-	addr     *net.UDPAddr
-	secret   string
+	// Closed once the sender stopped
+	done   <-chan struct{}
+	addr   *net.UDPAddr
+	secret string
+	// Handlers of different datagrams may use the conn concurrently
+	mutex *sync.RWMutex
 }
 
 func convertSecret(secretText string) ([32]byte, error) {
@@ -42,9 +50,12 @@ func (conn *UDPConn) Send(message *Message) error {
 		return err
 	}
 
-	conn.sendChan <- &UDPPayload{Bytes: bytes, Addr: conn.addr}
-
-	return err
+	select {
+	case conn.sendChan <- &UDPPayload{Bytes: bytes, Addr: conn.addr}:
+		return nil
+	case <-conn.done:
+		return ErrConnClosed
+	}
 }
 
 func (conn *UDPConn) Protocol() string {
@@ -56,16 +67,25 @@ func (conn *UDPConn) GetAddr() net.Addr {
 }
 
 func (conn *UDPConn) GetSecret() ([32]byte, error) {
+	conn.mutex.RLock()
+	defer conn.mutex.RUnlock()
+
 	return convertSecret(conn.secret)
 }
 
 func (conn *UDPConn) SetSecret(secret [32]byte) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
 	conn.secret = base64.StdEncoding.EncodeToString(secret[:])
 }
 
-func NewUDPConn(sendChan chan *UDPPayload, addr *net.UDPAddr) *UDPConn {
+// The conn sends through sendChan until done is closed
+func NewUDPConn(sendChan chan *UDPPayload, done <-chan struct{}, addr *net.UDPAddr) *UDPConn {
 	return &UDPConn{
 		sendChan: sendChan,
+		done:     done,
 		addr:     addr,
+		mutex:    &sync.RWMutex{},
 	}
 }
@@ -3,18 +3,10 @@ package shared
 import (
 	"encoding/json"
 	"fmt"
-	"log"
-	"math/rand"
-	"strconv"
-	"time"
 
 	"p2p/crypto"
 )
 
-func init() {
-	rand.Seed(time.Now().Unix())
-}
-
 func MessageIn(conn Conn, bytes []byte) (*Message, error) {
 	message := &Message{}
 	err := json.Unmarshal(bytes, message)
@@ -32,11 +24,13 @@ func MessageIn(conn Conn, bytes []byte) (*Message, error) {
 
 			// unmarshal into Request struct
 			err = json.Unmarshal(bytes, message)
+
+			// Keep track that the message came over the encrypted channel
+			message.Encrypt = err == nil
 		}
 
 		// if there was an error unmarshalling initially and either the message wasn't encrypted or unmarshaling the unencrypted message failed
 		if err != nil {
-			log.Print(err)
 			return message, err
 		}
 	}
@@ -66,7 +60,3 @@ func MessageOut(conn Conn, message *Message) ([]byte, error) {
 
 	return bytes, nil
 }
-
-func GenPort() string {
-	return ":" + strconv.Itoa(rand.Intn(65535-10000)+10000)
-}
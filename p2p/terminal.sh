@@ -1,3 +1,3 @@
 #!/bin/sh
 
-go run terminal/main.go
\ No newline at end of file
+go run terminal/main.go "$@"
\ No newline at end of file
@@ -1,19 +1,57 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"p2p/hole_punching/client"
+	"p2p/logging"
+	"p2p/metrics"
 	"p2p/shared"
 )
 
 func main() {
+	defaults := client.DefaultOptions()
+
+	serverAddr := flag.String("server", defaults.ServerAddr, "Address of the rendez-vous server")
+	serverKey := flag.String("server-key", "", "Expected base64 public key of the rendez-vous server")
+	bindAddr := flag.String("bind", "", "Local address to bind, every interface when empty")
+	ports := flag.String("port", fmt.Sprintf("%d-%d", defaults.PortMin, defaults.PortMax), "Local UDP port or port range (e.g. 40000 or 40000-40100)")
+	punchAttempts := flag.Int("punch-attempts", defaults.PunchAttempts, "Number of connect messages sent to punch the NAT of the other peer")
+	punchInterval := flag.Duration("punch-interval", defaults.PunchInterval, "Delay between two connect messages")
+	keepaliveInterval := flag.Duration("keepalive", defaults.KeepaliveInterval, "Delay between two keepalive messages to the rendez-vous server")
+	reconnectTimeout := flag.Duration("reconnect-timeout", defaults.ReconnectTimeout, "Greet the rendez-vous server again when it has not answered for this long (0 disables it)")
+	expose := flag.String("expose", "", "Comma separated local TCP addresses the other peer may forward to (e.g. 127.0.0.1:8080)")
+	namespace := flag.String("namespace", "", "Namespace of the username on the rendez-vous server")
+	identity := flag.String("identity", "", "Path of the identity key our username is bound to, created if missing (ephemeral key if empty)")
+	blocklist := flag.String("blocklist", "", "File of the blocked identity key fingerprints, one per line")
+	visible := flag.Bool("visible", false, "Let the other peers find us when they browse the online peers")
+	group := flag.String("group", "", "Join a group chat with this name instead of connecting to a single peer")
+	groupSecret := flag.String("group-secret", "", "Secret of the group, only the peers knowing it can join")
+	forward := flag.String("forward", "", "Forward a local TCP address to an address exposed by the other peer (e.g. 127.0.0.1:9000=127.0.0.1:8080)")
+	logLevel := flag.String("log-level", "info", "Log level: debug, info, warn or error")
+	metricsAddr := flag.String("metrics", "", "HTTP address to serve the Prometheus metrics of the client at on /metrics (disabled if empty)")
+	flag.Parse()
+
 	fmt.Println("- Terminal Client - ")
 
+	var err error
+
 	// Get username from user
 	var username string
 	for username == "" || len(username) > 32 {
@@ -26,45 +64,454 @@ func main() {
 
 	fmt.Printf("Nice to meet you %s!\n", username)
 
-	client, err := client.NewClient(username, "127.0.0.1:9001")
+	options := defaults
+	options.ServerAddr = *serverAddr
+	options.ServerKey = *serverKey
+	options.BindAddr = *bindAddr
+	options.PunchAttempts = *punchAttempts
+	options.PunchInterval = *punchInterval
+	options.KeepaliveInterval = *keepaliveInterval
+	options.ReconnectTimeout = *reconnectTimeout
+	options.Visible = *visible
+	options.Namespace = *namespace
+
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	options.Logger, err = logging.New(os.Stderr, level, "text")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *identity != "" {
+		options.IdentityKey, err = loadIdentityKey(*identity)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	options.PortMin, options.PortMax, err = parsePorts(*ports)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	client, err := client.NewClient(username, options)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	client.OnRegistered(registeredCallback)
 	client.OnConnecting(connectingCallback)
 	client.OnConnected(connectedCallback)
 	client.OnMessage(messageCallback)
+	client.OnCode(codeCallback)
+	client.OnAuthenticated(authenticatedCallback)
+	client.OnGroupJoin(groupJoinCallback)
+	client.OnGroupLeave(groupLeaveCallback)
+	client.OnGroupMessage(groupMessageCallback)
+	client.OnList(listCallback)
+	client.OnLookup(lookupCallback)
+	client.OnIncoming(incomingCallback)
+	client.OnEstablishFailed(establishFailedCallback)
+	client.OnResumed(resumedCallback)
+	client.OnDisconnected(disconnectedCallback)
 
-	client.Start()
+	if *blocklist != "" {
+		blocklistPath = *blocklist
+		if err := loadBlocklist(client); err != nil {
+			log.Fatal(err)
+		}
+	}
+	client.OnPresence(presenceCallback)
 
-	exit := make(chan os.Signal)
-	signal.Notify(exit, syscall.SIGINT, syscall.SIGTERM)
-	fmt.Println(<-exit)
+	if *metricsAddr != "" {
+		registry := metrics.NewRegistry()
+		client.SetMetrics(registry)
 
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", registry)
+		go func() {
+			log.Fatal(http.ListenAndServe(*metricsAddr, mux))
+		}()
+	}
+
+	if *expose != "" {
+		for _, addr := range strings.Split(*expose, ",") {
+			client.Expose(strings.TrimSpace(addr))
+			fmt.Printf("Exposing %s to the other peer\n", addr)
+		}
+	}
+
+	if *forward != "" {
+		addrs := strings.SplitN(*forward, "=", 2)
+		if len(addrs) != 2 {
+			log.Fatal("forward must be formatted as localAddr=remoteAddr")
+		}
+
+		listener, err := client.Forward(addrs[0], addrs[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer listener.Close()
+
+		fmt.Printf("Forwarding %s to %s on the other peer\n", addrs[0], addrs[1])
+	}
+
+	// The client stops on the first signal
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := client.Start(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	// The callbacks run on the goroutines of the client, they never wait for the user
+	go run(ctx, client, *group, *groupSecret)
+
+	<-ctx.Done()
 	client.Stop()
 }
 
 // MARK: - Private
 
-func registeredCallback(client *client.Client) {
-	var peerID string
-	for peerID == "" {
-		fmt.Println("PeerID")
-		fmt.Print("> ")
-		if _, err := fmt.Scanln(&peerID); err != nil {
+// Parse a port (40000) or a port range (40000-40100)
+func parsePorts(ports string) (int, int, error) {
+	bounds := strings.SplitN(ports, "-", 2)
+
+	min, err := strconv.Atoi(bounds[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %s", bounds[0])
+	}
+
+	if len(bounds) == 1 {
+		return min, min, nil
+	}
+
+	max, err := strconv.Atoi(bounds[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %s", bounds[1])
+	}
+
+	return min, max, nil
+}
+
+var (
+	lists   = make(chan *shared.PeerList, 1)
+	lookups = make(chan *shared.Peer, 1)
+	// Connection request waiting for an answer
+	incoming atomic.Pointer[shared.Peer]
+	// Signaled when the commands must be read again, e.g. once a connection failed
+	reprompt = make(chan struct{}, 1)
+	// File of the blocked fingerprints, not saved when empty
+	blocklistPath string
+)
+
+// Wait for the registration, then read the commands, or the messages of the group, until the client stops
+func run(ctx context.Context, client *client.Client, group string, groupSecret string) {
+	if err := client.Register(ctx); err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Fatal(err)
+	}
+
+	if group != "" {
+		chat(client, group, groupSecret)
+		return
+	}
+
+	// Get notified when visible peers come online or go offline
+	if err := client.Subscribe(shared.PeerFilter{}); err != nil {
+		log.Print(err)
+	}
+
+	for {
+		prompt(ctx, client)
+
+		select {
+		case <-reprompt:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Read commands until we ask for a connection or accept one
+func prompt(ctx context.Context, client *client.Client) {
+	for {
+		var input string
+		for input == "" {
+			fmt.Println("Type \"list\" (or \"list:prefix\") to browse the online peers, \"code\" to create a pairing code, or enter a pairing code, a username or a PeerID")
+			fmt.Print("> ")
+			if _, err := fmt.Scanln(&input); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		switch {
+		case input == "list" || strings.HasPrefix(input, "list:"):
+			browse(client, strings.TrimPrefix(strings.TrimPrefix(input, "list"), ":"))
+		case input == "accept" || input == "decline" || input == "block":
+			if answer(client, input) {
+				return
+			}
+		case input == "code":
+			if err := client.CreateCode(); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case isPairingCode(input):
+			fmt.Printf("Joining pairing code %s...\n", input)
+
+			if err := client.JoinCode(input); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case isPeerID(input):
+			fmt.Printf("Asking peer %s to connect...\n", input)
+
+			// Failures are reported by the establish failed callback, which prompts again
+			client.Establish(ctx, input)
+			return
+		default:
+			fmt.Printf("Looking up %s...\n", input)
+
+			if err := client.LookupUsername(input); err != nil {
+				log.Fatal(err)
+			}
+
+			select {
+			case peer := <-lookups:
+				fmt.Printf("Asking %s (%s) to connect...\n", peer.Username, peer.ID)
+
+				client.Establish(ctx, peer.ID)
+				return
+			case <-time.After(5 * time.Second):
+				fmt.Printf("%s is not online or not visible\n", input)
+			}
+		}
+	}
+}
+
+// Answer the pending connection request, returns true once accepted
+func answer(client *client.Client, input string) bool {
+	peer := incoming.Swap(nil)
+	if peer == nil {
+		fmt.Println("No pending connection request")
+		return false
+	}
+
+	switch input {
+	case "accept":
+		fmt.Printf("Accepted %s, connecting...\n", peer.Username)
+
+		if err := client.Accept(peer.ID); err != nil {
 			log.Fatal(err)
 		}
+		return true
+	case "block":
+		client.Block(peer.Fingerprint())
+
+		if err := saveBlocklist(client); err != nil {
+			log.Print(err)
+		}
+
+		fmt.Printf("Blocked %s\n", peer.Fingerprint())
+	}
+
+	if err := client.Decline(peer.ID); err != nil {
+		log.Print(err)
 	}
 
-	fmt.Printf("Establishing connection with peer %s...\n", peerID)
+	return false
+}
+
+func incomingCallback(client *client.Client, peer *shared.Peer) {
+	incoming.Store(peer)
 
-	client.SetOtherPeer(&shared.Peer{ID: peerID})
-	client.GetRDVServerConn().Send(&shared.Message{
-		Type:    "establish",
-		PeerID:  client.GetCurrentPeer().ID,
-		Content: peerID,
-	})
+	fmt.Printf("\n%s (%s) wants to connect\n", peer.Username, peer.ID)
+	fmt.Printf("Identity key fingerprint: %s\n", peer.Fingerprint())
+	fmt.Println("Type \"accept\", \"decline\" or \"block\"")
+	fmt.Print("> ")
+}
+
+func establishFailedCallback(client *client.Client, err error) {
+	switch {
+	case errors.Is(err, shared.ErrUnknownPeer):
+		fmt.Printf("%s, type list to browse the visible peers\n", err)
+	case errors.Is(err, shared.ErrRateLimited):
+		fmt.Println("Too many connection requests, wait a bit before trying again")
+	default:
+		fmt.Println(err)
+	}
+
+	select {
+	case reprompt <- struct{}{}:
+	default:
+	}
+}
+
+// Blocked fingerprints, one per line
+func loadBlocklist(client *client.Client) error {
+	text, err := os.ReadFile(blocklistPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, fingerprint := range strings.Fields(string(text)) {
+		client.Block(fingerprint)
+	}
+
+	return nil
+}
+
+func saveBlocklist(client *client.Client) error {
+	if blocklistPath == "" {
+		return nil
+	}
+
+	blocked := client.GetBlocked()
+	return os.WriteFile(blocklistPath, []byte(strings.Join(blocked, "\n")+"\n"), 0600)
+}
+
+// Pairing codes look like 7-crossword-maple
+func isPairingCode(input string) bool {
+	words := strings.Split(input, "-")
+	_, err := strconv.Atoi(words[0])
+	return len(words) == 3 && err == nil
+}
+
+// Peer IDs are hex encoded 32 bytes hashes
+func isPeerID(input string) bool {
+	bytes, err := hex.DecodeString(input)
+	return err == nil && len(bytes) == 32
+}
+
+func lookupCallback(client *client.Client, peer *shared.Peer) {
+	select {
+	case lookups <- peer:
+	default:
+	}
+}
+
+// Load the identity key binding our username, or generate and save it on first start
+func loadIdentityKey(path string) (ed25519.PrivateKey, error) {
+	text, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		encoded := base64.StdEncoding.EncodeToString(key.Seed())
+		return key, os.WriteFile(path, []byte(encoded+"\n"), 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(text)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s does not contain a base64 encoded %d bytes seed", path, ed25519.SeedSize)
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// Join the group and send every line read to its members
+func chat(client *client.Client, group string, secret string) {
+	fmt.Printf("Joining group %s...\n", group)
+
+	if err := client.JoinGroup(group, secret); err != nil {
+		log.Fatal(err)
+	}
+
+	for {
+		var text string
+		for text == "" {
+			fmt.Print("> ")
+			if _, err := fmt.Scanln(&text); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if err := client.SendGroupMessage(group, text); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func groupJoinCallback(client *client.Client, group string, peer *shared.Peer) {
+	fmt.Printf("%s (%s) joined %s\n", peer.Username, peer.ID, group)
+}
+
+func groupLeaveCallback(client *client.Client, group string, peer *shared.Peer) {
+	fmt.Printf("%s left %s\n", peer.Username, group)
+}
+
+func groupMessageCallback(client *client.Client, group string, peer *shared.Peer, text string) {
+	fmt.Printf("[%s] %s: %s\n", group, peer.Username, text)
+}
+
+// Print the visible online peers whose username starts with prefix, page by page
+func browse(client *client.Client, prefix string) {
+	filter := shared.PeerFilter{Username: prefix}
+
+	for {
+		if err := client.List(filter); err != nil {
+			log.Print(err)
+			return
+		}
+
+		select {
+		case list := <-lists:
+			for _, peer := range list.Peers {
+				fmt.Printf("%s\t%s\n", peer.Username, peer.ID)
+			}
+
+			if filter.Offset == 0 && len(list.Peers) == 0 {
+				fmt.Println("No visible peer online")
+			}
+
+			if !list.More {
+				return
+			}
+
+			filter.Offset += len(list.Peers)
+		case <-time.After(5 * time.Second):
+			log.Print("The rendez-vous server did not answer the list request")
+			return
+		}
+	}
+}
+
+func listCallback(client *client.Client, list *shared.PeerList) {
+	select {
+	case lists <- list:
+	default:
+	}
+}
+
+func presenceCallback(client *client.Client, peer *shared.Peer, online bool) {
+	if online {
+		fmt.Printf("%s (%s) is online\n", peer.Username, peer.ID)
+	} else {
+		fmt.Printf("%s is offline\n", peer.Username)
+	}
+}
+
+func codeCallback(client *client.Client, code string) {
+	fmt.Printf("Pairing code: %s\n", code)
+	fmt.Println("Waiting for the other peer to join it...")
+}
+
+func authenticatedCallback(client *client.Client) {
+	fmt.Println("The other peer proved it knows the pairing code, the rendez-vous server cannot read this session")
 }
 
 func connectingCallback(client *client.Client) {
@@ -77,6 +524,14 @@ func connectingCallback(client *client.Client) {
 	fmt.Printf("Address: %s\n\n", peerConn.GetAddr())
 }
 
+func resumedCallback(client *client.Client) {
+	fmt.Printf("Resumed the session with %s from %s\n", client.GetOtherPeer().Username, client.GetOtherPeerConn().GetAddr())
+}
+
+func disconnectedCallback(client *client.Client) {
+	fmt.Printf("%s left\n", client.GetOtherPeer().Username)
+}
+
 func connectedCallback(client *client.Client) {
 	peer := client.GetOtherPeer()
 
@@ -93,19 +548,10 @@ func connectedCallback(client *client.Client) {
 				}
 			}
 
-			currentPeer := client.GetCurrentPeer()
-			otherPeerConn := client.GetOtherPeerConn()
-
-			if otherPeerConn == nil {
-				log.Println("No Peer connected yet!")
+			if err := client.Send(context.Background(), text); err != nil {
+				log.Println(err)
 				return
 			}
-
-			otherPeerConn.Send(&shared.Message{
-				Type:    "message",
-				PeerID:  currentPeer.ID,
-				Content: text,
-			})
 		}
 	}()
 }